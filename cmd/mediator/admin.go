@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/admin"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// adminAPI is the mediator's administrative HTTP API, served on a listener of its own.
+// Requests must carry the admin token as a bearer token.
+type adminAPI struct {
+	m     *mediator
+	addr  string
+	token string
+}
+
+// newAdminAPI creates the admin API, or returns nil if no admin token is configured.
+func newAdminAPI(m *mediator, cfg *mediatorConfig) *adminAPI {
+	if cfg.AdminToken == "" {
+		return nil
+	}
+
+	return &adminAPI{
+		m:     m,
+		addr:  cfg.AdminAddr,
+		token: cfg.AdminToken,
+	}
+}
+
+func (a *adminAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", a.sessions)
+	mux.HandleFunc("/kick", a.kick)
+	mux.HandleFunc("/broadcast", a.broadcast)
+	mux.HandleFunc("/drain", a.drain)
+
+	faults := a.m.faults.AdminHandler("/faults")
+	mux.Handle("/faults", faults)
+	mux.Handle("/faults/", faults)
+
+	return admin.RequireToken(a.token, mux)
+}
+
+// sessionInfo describes a live session, as listed by the admin API.
+type sessionInfo struct {
+	RoomID      string    `json:"roomId"`
+	UserID      string    `json:"userId"`
+	Username    string    `json:"username"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	Version     int       `json:"version"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	QueueDepth  int       `json:"queueDepth"`
+}
+
+// sessions lists the live sessions of players who said hello, optionally filtered by the room query parameter.
+func (a *adminAPI) sessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomID, filtered := r.URL.Query()["room"]
+
+	infos := []sessionInfo{}
+	for _, hr := range a.m.rooms {
+		if filtered && hr.id != roomID[0] {
+			continue
+		}
+
+		for _, session := range hr.sessions.GetUserSessions() {
+			user := session.User()
+			infos = append(infos, sessionInfo{
+				RoomID:      hr.id,
+				UserID:      user.UserID,
+				Username:    user.Username,
+				RemoteAddr:  session.Conn.RemoteAddr().String(),
+				Version:     session.Version(),
+				ConnectedAt: session.ConnectedAt,
+				QueueDepth:  session.QueueDepth(),
+			})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// kickRequest is the request body accepted by the kick endpoint.
+type kickRequest struct {
+	// RoomID limits the kick to a single room, or is empty to kick the user from every room.
+	RoomID string `json:"roomId,omitempty"`
+	UserID string `json:"userId"`
+}
+
+// kick removes a user from the room(s), closing all of their sessions, and telling the room service they left.
+func (a *adminAPI) kick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req kickRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.UserID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	span := a.m.tracer.StartSpan("admin.kick", trace.SpanContext{})
+	span.SetAttribute("userId", req.UserID)
+	defer span.Finish()
+
+	kicked := 0
+	for _, hr := range a.m.rooms {
+		if req.RoomID != "" && hr.id != req.RoomID {
+			continue
+		}
+
+		sessions := hr.sessions.GetSessionsOfUser(req.UserID)
+		if len(sessions) == 0 {
+			continue
+		}
+
+		trace.Log(span).WithFields(logrus.Fields{
+			"roomId":   hr.id,
+			"userId":   req.UserID,
+			"sessions": len(sessions),
+		}).Infof("Kicking user")
+
+		a.m.evict(span, hr, sessions, "You have been removed from the room", disconnectKicked)
+		kicked += len(sessions)
+	}
+
+	if kicked == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": kicked})
+}
+
+// broadcastRequest is the request body accepted by the broadcast endpoint.
+type broadcastRequest struct {
+	// RoomID limits the announcement to a single room, or is empty to send it to every room.
+	RoomID  string `json:"roomId,omitempty"`
+	Content string `json:"content"`
+}
+
+// broadcast sends a system announcement to every player in the room(s), on every mediator replica.
+func (a *adminAPI) broadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req broadcastRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Content == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if req.RoomID != "" {
+		if _, ok := a.m.rooms[req.RoomID]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	span := a.m.tracer.StartSpan("admin.broadcast", trace.SpanContext{})
+	defer span.Finish()
+
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, "*", gameon.Event{
+		Type: gameon.TypeEvent,
+		Content: map[string]string{
+			"*": req.Content,
+		},
+	})
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error creating announcement message")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, hr := range a.m.rooms {
+		if req.RoomID != "" && hr.id != req.RoomID {
+			continue
+		}
+
+		trace.Log(span).WithField("roomId", hr.id).Infof("Broadcasting system announcement")
+		a.m.fanout.Publish(span, hr, []gameon.Message{*msg})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// drain handles POST /drain, ahead of taking the mediator replica out of rotation,
+// and responds with the number of sessions drained.
+func (a *adminAPI) drain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	span := a.m.tracer.StartSpan("admin.drain", trace.SpanContext{})
+	defer span.Finish()
+
+	drained := a.m.drain(span)
+
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": drained})
+}
+
+// drain stops the mediator from accepting new sessions, and removes every player from their room.
+// It returns the number of sessions closed.
+func (m *mediator) drain(span *trace.Span) int {
+	atomic.StoreInt32(&m.draining, 1)
+	trace.Log(span).Infof("Draining mediator")
+
+	drained := 0
+	for _, hr := range m.rooms {
+		users := make(map[string][]*Session)
+		for _, session := range hr.sessions.GetUserSessions() {
+			userID := session.UserID()
+			users[userID] = append(users[userID], session)
+		}
+
+		for _, sessions := range users {
+			m.evict(span, hr, sessions, "The room is restarting, please come back in a moment", disconnectDrained)
+			drained += len(sessions)
+		}
+	}
+
+	return drained
+}
+
+// evict removes a user from the room on the mediator's initiative:
+// the user's sessions are sent a notice and closed, and the room service is told the user left.
+func (m *mediator) evict(span *trace.Span, hr *hostedRoom, sessions []*Session, notice string, reason disconnectReason) {
+	user := sessions[0].User()
+	version := sessions[0].Version()
+
+	// Sessions are marked as leaving before being closed, so that the user's state isn't kept for recovery
+	for _, session := range sessions {
+		session.Leave()
+	}
+
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, user.UserID, gameon.Event{
+		Type: gameon.TypeEvent,
+		Content: map[string]string{
+			user.UserID: notice,
+		},
+	})
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error creating eviction notice")
+	} else {
+		sendMessage(span, msg, sessions...)
+	}
+
+	for _, session := range sessions {
+		session.CloseWithReason(reason)
+	}
+
+	goodbye := &gameon.Goodbye{UserInfo: user}
+	client := hr.clientFor(span, user, sessions[0])
+	resp, err := client.Goodbye(span, goodbye, version)
+	if err != nil {
+		trace.Log(span).WithError(err).WithFields(logrus.Fields{
+			"roomId": hr.id,
+			"userId": user.UserID,
+		}).Errorf("Error saying goodbye to room service for evicted user")
+		return
+	}
+
+	m.mirror(span, hr, client, "/goodbye", user, goodbye, resp, func(span *trace.Span, shadow *room) (*gameon.MessageCollection, error) {
+		return shadow.Goodbye(span, goodbye, version)
+	})
+
+	m.handleResponse(span, hr, resp, nil)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, obj interface{}) {
+	bytes, err := json.Marshal(obj)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(bytes)
+}
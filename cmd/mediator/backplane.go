@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// envelope carries a batch of messages published to the backplane,
+// to be delivered to the sessions of a room on every mediator replica.
+type envelope struct {
+	// Origin is the ID of the replica that published the envelope.
+	Origin string `json:"origin"`
+	// Epoch identifies the process of the origin replica that published the envelope, by its boot time,
+	// so that sequence numbers starting over when a replica restarts with the same ID aren't taken for duplicates.
+	Epoch int64 `json:"epoch"`
+	// Seq orders the envelopes published by the origin replica's process for the room, starting from 1.
+	Seq      uint64           `json:"seq"`
+	RoomID   string           `json:"roomId"`
+	Messages []gameon.Message `json:"messages"`
+	// Traceparent carries the context of the span that published the envelope, in the W3C traceparent format.
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+// backplane is a pub/sub channel shared by all mediator replicas,
+// so that messages reach sessions of a room regardless of the replica they are connected to.
+type backplane interface {
+	// Publish sends the envelope to the subscribers on every replica, including the publishing one.
+	Publish(env *envelope) error
+
+	// Subscribe registers a handler for the envelopes published by every replica.
+	Subscribe(handler func(env *envelope)) error
+
+	Close() error
+}
+
+func newBackplane(kind, url string) (backplane, error) {
+	switch kind {
+	case "memory":
+		return newMemoryBackplane(), nil
+	case "redis":
+		return newRedisBackplane(url)
+	default:
+		return nil, fmt.Errorf("unsupported backplane: %s", kind)
+	}
+}
+
+// memoryBackplane is a backplane for a single mediator replica, delivering envelopes to its subscribers synchronously.
+type memoryBackplane struct {
+	handlers []func(env *envelope)
+	mutex    sync.RWMutex
+}
+
+func newMemoryBackplane() *memoryBackplane {
+	return &memoryBackplane{}
+}
+
+func (b *memoryBackplane) Publish(env *envelope) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, handler := range b.handlers {
+		handler(env)
+	}
+	return nil
+}
+
+func (b *memoryBackplane) Subscribe(handler func(env *envelope)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *memoryBackplane) Close() error {
+	return nil
+}
+
+// fanout publishes room messages to the backplane, and delivers the ones received from it to local sessions.
+// Envelopes from each origin replica are delivered once, in the order published for their room.
+type fanout struct {
+	backplane backplane
+	replicaID string
+	epoch     int64
+
+	published map[string]*roomPublisher
+	pubMutex  sync.Mutex
+
+	delivered map[string]deliveredSeq
+	subMutex  sync.Mutex
+}
+
+// roomPublisher sequences the envelopes published for a room.
+type roomPublisher struct {
+	seq   uint64
+	mutex sync.Mutex
+}
+
+// deliveredSeq is the last envelope delivered from an origin replica's process for a room.
+type deliveredSeq struct {
+	epoch int64
+	seq   uint64
+}
+
+func newFanout(backplane backplane, replicaID string) *fanout {
+	if replicaID == "" {
+		hostname, _ := os.Hostname()
+		replicaID = fmt.Sprintf("%s-%d-%08x", hostname, os.Getpid(), rand.Uint32())
+	}
+
+	return &fanout{
+		backplane: backplane,
+		replicaID: replicaID,
+		epoch:     time.Now().UnixNano(),
+		published: make(map[string]*roomPublisher),
+		delivered: make(map[string]deliveredSeq),
+	}
+}
+
+// publisher returns the room's publisher, creating it on first use.
+func (f *fanout) publisher(roomID string) *roomPublisher {
+	f.pubMutex.Lock()
+	defer f.pubMutex.Unlock()
+
+	p, ok := f.published[roomID]
+	if !ok {
+		p = &roomPublisher{}
+		f.published[roomID] = p
+	}
+	return p
+}
+
+// Publish sends messages to the sessions of the room on every replica.
+// If the backplane fails, the messages are delivered to local sessions only.
+func (f *fanout) Publish(span *trace.Span, hr *hostedRoom, messages []gameon.Message) {
+	// Publishing is serialized per room, so that envelopes reach the backplane in sequence order,
+	// without a slow publish holding up other rooms
+	p := f.publisher(hr.id)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.seq++
+	env := &envelope{
+		Origin:   f.replicaID,
+		Epoch:    f.epoch,
+		Seq:      p.seq,
+		RoomID:   hr.id,
+		Messages: messages,
+
+		Traceparent: span.Context.Traceparent(),
+	}
+
+	err := f.backplane.Publish(env)
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error publishing to backplane, delivering to local sessions only")
+		deliverMessages(span, hr, messages)
+	}
+}
+
+// Accept returns true if the envelope should be delivered,
+// or false if it is a duplicate or arrived after a later envelope from the same origin and room.
+// Sequence numbers start over when the origin replica restarts: envelopes from a later epoch than the last one
+// delivered are accepted from their first, while envelopes from an earlier epoch are left over from a previous process.
+func (f *fanout) Accept(span *trace.Span, env *envelope) bool {
+	f.subMutex.Lock()
+	defer f.subMutex.Unlock()
+
+	key := env.Origin + "/" + env.RoomID
+	last := f.delivered[key]
+	switch {
+	case env.Epoch < last.epoch:
+		return false
+	case env.Epoch > last.epoch:
+		if last.epoch != 0 {
+			trace.Log(span).Infof("Backplane envelopes from %s for room %q restarted from a new epoch", env.Origin, env.RoomID)
+		}
+		last = deliveredSeq{epoch: env.Epoch}
+	}
+
+	if env.Seq <= last.seq {
+		return false
+	}
+
+	if env.Seq > last.seq+1 && last.seq != 0 {
+		trace.Log(span).Warnf("Backplane envelopes %d-%d from %s for room %q were lost", last.seq+1, env.Seq-1, env.Origin, env.RoomID)
+	}
+	f.delivered[key] = deliveredSeq{epoch: env.Epoch, seq: env.Seq}
+	return true
+}
+
+// deliverMessages dispatches messages to the room's local sessions:
+// broadcasts to every session, and other messages to all sessions of their recipient.
+func deliverMessages(span *trace.Span, hr *hostedRoom, messages []gameon.Message) {
+	for _, msg := range messages {
+		if msg.Recipient == "*" {
+			sessions := hr.sessions.GetUserSessions()
+			sendMessage(span, &msg, sessions...)
+			broadcastFanout.Observe(float64(len(sessions)), hr.id)
+		} else {
+			sendMessage(span, &msg, hr.sessions.GetSessionsOfUser(msg.Recipient)...)
+		}
+	}
+}
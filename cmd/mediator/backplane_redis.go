@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// redisChannelPrefix prefixes the Redis channel of each room, e.g., chatter:room:<room id>.
+const redisChannelPrefix = "chatter:room:"
+
+// redisMaxIdle is the number of idle publishing connections kept open for reuse.
+const redisMaxIdle = 8
+
+// redisBackplane is a backplane shared by mediator replicas through Redis pub/sub.
+// It speaks the Redis protocol (RESP) directly, using a pool of connections for publishing, so that rooms publish
+// concurrently, and another connection for subscribing. Connections are re-established as needed.
+type redisBackplane struct {
+	address  string
+	password string
+	timeout  time.Duration
+
+	idle      []*redisConn
+	idleMutex sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newRedisBackplane creates a backplane for the Redis server at the given URL (e.g., redis://:password@redis:6379).
+func newRedisBackplane(serverURL string) (*redisBackplane, error) {
+	if serverURL == "" {
+		serverURL = "redis://localhost:6379"
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis url: %s", serverURL)
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	password := ""
+	if u.User != nil {
+		password, _ = u.User.Password()
+	}
+
+	return &redisBackplane{
+		address:  address,
+		password: password,
+		timeout:  5 * time.Second,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func (b *redisBackplane) Publish(env *envelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	conn, err := b.getConn()
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do(b.timeout, "PUBLISH", redisChannelPrefix+env.RoomID, string(payload))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	b.putConn(conn)
+	return nil
+}
+
+// getConn returns an idle publishing connection, or a new one if none is idle.
+func (b *redisBackplane) getConn() (*redisConn, error) {
+	b.idleMutex.Lock()
+	if n := len(b.idle); n > 0 {
+		conn := b.idle[n-1]
+		b.idle = b.idle[:n-1]
+		b.idleMutex.Unlock()
+		return conn, nil
+	}
+	b.idleMutex.Unlock()
+
+	return b.dial()
+}
+
+// putConn returns a publishing connection to the pool, or closes it if the pool is full or the backplane is closed.
+func (b *redisBackplane) putConn(conn *redisConn) {
+	b.idleMutex.Lock()
+	defer b.idleMutex.Unlock()
+
+	select {
+	case <-b.done:
+		conn.Close()
+		return
+	default:
+	}
+
+	if len(b.idle) >= redisMaxIdle {
+		conn.Close()
+		return
+	}
+	b.idle = append(b.idle, conn)
+}
+
+// Subscribe subscribes to the channels of all rooms, and dispatches envelopes to the handler from a background goroutine.
+// The subscription is re-established with a backoff whenever its connection fails.
+func (b *redisBackplane) Subscribe(handler func(env *envelope)) error {
+	conn, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		backoff := 100 * time.Millisecond
+		for {
+			err := b.receive(conn, handler)
+
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+
+			logrus.WithError(err).Errorf("Backplane subscription lost, resubscribing in %s", backoff)
+			time.Sleep(backoff)
+
+			conn, err = b.subscribe()
+			if err != nil {
+				if backoff < 10*time.Second {
+					backoff *= 2
+				}
+				conn = nil
+				continue
+			}
+			backoff = 100 * time.Millisecond
+		}
+	}()
+
+	return nil
+}
+
+func (b *redisBackplane) subscribe() (*redisConn, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Send(b.timeout, "PSUBSCRIBE", redisChannelPrefix+"*")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// receive dispatches the envelopes received on a subscribed connection, until the connection fails.
+func (b *redisBackplane) receive(conn *redisConn, handler func(env *envelope)) error {
+	if conn == nil {
+		return fmt.Errorf("not subscribed")
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	defer conn.Close()
+
+	// Closing the backplane interrupts the blocking receive
+	go func() {
+		select {
+		case <-b.done:
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	for {
+		reply, err := conn.Receive(0)
+		if err != nil {
+			return err
+		}
+
+		// Pattern subscription messages are of the form: ["pmessage", <pattern>, <channel>, <payload>]
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 4 || parts[0] != "pmessage" {
+			continue
+		}
+
+		payload, _ := parts[3].(string)
+		var env envelope
+		err = json.Unmarshal([]byte(payload), &env)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error unmarshaling backplane envelope")
+			continue
+		}
+
+		handler(&env)
+	}
+}
+
+func (b *redisBackplane) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+
+	b.idleMutex.Lock()
+	defer b.idleMutex.Unlock()
+
+	for _, conn := range b.idle {
+		conn.Close()
+	}
+	b.idle = nil
+	return nil
+}
+
+func (b *redisBackplane) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", b.address, b.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+	}
+
+	if b.password != "" {
+		_, err := conn.Do(b.timeout, "AUTH", b.password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// redisConn is a connection to a Redis server, speaking just enough of RESP for pub/sub.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Do sends a command and returns its reply.
+func (c *redisConn) Do(timeout time.Duration, args ...string) (interface{}, error) {
+	err := c.Send(timeout, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Receive(timeout)
+}
+
+// Send writes a command as a RESP array of bulk strings.
+func (c *redisConn) Send(timeout time.Duration, args ...string) error {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := io.WriteString(c.conn, buf.String())
+	return err
+}
+
+// Receive reads a single reply, waiting up to the timeout (or indefinitely, for a zero timeout).
+// Error replies are returned as errors.
+func (c *redisConn) Receive(timeout time.Duration) (interface{}, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	c.conn.SetReadDeadline(deadline)
+
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid redis reply: %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk string length: %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(c.reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length: %q", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+
+		elements := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			element, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+		return elements, nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply: %q", line)
+	}
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server, speaking enough of RESP for AUTH, PUBLISH and PSUBSCRIBE.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	clients map[*fakeRedisClient]bool
+	mutex   sync.Mutex
+}
+
+type fakeRedisClient struct {
+	conn    net.Conn
+	pattern string
+	mutex   sync.Mutex
+}
+
+func (c *fakeRedisClient) write(reply string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	io.WriteString(c.conn, reply)
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeRedis{
+		listener: listener,
+		password: password,
+		clients:  make(map[*fakeRedisClient]bool),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	client := &fakeRedisClient{conn: conn}
+	s.mutex.Lock()
+	s.clients[client] = true
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.clients, client)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	// Commands are arrays of bulk strings, which parse as replies do
+	reader := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	authenticated := s.password == ""
+	for {
+		reply, err := reader.readReply()
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]interface{})
+		if len(args) == 0 {
+			client.write("-ERR empty command\r\n")
+			continue
+		}
+
+		switch {
+		case args[0] == "AUTH" && len(args) == 2:
+			if args[1] != s.password {
+				client.write("-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			client.write("+OK\r\n")
+		case !authenticated:
+			client.write("-NOAUTH Authentication required.\r\n")
+		case args[0] == "PUBLISH" && len(args) == 3:
+			n := s.publish(args[1].(string), args[2].(string))
+			client.write(fmt.Sprintf(":%d\r\n", n))
+		case args[0] == "PSUBSCRIBE" && len(args) == 2:
+			pattern := args[1].(string)
+			s.mutex.Lock()
+			client.pattern = pattern
+			s.mutex.Unlock()
+			client.write(fmt.Sprintf("*3\r\n$10\r\npsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(pattern), pattern))
+		default:
+			client.write(fmt.Sprintf("-ERR unknown command %v\r\n", args[0]))
+		}
+	}
+}
+
+// publish sends the message to the clients subscribed to the channel, returning their number.
+func (s *fakeRedis) publish(channel, message string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for client := range s.clients {
+		if matched, _ := path.Match(client.pattern, channel); client.pattern != "" && matched {
+			client.write(respArray("pmessage", client.pattern, channel, message))
+			n++
+		}
+	}
+	return n
+}
+
+// disconnect drops all client connections, as a restarting server would.
+func (s *fakeRedis) disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for client := range s.clients {
+		client.conn.Close()
+	}
+}
+
+func (s *fakeRedis) close() {
+	s.listener.Close()
+	s.disconnect()
+}
+
+// respArray encodes an array of bulk strings.
+func respArray(elements ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(elements))
+	for _, element := range elements {
+		reply += fmt.Sprintf("$%d\r\n%s\r\n", len(element), element)
+	}
+	return reply
+}
+
+// publishUntilReceived publishes the envelope until the subscriber receives it, since a subscription only takes effect
+// once the server handles it, and the first publish after a disconnection fails.
+func publishUntilReceived(t *testing.T, b *redisBackplane, received <-chan *envelope, env *envelope) {
+	deadline := time.After(5 * time.Second)
+	for {
+		b.Publish(env)
+
+		select {
+		case got := <-received:
+			if got.Seq != env.Seq {
+				// A duplicate of an earlier envelope
+				continue
+			}
+			if got.Origin != env.Origin || got.RoomID != env.RoomID || len(got.Messages) != len(env.Messages) {
+				t.Fatalf("received envelope %+v, want %+v", got, env)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("envelope %d was never received", env.Seq)
+		}
+	}
+}
+
+// TestRedisBackplane verifies that envelopes published to Redis are delivered to pattern subscribers,
+// and that both publishing and subscribing recover once the server drops their connections.
+func TestRedisBackplane(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.close()
+
+	b, err := newRedisBackplane("redis://:secret@" + server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	received := make(chan *envelope, 64)
+	err = b.Subscribe(func(env *envelope) {
+		received <- env
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishUntilReceived(t, b, received, &envelope{Origin: "replica-1", Epoch: 1, Seq: 1, RoomID: "room"})
+
+	server.disconnect()
+
+	publishUntilReceived(t, b, received, &envelope{Origin: "replica-1", Epoch: 1, Seq: 2, RoomID: "room"})
+}
+
+func TestRedisBackplaneRejectsWrongPassword(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.close()
+
+	b, err := newRedisBackplane("redis://:wrong@" + server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	err = b.Publish(&envelope{Origin: "replica-1", Epoch: 1, Seq: 1, RoomID: "room"})
+	if err == nil {
+		t.Errorf("publishing with the wrong password succeeded")
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go io.WriteString(server, "+OK\r\n:42\r\n$-1\r\n*2\r\n$3\r\nfoo\r\n*1\r\n$0\r\n\r\n-ERR oops\r\n")
+
+	conn := &redisConn{conn: client, reader: bufio.NewReader(client)}
+	want := []interface{}{"OK", int64(42), nil, []interface{}{"foo", []interface{}{""}}}
+	for _, w := range want {
+		got, err := conn.readReply()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(w) {
+			t.Errorf("got reply %#v, want %#v", got, w)
+		}
+	}
+
+	_, err := conn.readReply()
+	if err == nil || err.Error() != "redis error: ERR oops" {
+		t.Errorf("got error %v, want redis error", err)
+	}
+}
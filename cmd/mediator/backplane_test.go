@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFanoutAccept(t *testing.T) {
+	f := newFanout(newMemoryBackplane(), "replica-1")
+
+	steps := []struct {
+		name   string
+		env    envelope
+		accept bool
+	}{
+		{"first", envelope{Origin: "replica-2", Epoch: 100, Seq: 1, RoomID: "room"}, true},
+		{"next", envelope{Origin: "replica-2", Epoch: 100, Seq: 2, RoomID: "room"}, true},
+		{"duplicate", envelope{Origin: "replica-2", Epoch: 100, Seq: 2, RoomID: "room"}, false},
+		{"late", envelope{Origin: "replica-2", Epoch: 100, Seq: 1, RoomID: "room"}, false},
+		{"after a gap", envelope{Origin: "replica-2", Epoch: 100, Seq: 5, RoomID: "room"}, true},
+		{"other room", envelope{Origin: "replica-2", Epoch: 100, Seq: 1, RoomID: "other"}, true},
+		{"other origin", envelope{Origin: "replica-3", Epoch: 100, Seq: 1, RoomID: "room"}, true},
+		{"origin restarted", envelope{Origin: "replica-2", Epoch: 200, Seq: 1, RoomID: "room"}, true},
+		{"restarted origin's next", envelope{Origin: "replica-2", Epoch: 200, Seq: 2, RoomID: "room"}, true},
+		{"previous process", envelope{Origin: "replica-2", Epoch: 100, Seq: 6, RoomID: "room"}, false},
+	}
+
+	for _, step := range steps {
+		env := step.env
+		if got := f.Accept(nil, &env); got != step.accept {
+			t.Errorf("%s: Accept(%+v) = %v, want %v", step.name, env, got, step.accept)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/config"
+)
+
+// mediatorConfig holds the mediator's settings, loaded from a configuration file, environment variables and flags.
+// Settings marked reload are applied again on SIGHUP.
+type mediatorConfig struct {
+	Listen          string        `key:"listen" env:"LISTEN_ADDR" default:":3000" usage:"Address serving websocket connections, pushes and metrics"`
+	LogLevel        string        `key:"log.level" env:"LOG_LEVEL" default:"debug" options:"debug,info,warning,error" reload:"true" usage:"Log level"`
+	ShutdownTimeout time.Duration `key:"shutdown.timeout" env:"SHUTDOWN_TIMEOUT" default:"10s" min:"0s" usage:"Time allowed for draining sessions on shutdown"`
+	HealthTimeout   time.Duration `key:"health.timeout" env:"HEALTH_TIMEOUT" default:"2s" min:"1ms" usage:"Timeout of each readiness check"`
+
+	RoomID         string `key:"room.id" env:"ROOM_ID" usage:"ID of the single hosted room, unless a routes file is set"`
+	RoomName       string `key:"room.name" env:"ROOM_NAME" default:"Chatter" usage:"Name of the single hosted room, shown to players when its service fails, unless a routes file is set"`
+	RoomPushID     string `key:"room.push_id" env:"ROOM_PUSH_ID" default:"room" usage:"ID the single hosted room's service signs pushed messages with, unless a routes file is set"`
+	RoomServiceURL string `key:"room.url" env:"ROOM_SERVICE_URL" default:"http://localhost:6379/room" usage:"URL of the single hosted room's service, unless a routes file is set"`
+	RoutesFile     string `key:"routes.file" env:"ROUTES_FILE" usage:"File mapping the hosted room IDs to their room services"`
+	RoutingRules   string `key:"routing.rules_file" env:"ROUTING_RULES_FILE" reload:"true" usage:"File with rules routing room service requests between named backends"`
+	MirrorReport   string `key:"mirror.report_file" env:"MIRROR_REPORT_FILE" usage:"File recording shadow responses differing from primary ones (logged if not set)"`
+
+	RoomTimeout          time.Duration `key:"room.timeout" env:"ROOM_TIMEOUT" default:"5s" min:"1ms" usage:"Timeout of room service requests"`
+	RoomRetries          int           `key:"room.retries" env:"ROOM_RETRIES" default:"2" min:"0" usage:"Retries of failed room service requests"`
+	RoomRetryBackoff     time.Duration `key:"room.retry_backoff" env:"ROOM_RETRY_BACKOFF" default:"100ms" min:"1ms" usage:"Initial backoff between room service request retries"`
+	RoomMaxRetryBackoff  time.Duration `key:"room.max_retry_backoff" env:"ROOM_MAX_RETRY_BACKOFF" default:"2s" min:"1ms" usage:"Maximal backoff between room service request retries"`
+	RoomBreakerThreshold int           `key:"room.breaker_threshold" env:"ROOM_BREAKER_THRESHOLD" default:"5" min:"0" usage:"Consecutive room service failures opening the circuit breaker (0 disables it)"`
+	RoomBreakerCooldown  time.Duration `key:"room.breaker_cooldown" env:"ROOM_BREAKER_COOLDOWN" default:"10s" min:"1ms" usage:"Time the circuit breaker stays open before probing the room service"`
+	RoomMaxConcurrent    int           `key:"room.max_concurrent" env:"ROOM_MAX_CONCURRENT" default:"32" min:"1" usage:"Maximal outstanding requests per room service"`
+
+	RecoveryWindow    time.Duration `key:"recovery.window" env:"RECOVERY_WINDOW" default:"5m" min:"0s" usage:"Time a disconnected player's session can be recovered within"`
+	ConcurrentLogins  string        `key:"concurrent_logins" env:"CONCURRENT_LOGINS" default:"allow" options:"allow,forbid" reload:"true" usage:"Whether players may join from several sessions at once"`
+	IdentityPolicy    string        `key:"identity.policy" env:"IDENTITY_POLICY" default:"reject" options:"reject,overwrite" reload:"true" usage:"Handling of messages claiming a foreign identity"`
+	FeedbackTemplates string        `key:"feedback.templates_file" env:"FEEDBACK_TEMPLATES_FILE" reload:"true" usage:"File overriding the messages sent to players when the room service fails"`
+
+	SessionQueueSize   int           `key:"session.queue_size" env:"SESSION_QUEUE_SIZE" default:"64" min:"1" usage:"Outbound message queue size of every session"`
+	WriteTimeout       time.Duration `key:"session.write_timeout" env:"WRITE_TIMEOUT" default:"10s" min:"1ms" usage:"Timeout of websocket writes"`
+	SlowConsumerPolicy string        `key:"session.slow_consumer_policy" env:"SLOW_CONSUMER_POLICY" default:"drop" options:"drop,disconnect,coalesce" usage:"Handling of messages to sessions whose queue is full"`
+
+	PingInterval   time.Duration `key:"keepalive.ping_interval" env:"PING_INTERVAL" default:"30s" min:"1ms" usage:"Interval between websocket pings"`
+	PongTimeout    time.Duration `key:"keepalive.pong_timeout" env:"PONG_TIMEOUT" default:"60s" min:"1ms" usage:"Time without a pong after which a session is closed"`
+	IdleTimeout    time.Duration `key:"keepalive.idle_timeout" env:"IDLE_TIMEOUT" default:"30m" min:"1ms" usage:"Time without messages from the player after which a session is closed"`
+	MaxMessageSize int64         `key:"keepalive.max_message_size" env:"MAX_MESSAGE_SIZE" default:"65536" min:"1" usage:"Maximal size of websocket messages from players"`
+
+	GameOnID         string        `key:"gameon.id" env:"GAMEON_ID" usage:"GameOn! ID expected on websocket handshakes"`
+	GameOnSecret     string        `key:"gameon.secret" env:"GAMEON_SECRET" secret:"true" usage:"GameOn! secret verifying websocket handshakes"`
+	HandshakeMaxSkew time.Duration `key:"handshake.max_skew" env:"HANDSHAKE_MAX_SKEW" default:"5m" min:"0s" usage:"Maximal clock skew of signed websocket handshakes"`
+	PushSecret       string        `key:"push.secret" env:"PUSH_SECRET" secret:"true" usage:"Secret verifying messages pushed by room services"`
+
+	Backplane    string `key:"backplane.kind" env:"BACKPLANE" default:"memory" options:"memory,redis" usage:"Pub/sub backplane shared by mediator replicas"`
+	BackplaneURL string `key:"backplane.url" env:"BACKPLANE_URL" usage:"URL of the Redis backplane"`
+	ReplicaID    string `key:"replica.id" env:"REPLICA_ID" usage:"ID of this mediator replica (generated by default)"`
+
+	TraceExport string `key:"trace.export" env:"TRACE_EXPORT" usage:"Destination of exported spans: stdout or a file path"`
+
+	AdminAddr  string `key:"admin.addr" env:"ADMIN_ADDR" default:":3001" usage:"Address serving the admin API"`
+	AdminToken string `key:"admin.token" env:"ADMIN_TOKEN" secret:"true" usage:"Bearer token of the admin API, which is disabled if not set"`
+}
+
+func (c *mediatorConfig) Validate() error {
+	if c.PongTimeout <= c.PingInterval {
+		return fmt.Errorf("pong timeout (%s) must be longer than ping interval (%s)", c.PongTimeout, c.PingInterval)
+	}
+	if c.RoomMaxRetryBackoff < c.RoomRetryBackoff {
+		return fmt.Errorf("max retry backoff (%s) must not be shorter than retry backoff (%s)", c.RoomMaxRetryBackoff, c.RoomRetryBackoff)
+	}
+	if c.Backplane == "redis" && c.BackplaneURL == "" {
+		return fmt.Errorf("redis backplane requires a backplane url")
+	}
+	return nil
+}
+
+// loadConfig loads the mediator's configuration, exiting if it is invalid.
+// The returned loader reloads it on SIGHUP.
+func loadConfig() (*mediatorConfig, *config.Loader) {
+	cfg := new(mediatorConfig)
+	loader := config.MustLoad(cfg)
+	return cfg, loader
+}
+
+// reloadConfig reloads the configuration, applying the settings that can be changed while running.
+func (m *mediator) reloadConfig(cfg *mediatorConfig, loader *config.Loader) {
+	next, applied, err := loader.Reload(cfg)
+	if err != nil {
+		logrus.WithError(err).Errorf("Invalid configuration, keeping the current one")
+		return
+	}
+
+	updated := next.(*mediatorConfig)
+	// Settings are rebuilt even if no key changed, since files they name (e.g., feedback templates) may have changed
+	settings, err := newSettings(updated)
+	if err != nil {
+		logrus.WithError(err).Errorf("Error applying reloaded configuration, keeping the current one")
+		return
+	}
+	routers, err := m.newRouters(updated.RoutingRules)
+	if err != nil {
+		logrus.WithError(err).Errorf("Error applying reloaded routing rules, keeping the current configuration")
+		return
+	}
+
+	*cfg = *updated
+	m.settings.Store(settings)
+	m.setRouters(routers)
+	loader.Reloaded(cfg, applied)
+}
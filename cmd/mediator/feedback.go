@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// roomErrorClass classifies a failed room service request, from the player's point of view.
+type roomErrorClass string
+
+const (
+	// roomErrorTimeout is used when the room service didn't respond in time.
+	roomErrorTimeout roomErrorClass = "timeout"
+
+	// roomErrorUnavailable is used when the room service couldn't be reached, or is considered down.
+	roomErrorUnavailable roomErrorClass = "unavailable"
+
+	// roomErrorServer is used when the room service failed with a 5xx status code.
+	roomErrorServer roomErrorClass = "server_error"
+
+	// roomErrorBadResponse is used when the room service rejected the request, or responded with an invalid response.
+	roomErrorBadResponse roomErrorClass = "bad_response"
+)
+
+func classifyRoomError(err error) roomErrorClass {
+	if err == errCircuitOpen || err == errBulkheadFull {
+		return roomErrorUnavailable
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusGatewayTimeout:
+			return roomErrorTimeout
+		case statusErr.StatusCode == http.StatusBadGateway || statusErr.StatusCode == http.StatusServiceUnavailable:
+			return roomErrorUnavailable
+		case statusErr.StatusCode >= 500:
+			return roomErrorServer
+		default:
+			return roomErrorBadResponse
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return roomErrorTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return roomErrorUnavailable
+	}
+
+	return roomErrorBadResponse
+}
+
+// feedbackData is the data available to feedback templates.
+type feedbackData struct {
+	UserID   string
+	Username string
+	Class    roomErrorClass
+}
+
+// feedbackTemplates holds the templates of the messages synthesized for players when the room service fails.
+// Events are sent when a command or goodbye fails, and the location is sent when a hello fails.
+type feedbackTemplates struct {
+	Events   map[roomErrorClass]string `json:"events"`
+	Location string                    `json:"location"`
+
+	events   map[roomErrorClass]*template.Template
+	location *template.Template
+}
+
+var defaultFeedbackTemplates = feedbackTemplates{
+	Events: map[roomErrorClass]string{
+		roomErrorTimeout:     "The room is not responding, try again in a moment",
+		roomErrorUnavailable: "The room is temporarily unavailable, try again later",
+		roomErrorServer:      "Something went wrong in the room, try again",
+		roomErrorBadResponse: "The room didn't quite get that, try something else",
+	},
+	Location: "The lights are out and the room is eerily quiet. Try again in a moment, {{.Username}}.",
+}
+
+// loadFeedbackTemplates loads the feedback templates from the given file, if any.
+// Templates missing from the file are taken from the defaults.
+func loadFeedbackTemplates(filename string) (*feedbackTemplates, error) {
+	templates := &feedbackTemplates{
+		Events:   make(map[roomErrorClass]string),
+		Location: defaultFeedbackTemplates.Location,
+	}
+	for class, text := range defaultFeedbackTemplates.Events {
+		templates.Events[class] = text
+	}
+
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		var overrides feedbackTemplates
+		err = json.Unmarshal(data, &overrides)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feedback templates %s: %v", filename, err)
+		}
+
+		for class, text := range overrides.Events {
+			if _, ok := templates.Events[class]; !ok {
+				return nil, fmt.Errorf("invalid feedback templates %s: unknown error class %q", filename, class)
+			}
+			templates.Events[class] = text
+		}
+		if overrides.Location != "" {
+			templates.Location = overrides.Location
+		}
+	}
+
+	var err error
+	templates.events = make(map[roomErrorClass]*template.Template, len(templates.Events))
+	for class, text := range templates.Events {
+		templates.events[class], err = template.New(string(class)).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feedback template for %s: %v", class, err)
+		}
+	}
+
+	templates.location, err = template.New("location").Parse(templates.Location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feedback template for location: %v", err)
+	}
+
+	return templates, nil
+}
+
+func executeTemplate(span *trace.Span, tmpl *template.Template, data feedbackData) string {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error executing feedback template %s", tmpl.Name())
+	}
+	return buf.String()
+}
+
+// roomErrorFeedback lets the player know a request to the room service failed, rather than leaving them hanging.
+// A failed hello is answered with a degraded location, and any other failed request with an event.
+func (m *mediator) roomErrorFeedback(span *trace.Span, hr *hostedRoom, session *Session, user gameon.UserInfo, direction gameon.Direction, err error) {
+	class := classifyRoomError(err)
+	data := feedbackData{
+		UserID:   user.UserID,
+		Username: user.Username,
+		Class:    class,
+	}
+
+	trace.Log(span).WithError(err).WithFields(logrus.Fields{
+		"roomId":    hr.id,
+		"userId":    user.UserID,
+		"direction": string(direction),
+		"class":     string(class),
+	}).Errorf("Error executing request with room service")
+
+	feedback := m.currentSettings().feedback
+
+	var payload interface{}
+	if direction == gameon.DirectionRoomHello {
+		payload = gameon.Location{
+			Type:        gameon.TypeLocation,
+			Name:        hr.name,
+			Description: executeTemplate(span, feedback.location, data),
+		}
+	} else {
+		payload = gameon.Event{
+			Type: gameon.TypeEvent,
+			Content: map[string]string{
+				user.UserID: executeTemplate(span, feedback.events[class], data),
+			},
+		}
+	}
+
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, user.UserID, payload)
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error creating feedback message")
+		return
+	}
+
+	sendMessage(span, msg, session)
+}
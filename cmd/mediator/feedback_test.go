@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// TestRoomErrorFeedbackNamesRoom verifies that a player whose hello failed is shown the name of the room,
+// including when the single hosted room has no ID.
+func TestRoomErrorFeedbackNamesRoom(t *testing.T) {
+	routes, err := ioutil.TempFile("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(routes.Name())
+	routes.WriteString(`{"rooms": {"lobby": {"url": "http://localhost:6379/room", "name": "The Lobby"}, "attic": {"url": "http://localhost:6379/room"}}}`)
+	routes.Close()
+
+	tests := []struct {
+		name   string
+		cfg    mediatorConfig
+		roomID string
+		want   string
+	}{
+		{name: "single room", cfg: mediatorConfig{RoomName: "Chatter", RoomServiceURL: "http://localhost:6379/room"}, roomID: "", want: "Chatter"},
+		{name: "named route", cfg: mediatorConfig{RoutesFile: routes.Name()}, roomID: "lobby", want: "The Lobby"},
+		{name: "unnamed route", cfg: mediatorConfig{RoutesFile: routes.Name()}, roomID: "attic", want: "attic"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table, err := loadRoutingTable(&test.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rooms := newHostedRooms(table, newTestClientConfig(), 0, writeConfig{queueSize: 1}, keepaliveConfig{})
+
+			settings, err := newSettings(&test.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &mediator{rooms: rooms}
+			m.settings.Store(settings)
+
+			span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+			session := newTestSession("bob")
+			m.roomErrorFeedback(span, rooms[test.roomID], session, gameon.UserInfo{UserID: "bob"}, gameon.DirectionRoomHello, errors.New("connection refused"))
+
+			if len(session.outbound) != 1 {
+				t.Fatalf("got %d messages, want a degraded location", len(session.outbound))
+			}
+			delivered, err := gameon.Decode(<-session.outbound)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var location gameon.Location
+			err = json.Unmarshal(delivered.Payload, &location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.Type != gameon.TypeLocation || location.Name != test.want {
+				t.Errorf("got location %q of type %q, want %q", location.Name, location.Type, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+)
+
+// handshakeVerifier verifies that websocket upgrade requests were signed by GameOn!,
+// using the secret shared between GameOn! and the room.
+type handshakeVerifier struct {
+	id      string
+	secret  string
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+// newHandshakeVerifier creates a handshake verifier, or returns nil if no shared secret is configured.
+func newHandshakeVerifier(cfg *mediatorConfig) *handshakeVerifier {
+	if cfg.GameOnSecret == "" {
+		return nil
+	}
+
+	return &handshakeVerifier{
+		id:      cfg.GameOnID,
+		secret:  cfg.GameOnSecret,
+		maxSkew: cfg.HandshakeMaxSkew,
+		now:     time.Now,
+	}
+}
+
+// Verify returns an error describing why the upgrade request should be rejected, or nil if it is properly signed.
+func (v *handshakeVerifier) Verify(req *http.Request) error {
+	if v.id != "" && req.Header.Get(gameon.IDHeader) != v.id {
+		return fmt.Errorf("unexpected signer id: %q", req.Header.Get(gameon.IDHeader))
+	}
+
+	return gameon.VerifyRequest(req, v.secret, nil, v.maxSkew, v.now())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+)
+
+func TestHandshakeVerifier(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := hex.EncodeToString(key)
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	v := newHandshakeVerifier(&mediatorConfig{GameOnID: "game-on.org", GameOnSecret: secret, HandshakeMaxSkew: 5 * time.Minute})
+	v.now = func() time.Time {
+		return now
+	}
+
+	tests := []struct {
+		name string
+		sign func(req *http.Request)
+		// err is a substring of the expected error, or empty if the handshake should be accepted
+		err string
+	}{
+		{
+			name: "valid",
+			sign: func(req *http.Request) {
+				gameon.SignRequest(req, "game-on.org", secret, nil, now)
+			},
+		},
+		{
+			name: "stale date",
+			sign: func(req *http.Request) {
+				gameon.SignRequest(req, "game-on.org", secret, nil, now.Add(-10*time.Minute))
+			},
+			err: "stale signature date",
+		},
+		{
+			name: "tampered signature",
+			sign: func(req *http.Request) {
+				gameon.SignRequest(req, "game-on.org", secret, nil, now)
+				req.Header.Set(gameon.SignatureHeader, gameon.Signature(secret, "game-on.org", "forged"))
+			},
+			err: "signature mismatch",
+		},
+		{
+			name: "wrong secret",
+			sign: func(req *http.Request) {
+				gameon.SignRequest(req, "game-on.org", "guessed", nil, now)
+			},
+			err: "signature mismatch",
+		},
+		{
+			name: "unknown id",
+			sign: func(req *http.Request) {
+				gameon.SignRequest(req, "someone-else", secret, nil, now)
+			},
+			err: "unexpected signer id",
+		},
+		{
+			name: "missing headers",
+			sign: func(req *http.Request) {},
+			err:  "unexpected signer id",
+		},
+		{
+			name: "missing signature",
+			sign: func(req *http.Request) {
+				gameon.SignRequest(req, "game-on.org", secret, nil, now)
+				req.Header.Del(gameon.SignatureHeader)
+			},
+			err: "missing signature headers",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://mediator/rooms/chatter", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.sign(req)
+
+			err = v.Verify(req)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestNewHandshakeVerifierWithoutSecret(t *testing.T) {
+	if v := newHandshakeVerifier(&mediatorConfig{GameOnID: "game-on.org"}); v != nil {
+		t.Errorf("got a verifier with no shared secret")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elevran/chatter/pkg/health"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// newHealthChecker creates the mediator's readiness checks: the mediator must be accepting new sessions,
+// and every room service backend serving players of every hosted room must answer, sharing a protocol version.
+// Backends that are only mirrored requests are checked too, but their failures don't fail readiness.
+func (m *mediator) newHealthChecker(timeout time.Duration) *health.Checker {
+	checker := health.NewChecker(timeout)
+
+	checker.Add("draining", func() error {
+		if atomic.LoadInt32(&m.draining) != 0 {
+			return errors.New("mediator is draining, new sessions are refused")
+		}
+		return nil
+	})
+
+	for _, hr := range m.rooms {
+		name := "room"
+		if hr.id != "" {
+			name += ":" + hr.id
+		}
+
+		hr := hr
+		checker.Add(name, func() error {
+			serving, _ := hr.servingClients()
+			return m.pingBackends(serving)
+		})
+		checker.Add(name+":versions", func() error {
+			span := m.tracer.StartSpan("readiness", trace.SpanContext{})
+			defer span.Finish()
+
+			_, err := hr.supportedVersions(span)
+			return err
+		})
+		checker.AddAdvisory(name+":mirrored", func() error {
+			_, mirrored := hr.servingClients()
+			return m.pingBackends(mirrored)
+		})
+	}
+
+	return checker
+}
+
+// pingBackends pings room service backends, returning an error describing the ones that failed.
+func (m *mediator) pingBackends(clients map[string]*room) error {
+	if len(clients) == 0 {
+		return nil
+	}
+
+	span := m.tracer.StartSpan("readiness", trace.SpanContext{})
+	defer span.Finish()
+
+	var failures []string
+	for backend, client := range clients {
+		if err := client.Ping(span); err != nil {
+			failures = append(failures, fmt.Sprintf("backend %s: %v", backend, err))
+		}
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/fault"
+	"github.com/elevran/chatter/pkg/health"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+func newTestClientConfig() roomClientConfig {
+	return roomClientConfig{
+		timeout:          time.Second,
+		retryBackoff:     time.Millisecond,
+		maxRetryBackoff:  time.Millisecond,
+		breakerThreshold: 5,
+		breakerCooldown:  time.Second,
+		maxConcurrent:    10,
+		faults:           fault.NewInjector(),
+	}
+}
+
+// newTestRoomService serves a room service answering /versions only.
+func newTestRoomService() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/versions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"version":[1,2]}`))
+	}))
+}
+
+// newTestMediator creates a mediator hosting a single room, served by the default backend at the given URL.
+func newTestMediator(roomID, serverURL string) (*mediator, *hostedRoom) {
+	config := newTestClientConfig()
+	hr := &hostedRoom{
+		id:           roomID,
+		client:       newRoom(roomID, defaultBackend, serverURL, config),
+		clientConfig: config,
+	}
+
+	return &mediator{
+		rooms:  map[string]*hostedRoom{roomID: hr},
+		tracer: trace.NewTracer("test", nil),
+	}, hr
+}
+
+func TestReadinessIgnoresMirroredBackends(t *testing.T) {
+	up := newTestRoomService()
+	defer up.Close()
+	down := newTestRoomService()
+	down.Close()
+
+	tests := []struct {
+		name  string
+		rules roomRoutingRules
+		// status is the expected readiness status, and mirrored the expected status of the mirrored backends check
+		status   string
+		mirrored string
+	}{
+		{
+			name:     "shadow down",
+			rules:    roomRoutingRules{Backends: map[string]string{"v2": up.URL, "v3": down.URL}, Weights: map[string]int{"default": 90, "v2": 10}, Shadow: "v3"},
+			status:   health.StatusOK,
+			mirrored: health.StatusWarn,
+		},
+		{
+			name:     "weighted backend down",
+			rules:    roomRoutingRules{Backends: map[string]string{"v2": down.URL}, Weights: map[string]int{"default": 90, "v2": 10}},
+			status:   health.StatusFail,
+			mirrored: health.StatusOK,
+		},
+		{
+			name:     "rule backend down",
+			rules:    roomRoutingRules{Backends: map[string]string{"v2": down.URL}, Rules: []routingRule{{UserIDs: []string{"alice"}, Backend: "v2"}}},
+			status:   health.StatusFail,
+			mirrored: health.StatusOK,
+		},
+		{
+			name:     "unused backend down",
+			rules:    roomRoutingRules{Backends: map[string]string{"v2": down.URL}},
+			status:   health.StatusOK,
+			mirrored: health.StatusWarn,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, hr := newTestMediator("r1", up.URL)
+			hr.router.Store(newRoomRouter(hr, test.rules, nil))
+
+			report := m.newHealthChecker(time.Second).Ready()
+			if report.Status != test.status {
+				t.Errorf("got readiness %s, want %s: %+v", report.Status, test.status, report.Checks)
+			}
+			if got := report.Checks["room:r1:mirrored"].Status; got != test.mirrored {
+				t.Errorf("got mirrored backends status %s, want %s: %+v", got, test.mirrored, report.Checks)
+			}
+		})
+	}
+}
+
+func TestReadinessFailsWithoutCommonVersion(t *testing.T) {
+	up := newTestRoomService()
+	defer up.Close()
+	v3 := newVersionsService("[3]")
+	defer v3.Close()
+
+	tests := []struct {
+		name  string
+		rules roomRoutingRules
+		// status is the expected status of the versions check
+		status string
+	}{
+		{name: "common version", rules: roomRoutingRules{Backends: map[string]string{"v3": v3.URL}}, status: health.StatusOK},
+		{name: "no common version", rules: roomRoutingRules{Backends: map[string]string{"v3": v3.URL}, Weights: map[string]int{"default": 90, "v3": 10}}, status: health.StatusFail},
+		{name: "no common version with a shadow", rules: roomRoutingRules{Backends: map[string]string{"v3": v3.URL}, Shadow: "v3"}, status: health.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, hr := newTestMediator("r1", up.URL)
+			hr.router.Store(newRoomRouter(hr, test.rules, nil))
+
+			report := m.newHealthChecker(time.Second).Ready()
+			if got := report.Checks["room:r1:versions"].Status; got != test.status {
+				t.Errorf("got versions status %s, want %s: %+v", got, test.status, report.Checks)
+			}
+			if report.Status != test.status {
+				t.Errorf("got readiness %s, want %s: %+v", report.Status, test.status, report.Checks)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// identityPolicy determines how a message claiming an identity other than the one bound to its session is handled.
+type identityPolicy string
+
+const (
+	// identityReject drops messages claiming a foreign identity.
+	identityReject identityPolicy = "reject"
+
+	// identityOverwrite replaces the claimed identity with the one bound to the session.
+	identityOverwrite identityPolicy = "overwrite"
+)
+
+// verifyIdentity checks the user info claimed by a message against the identity bound to the session at hello time.
+// The claimed user info is corrected to match the bound identity where the policy allows it.
+// It returns false if the message should be dropped.
+func (m *mediator) verifyIdentity(span *trace.Span, claimed *gameon.UserInfo, direction gameon.Direction, session *Session) bool {
+	bound := session.User()
+	if bound.UserID == "" {
+		securityEvent(span, "unbound_identity", session, claimed, direction).
+			Warnf("Dropping message received before hello")
+		return false
+	}
+
+	if claimed.UserID != bound.UserID {
+		if m.currentSettings().identityPolicy != identityOverwrite {
+			securityEvent(span, "identity_spoofing", session, claimed, direction).
+				Warnf("Dropping message claiming a foreign identity")
+			return false
+		}
+
+		securityEvent(span, "identity_spoofing", session, claimed, direction).
+			Warnf("Overwriting foreign identity claimed by message")
+	}
+
+	claimed.UserID = bound.UserID
+	claimed.Username = bound.Username
+	return true
+}
+
+func securityEvent(span *trace.Span, event string, session *Session, claimed *gameon.UserInfo, direction gameon.Direction) *logrus.Entry {
+	bound := session.User()
+	return trace.Log(span).WithFields(logrus.Fields{
+		"security":        event,
+		"direction":       string(direction),
+		"remoteAddr":      session.Conn.RemoteAddr().String(),
+		"sessionUserId":   bound.UserID,
+		"sessionUsername": bound.Username,
+		"claimedUserId":   claimed.UserID,
+		"claimedUsername": claimed.Username,
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// securityEvents is a log hook recording the security events logged.
+type securityEvents struct {
+	entries []logrus.Fields
+	mutex   sync.Mutex
+}
+
+func (h *securityEvents) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel, logrus.DebugLevel}
+}
+
+func (h *securityEvents) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data["security"]; !ok {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fields := logrus.Fields{"level": entry.Level.String()}
+	for key, value := range entry.Data {
+		fields[key] = value
+	}
+	h.entries = append(h.entries, fields)
+	return nil
+}
+
+// recordSecurityEvents starts recording the security events logged, until the returned function is called.
+func recordSecurityEvents() (*securityEvents, func()) {
+	events := &securityEvents{}
+	logger := logrus.StandardLogger()
+	hooks := logger.Hooks
+
+	logger.Hooks = make(logrus.LevelHooks)
+	for level, levelHooks := range hooks {
+		logger.Hooks[level] = append([]logrus.Hook(nil), levelHooks...)
+	}
+	logger.Hooks.Add(events)
+
+	return events, func() {
+		logger.Hooks = hooks
+	}
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	conn, _, closeConn := newTestConn(t)
+	defer closeConn()
+
+	bob := gameon.UserInfo{UserID: "bob", Username: "Bob"}
+
+	tests := []struct {
+		name    string
+		policy  identityPolicy
+		bound   gameon.UserInfo
+		claimed gameon.UserInfo
+		// ok is whether the message is accepted, and want the identity it is accepted with
+		ok   bool
+		want gameon.UserInfo
+		// event is the security event logged, if any
+		event string
+	}{
+		{name: "bound identity", policy: identityReject, bound: bob, claimed: bob, ok: true, want: bob},
+		{name: "username corrected", policy: identityReject, bound: bob, claimed: gameon.UserInfo{UserID: "bob", Username: "Robert"}, ok: true, want: bob},
+		{name: "rejected foreign identity", policy: identityReject, bound: bob, claimed: gameon.UserInfo{UserID: "alice", Username: "Alice"}, event: "identity_spoofing"},
+		{name: "overwritten foreign identity", policy: identityOverwrite, bound: bob, claimed: gameon.UserInfo{UserID: "alice", Username: "Alice"}, ok: true, want: bob, event: "identity_spoofing"},
+		{name: "unbound session", policy: identityReject, claimed: bob, event: "unbound_identity"},
+		{name: "unbound session overwriting", policy: identityOverwrite, claimed: bob, event: "unbound_identity"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &mediator{}
+			m.settings.Store(&settings{identityPolicy: test.policy})
+
+			session := newTestSession("")
+			session.Conn = conn
+			if test.bound.UserID != "" {
+				session.SetUser(test.bound, 1, true)
+			}
+
+			events, stop := recordSecurityEvents()
+			defer stop()
+
+			span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+			claimed := test.claimed
+			ok := m.verifyIdentity(span, &claimed, gameon.DirectionRoom, session)
+
+			if ok != test.ok {
+				t.Errorf("got accepted %v, want %v", ok, test.ok)
+			}
+			if ok && claimed != test.want {
+				t.Errorf("accepted as %+v, want %+v", claimed, test.want)
+			}
+
+			if test.event == "" {
+				if len(events.entries) != 0 {
+					t.Errorf("logged security events %v, want none", events.entries)
+				}
+				return
+			}
+			if len(events.entries) != 1 {
+				t.Fatalf("logged security events %v, want a single %s event", events.entries, test.event)
+			}
+			event := events.entries[0]
+			want := logrus.Fields{
+				"security":        test.event,
+				"level":           "warning",
+				"direction":       string(gameon.DirectionRoom),
+				"sessionUserId":   test.bound.UserID,
+				"sessionUsername": test.bound.Username,
+				"claimedUserId":   test.claimed.UserID,
+				"claimedUsername": test.claimed.Username,
+			}
+			for key, value := range want {
+				if event[key] != value {
+					t.Errorf("got %s %v, want %v", key, event[key], value)
+				}
+			}
+			if event["remoteAddr"] == "" {
+				t.Errorf("security event doesn't name the remote address")
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// disconnectReason classifies why a session was closed.
+type disconnectReason string
+
+const (
+	// disconnectClientClose is used when the client closed the websocket connection.
+	disconnectClientClose disconnectReason = "client_close"
+
+	// disconnectGoodbye is used when the client said goodbye.
+	disconnectGoodbye disconnectReason = "goodbye"
+
+	// disconnectPongTimeout is used when the client stopped answering pings.
+	disconnectPongTimeout disconnectReason = "pong_timeout"
+
+	// disconnectIdleTimeout is used when the client sent no messages for longer than the idle timeout.
+	disconnectIdleTimeout disconnectReason = "idle_timeout"
+
+	// disconnectProtocolError is used when the client sent an invalid, unexpected or oversized message.
+	disconnectProtocolError disconnectReason = "protocol_error"
+
+	// disconnectConnectionError is used when the websocket connection failed unexpectedly.
+	disconnectConnectionError disconnectReason = "connection_error"
+
+	// disconnectWriteError is used when writing to the websocket connection failed.
+	disconnectWriteError disconnectReason = "write_error"
+
+	// disconnectSlowConsumer is used when the client couldn't keep up with its outbound queue.
+	disconnectSlowConsumer disconnectReason = "slow_consumer"
+
+	// disconnectKicked is used when an administrator kicked the user out of the room.
+	disconnectKicked disconnectReason = "kicked"
+
+	// disconnectDrained is used when the mediator was drained of its sessions.
+	disconnectDrained disconnectReason = "drained"
+
+	// disconnectServerClose is used when the mediator closed the session for any other reason.
+	disconnectServerClose disconnectReason = "server_close"
+)
+
+// closeCode returns the websocket close code sent to the client when closing a session for the given reason,
+// or false if the connection is not usable for sending a close message.
+func (reason disconnectReason) closeCode() (int, bool) {
+	switch reason {
+	case disconnectGoodbye, disconnectKicked, disconnectServerClose:
+		return websocket.CloseNormalClosure, true
+	case disconnectIdleTimeout, disconnectPongTimeout, disconnectSlowConsumer, disconnectDrained:
+		return websocket.CloseGoingAway, true
+	case disconnectProtocolError:
+		return websocket.CloseProtocolError, true
+	default:
+		return 0, false
+	}
+}
+
+// keepaliveConfig configures the liveness checks and limits applied to every session's websocket connection.
+type keepaliveConfig struct {
+	pingInterval   time.Duration
+	pongTimeout    time.Duration
+	idleTimeout    time.Duration
+	maxMessageSize int64
+}
+
+func newKeepaliveConfig(cfg *mediatorConfig) keepaliveConfig {
+	return keepaliveConfig{
+		pingInterval:   cfg.PingInterval,
+		pongTimeout:    cfg.PongTimeout,
+		idleTimeout:    cfg.IdleTimeout,
+		maxMessageSize: cfg.MaxMessageSize,
+	}
+}
+
+// startKeepalive applies the read limits to the session's websocket connection, and starts tracking its liveness.
+// Must be called by the session's reader goroutine before reading any messages.
+func (s *Session) startKeepalive() {
+	s.Conn.SetReadLimit(s.keepalive.maxMessageSize)
+	s.lastActivity = time.Now()
+	s.extendReadDeadline()
+
+	s.Conn.SetPongHandler(func(string) error {
+		s.extendReadDeadline()
+		return nil
+	})
+}
+
+// touch records activity on the session, following a message received from the client.
+func (s *Session) touch() {
+	s.lastActivity = time.Now()
+	s.extendReadDeadline()
+}
+
+// extendReadDeadline allows the client another pong timeout to prove it's alive,
+// without extending beyond the idle timeout since the last message it sent.
+func (s *Session) extendReadDeadline() {
+	deadline := time.Now().Add(s.keepalive.pongTimeout)
+	if idleDeadline := s.lastActivity.Add(s.keepalive.idleTimeout); idleDeadline.Before(deadline) {
+		deadline = idleDeadline
+	}
+	s.Conn.SetReadDeadline(deadline)
+}
+
+// readErrorReason classifies an error returned when reading from the session's websocket connection.
+func (s *Session) readErrorReason(err error) disconnectReason {
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		switch closeErr.Code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+			return disconnectClientClose
+		case websocket.CloseAbnormalClosure:
+			return disconnectConnectionError
+		default:
+			return disconnectProtocolError
+		}
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if time.Since(s.lastActivity) >= s.keepalive.idleTimeout {
+			return disconnectIdleTimeout
+		}
+		return disconnectPongTimeout
+	}
+
+	if err == websocket.ErrReadLimit {
+		return disconnectProtocolError
+	}
+
+	return disconnectConnectionError
+}
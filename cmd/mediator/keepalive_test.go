@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/trace"
+	"github.com/gorilla/websocket"
+)
+
+func TestKeepalive(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepalive keepaliveConfig
+		// prepare sets up the client before it starts reading, and act is what it does meanwhile
+		prepare func(client *websocket.Conn)
+		act     func(t *testing.T, client *websocket.Conn)
+		// open is the minimal time the session should stay open
+		open   time.Duration
+		reason disconnectReason
+		code   int
+	}{
+		{
+			// Pings are answered by the client while reading, which extends the session up to the idle timeout
+			name:      "idle timeout",
+			keepalive: keepaliveConfig{pingInterval: 10 * time.Millisecond, pongTimeout: 50 * time.Millisecond, idleTimeout: 200 * time.Millisecond, maxMessageSize: 1024},
+			open:      200 * time.Millisecond,
+			reason:    disconnectIdleTimeout,
+			code:      websocket.CloseGoingAway,
+		},
+		{
+			name:      "messages postpone idle timeout",
+			keepalive: keepaliveConfig{pingInterval: 10 * time.Millisecond, pongTimeout: 50 * time.Millisecond, idleTimeout: 150 * time.Millisecond, maxMessageSize: 1024},
+			act: func(t *testing.T, client *websocket.Conn) {
+				for i := 0; i < 8; i++ {
+					err := client.WriteMessage(websocket.TextMessage, []byte(`room,room,{"content":"still here"}`))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					time.Sleep(50 * time.Millisecond)
+				}
+			},
+			open:   400 * time.Millisecond,
+			reason: disconnectIdleTimeout,
+			code:   websocket.CloseGoingAway,
+		},
+		{
+			name:      "pong timeout",
+			keepalive: keepaliveConfig{pingInterval: 10 * time.Millisecond, pongTimeout: 50 * time.Millisecond, idleTimeout: time.Minute, maxMessageSize: 1024},
+			prepare: func(client *websocket.Conn) {
+				client.SetPingHandler(func(string) error { return nil })
+			},
+			open:   50 * time.Millisecond,
+			reason: disconnectPongTimeout,
+			code:   websocket.CloseGoingAway,
+		},
+		{
+			// Oversized messages are refused by the websocket library itself, which sends its own close message
+			name:      "read limit",
+			keepalive: keepaliveConfig{pingInterval: time.Minute, pongTimeout: 2 * time.Minute, idleTimeout: time.Minute, maxMessageSize: 16},
+			act: func(t *testing.T, client *websocket.Conn) {
+				client.WriteMessage(websocket.TextMessage, []byte(`room,room,{"content":"`+strings.Repeat("a", 32)+`"}`))
+			},
+			reason: disconnectProtocolError,
+			code:   websocket.CloseMessageTooBig,
+		},
+		{
+			name:      "client close",
+			keepalive: keepaliveConfig{pingInterval: time.Minute, pongTimeout: 2 * time.Minute, idleTimeout: time.Minute, maxMessageSize: 1024},
+			act: func(t *testing.T, client *websocket.Conn) {
+				client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"), time.Now().Add(time.Second))
+			},
+			reason: disconnectClientClose,
+			code:   websocket.CloseNormalClosure,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, client, closeConn := newTestConn(t)
+			defer closeConn()
+
+			m := &mediator{tracer: trace.NewTracer("test", nil)}
+			hr := &hostedRoom{id: "room", sessions: newSessions(0, writeConfig{queueSize: 8, writeTimeout: time.Second}, test.keepalive)}
+			span := m.tracer.StartSpan("test", trace.SpanContext{})
+
+			if test.prepare != nil {
+				test.prepare(client)
+			}
+			closed := make(chan *websocket.CloseError, 1)
+			go func() {
+				_, closeErr := readUntilClosed(t, client)
+				closed <- closeErr
+			}()
+
+			started := time.Now()
+			session := hr.sessions.NewSession(span, conn)
+			go m.handleMessages(hr, session)
+			if test.act != nil {
+				test.act(t, client)
+			}
+
+			select {
+			case <-session.Closed():
+			case <-time.After(5 * time.Second):
+				t.Fatal("session wasn't closed")
+			}
+			if elapsed := time.Since(started); elapsed < test.open {
+				t.Errorf("session was closed after %s, want it open for at least %s", elapsed, test.open)
+			}
+			if session.Reason() != test.reason {
+				t.Errorf("session was closed for %s, want %s", session.Reason(), test.reason)
+			}
+
+			closeErr := <-closed
+			if closeErr == nil || closeErr.Code != test.code {
+				t.Errorf("got close %v, want code %d", closeErr, test.code)
+			}
+		})
+	}
+}
+
+func TestCloseCode(t *testing.T) {
+	tests := []struct {
+		reason disconnectReason
+		code   int
+		ok     bool
+	}{
+		{reason: disconnectGoodbye, code: websocket.CloseNormalClosure, ok: true},
+		{reason: disconnectKicked, code: websocket.CloseNormalClosure, ok: true},
+		{reason: disconnectServerClose, code: websocket.CloseNormalClosure, ok: true},
+		{reason: disconnectIdleTimeout, code: websocket.CloseGoingAway, ok: true},
+		{reason: disconnectPongTimeout, code: websocket.CloseGoingAway, ok: true},
+		{reason: disconnectSlowConsumer, code: websocket.CloseGoingAway, ok: true},
+		{reason: disconnectDrained, code: websocket.CloseGoingAway, ok: true},
+		{reason: disconnectProtocolError, code: websocket.CloseProtocolError, ok: true},
+		{reason: disconnectClientClose},
+		{reason: disconnectConnectionError},
+		{reason: disconnectWriteError},
+	}
+
+	for _, test := range tests {
+		if code, ok := test.reason.closeCode(); code != test.code || ok != test.ok {
+			t.Errorf("closeCode(%s) = %d, %v, want %d, %v", test.reason, code, ok, test.code, test.ok)
+		}
+	}
+}
@@ -1,21 +1,70 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
 
 func main() {
-	logrus.SetLevel(logrus.DebugLevel)
+	cfg, loader := loadConfig()
 	logrus.Infof("Starting mediator service")
 
-	m := newMediator()
+	m := newMediator(cfg)
 
 	http.HandleFunc("/", m.handleHTTP)
+	http.HandleFunc("/push/", m.handlePush)
+	http.Handle("/metrics", metricsRegistry.Handler())
 
-	err := http.ListenAndServe(":3000", nil)
-	if err != nil {
-		logrus.WithError(err).Fatalf("Error running main")
+	checker := m.newHealthChecker(cfg.HealthTimeout)
+	http.Handle("/healthz", checker.LivenessHandler())
+	http.Handle("/readyz", checker.ReadinessHandler())
+
+	servers := []*http.Server{{Addr: cfg.Listen}}
+
+	if admin := newAdminAPI(m, cfg); admin != nil {
+		servers = append(servers, &http.Server{Addr: admin.addr, Handler: admin.Handler()})
+	} else {
+		logrus.Warnf("No admin token configured, admin API is disabled")
+	}
+
+	for _, server := range servers {
+		go func(server *http.Server) {
+			err := server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logrus.WithError(err).Fatalf("Error running main")
+			}
+		}(server)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	sig := <-signals
+	for ; sig == syscall.SIGHUP; sig = <-signals {
+		logrus.Infof("Received %s, reloading configuration", sig)
+		m.reloadConfig(cfg, loader)
+	}
+
+	logrus.Infof("Received %s, shutting down mediator service", sig)
+	checker.Shutdown()
+	m.shutdown(cfg.ShutdownTimeout)
+
+	// Requests still in flight (e.g., pushes) are given a little more time to complete
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error shutting down HTTP server on %s", server.Addr)
+		}
 	}
+
+	logrus.Infof("Mediator service stopped")
 }
@@ -1,257 +1,580 @@
 package main
 
 import (
-	"encoding/json"
-	"net/http"
-
 	"fmt"
-
-	"os"
-
-	"bytes"
-	"strings"
+	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/fault"
 	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
 	"github.com/gorilla/websocket"
 )
 
 var (
-	SupportedVersions = []int{1}
+	// DefaultVersions are the protocol versions advertised when the room service can't be queried for its own.
+	DefaultVersions = []int{1}
 )
 
 type mediator struct {
-	room     *room
-	roomID   string
-	sessions *SessionManager
+	rooms        map[string]*hostedRoom
+	fanout       *fanout
+	verifier     *handshakeVerifier
+	pushVerifier *pushVerifier
+	tracer       *trace.Tracer
+	mirrorReport *mirrorReport
+	faults       *fault.Injector
+
+	// settings holds the current *settings, replaced when the configuration is reloaded.
+	settings atomic.Value
+
+	// draining is set once the mediator stopped accepting new sessions.
+	draining int32
 }
 
-func newMediator() *mediator {
+// settings holds the mediator settings that can be changed while running.
+type settings struct {
+	feedback         *feedbackTemplates
+	identityPolicy   identityPolicy
+	concurrentLogins bool
+}
+
+func newSettings(cfg *mediatorConfig) (*settings, error) {
+	feedback, err := loadFeedbackTemplates(cfg.FeedbackTemplates)
+	if err != nil {
+		return nil, fmt.Errorf("error loading feedback templates: %v", err)
+	}
+
+	return &settings{
+		feedback:         feedback,
+		identityPolicy:   identityPolicy(cfg.IdentityPolicy),
+		concurrentLogins: cfg.ConcurrentLogins == "allow",
+	}, nil
+}
+
+func newMediator(cfg *mediatorConfig) *mediator {
+	table, err := loadRoutingTable(cfg)
+	if err != nil {
+		panic(fmt.Sprintf("error loading routing table: %v", err))
+	}
+
+	settings, err := newSettings(cfg)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	backplane, err := newBackplane(cfg.Backplane, cfg.BackplaneURL)
+	if err != nil {
+		panic(fmt.Sprintf("error creating backplane: %v", err))
+	}
+
+	report, err := newMirrorReport(cfg.MirrorReport)
+	if err != nil {
+		panic(fmt.Sprintf("error opening mirror report: %v", err))
+	}
+
+	tracer, err := trace.NewServiceTracer("mediator", cfg.TraceExport)
+	if err != nil {
+		panic(fmt.Sprintf("error creating trace exporter: %v", err))
+	}
+
+	faults := fault.NewInjector()
+	clientConfig := newRoomClientConfig(cfg)
+	clientConfig.faults = faults
+
 	m := &mediator{
-		room:     newRoom(),
-		roomID:   os.Getenv("ROOM_ID"),
-		sessions: newSessions(),
+		rooms:        newHostedRooms(table, clientConfig, cfg.RecoveryWindow, newWriteConfig(cfg), newKeepaliveConfig(cfg)),
+		fanout:       newFanout(backplane, cfg.ReplicaID),
+		verifier:     newHandshakeVerifier(cfg),
+		pushVerifier: newPushVerifier(cfg.PushSecret),
+		tracer:       tracer,
+		mirrorReport: report,
+		faults:       faults,
+	}
+	m.settings.Store(settings)
+
+	if m.verifier == nil {
+		logrus.Warnf("No GameOn! shared secret configured, websocket handshakes will not be verified")
+	}
+	if m.pushVerifier == nil {
+		logrus.Warnf("No push secret configured, messages pushed by room services will be rejected")
+	}
+
+	for roomID, route := range table.Rooms {
+		logrus.Infof("Hosting room %q backed by room service %s", roomID, route.URL)
+	}
+
+	routers, err := m.newRouters(cfg.RoutingRules)
+	if err != nil {
+		panic(fmt.Sprintf("error loading routing rules: %v", err))
+	}
+	m.setRouters(routers)
+
+	m.registerMetrics()
+
+	err = backplane.Subscribe(m.handleEnvelope)
+	if err != nil {
+		panic(fmt.Sprintf("error subscribing to backplane: %v", err))
 	}
 
 	return m
 }
 
 func (m *mediator) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	logrus.Debugf("Incoming HTTP request from %s", r.RemoteAddr)
+	// The session continues the trace propagated by the client, if any, and every log line of the handshake is tagged with it
+	parent, _ := trace.Extract(r.Header)
+	span := m.tracer.StartSpan("websocket.session", parent)
+	span.SetAttribute("remoteAddr", r.RemoteAddr)
+	defer span.Finish()
+
+	log := trace.Log(span).WithField("remoteAddr", r.RemoteAddr)
+	log.Debugf("Incoming HTTP request")
+
+	if atomic.LoadInt32(&m.draining) != 0 {
+		log.Warnf("Rejecting websocket handshake while draining")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if m.verifier != nil {
+		err := m.verifier.Verify(r)
+		if err != nil {
+			log.WithError(err).Warnf("Rejecting unverified websocket handshake")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	hr, ok := m.lookupRoom(r.URL.Path)
+	if !ok {
+		log.Warnf("Rejecting websocket handshake for unknown room: %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	span.SetAttribute("roomId", hr.id)
 
 	var upgrader websocket.Upgrader
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		logrus.WithError(err).Errorf("Error upgrading HTTP to websocket connection")
+		log.WithError(err).Errorf("Error upgrading HTTP to websocket connection")
 		return
 	}
 
-	logrus.Debugf("Websocket connection established with %s", conn.RemoteAddr().String())
-	m.handleWebsocket(conn)
+	log.Debugf("Websocket connection established for room %q", hr.id)
+	m.handleWebsocket(span, hr, conn, r.Header)
 }
 
-func (m *mediator) handleWebsocket(conn *websocket.Conn) {
-	session := m.sessions.NewSession(conn)
+// handleWebsocket runs a session over an established websocket connection, until it is closed.
+// The session's span lasts as long as the connection, and tags the log lines of its writer and reader goroutines.
+func (m *mediator) handleWebsocket(span *trace.Span, hr *hostedRoom, conn *websocket.Conn, header http.Header) {
+	session := hr.sessions.NewSession(span, conn)
+	session.Header = header
 
-	m.ack(session)
-	go m.handleMessages(session)
+	m.ack(span, hr, session)
+	go m.handleMessages(hr, session)
 
-	select {
-	case <-session.Closed():
-		conn.Close()
-	}
+	// The connection is closed by the session's writer goroutine, once done flushing its outbound queue
+	<-session.Closed()
+
+	userID := session.UserID()
+	span.SetAttribute("userId", userID)
+	span.SetAttribute("reason", string(session.Reason()))
+
+	trace.Log(span).WithFields(logrus.Fields{
+		"reason":     string(session.Reason()),
+		"roomId":     hr.id,
+		"userId":     userID,
+		"remoteAddr": conn.RemoteAddr().String(),
+		"duration":   time.Since(session.ConnectedAt).String(),
+	}).Infof("Websocket session closed")
+
+	disconnects.Inc(hr.id, string(session.Reason()))
 }
 
-func (m *mediator) handleMessages(session *Session) {
+func (m *mediator) handleMessages(hr *hostedRoom, session *Session) {
 	// The loop runs forever, and is terminated only when an error occurs.
-	// In such a case, attempt to close the session (in case not closed already).
-	defer session.Close()
+	// In such a case, attempt to close the session (in case not closed already),
+	// classifying the error as a protocol error unless found otherwise.
+	reason := disconnectProtocolError
+	defer func() {
+		session.CloseWithReason(reason)
+	}()
+
+	session.startKeepalive()
 
 	for {
 		_, bytes, err := session.Conn.ReadMessage()
 		if err != nil {
-			logrus.WithError(err).Errorf("Error reading websocket message")
+			reason = session.readErrorReason(err)
+			session.log().WithError(err).WithField("reason", string(reason)).Debugf("Error reading websocket message")
 			return
 		}
+		session.touch()
 
-		msg, err := parseMessage(bytes)
-		if err != nil {
-			logrus.WithError(err).Errorf("Error parsing websocket message")
+		// Every inbound message starts a new trace, followed through the room service and back to the player sessions
+		span := m.tracer.StartSpan("websocket.message", trace.SpanContext{})
+		span.SetAttribute("roomId", hr.id)
+		ok := m.handleMessage(span, hr, session, bytes)
+		span.Finish()
+
+		if !ok {
 			return
 		}
+	}
+}
 
-		logrus.WithFields(messageToFields(msg)).Debugf("Websocket message received")
+// handleMessage handles a single websocket message received on the session.
+// It returns false if the message violates the protocol, and the session should be closed.
+func (m *mediator) handleMessage(span *trace.Span, hr *hostedRoom, session *Session, bytes []byte) bool {
+	msg, err := gameon.Decode(bytes)
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error parsing websocket message")
+		return false
+	}
 
-		// Validate the message recipient is our own room ID
-		if m.roomID != "" && msg.Recipient != m.roomID {
-			logrus.WithError(fmt.Errorf("recipient (%s) doesn't match expected room id (%s)", msg.Recipient, m.roomID)).
-				Errorf("Invalid message received")
-			return
-		}
+	span.SetAttribute("direction", string(msg.Direction))
+	trace.Log(span).WithFields(messageToFields(msg)).Debugf("Websocket message received")
 
-		var payload interface{}
-		switch msg.Direction {
-		case "roomHello":
-			payload = &gameon.Hello{}
-		case "roomGoodbye":
-			payload = &gameon.Goodbye{}
-		case "room":
-			payload = &gameon.RoomCommand{}
-		default:
-			logrus.WithError(fmt.Errorf("unrecognized message direction: %s", msg.Direction)).
-				Errorf("Invalid message received")
-			return
-		}
+	// Messages are counted by direction once it is known to be valid, so that clients can't create series at will
+	switch msg.Direction {
+	case gameon.DirectionRoomHello, gameon.DirectionRoomGoodbye, gameon.DirectionRoom:
+		messagesReceived.Inc(string(msg.Direction))
+	default:
+		messagesReceived.Inc(invalidDirection)
+		trace.Log(span).WithError(fmt.Errorf("unrecognized message direction: %s", msg.Direction)).
+			Errorf("Invalid message received")
+		return false
+	}
 
-		err = json.Unmarshal(msg.Payload, payload)
-		if err != nil {
-			logrus.WithError(err).Errorf("Error unmarshaling message payload")
-			return
-		}
+	// Validate the message recipient is the session's room ID
+	if !hr.AcceptsRecipient(msg.Recipient) {
+		trace.Log(span).WithError(fmt.Errorf("recipient (%s) doesn't match expected room id (%s)", msg.Recipient, hr.id)).
+			Errorf("Invalid message received")
+		return false
+	}
 
-		switch payload := payload.(type) {
-		case *gameon.Hello:
-			m.handleHello(payload, session)
-		case *gameon.Goodbye:
-			m.handleGoodbye(payload, session)
-		case *gameon.RoomCommand:
-			m.handleRoomCommand(payload, session)
-		default:
-			logrus.WithError(fmt.Errorf("unrecognized payload type: %T", payload))
-		}
+	payload, err := gameon.DecodePayload(msg)
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error unmarshaling message payload")
+		return false
+	}
+
+	switch payload := payload.(type) {
+	case *gameon.Hello:
+		span.SetAttribute("userId", payload.UserID)
+		m.handleHello(span, hr, payload, session)
+	case *gameon.Goodbye:
+		span.SetAttribute("userId", payload.UserID)
+		m.handleGoodbye(span, hr, payload, session)
+	case *gameon.RoomCommand:
+		span.SetAttribute("userId", payload.UserID)
+		m.handleRoomCommand(span, hr, payload, session)
+	default:
+		trace.Log(span).WithError(fmt.Errorf("unrecognized payload type: %T", payload)).Errorf("Invalid message received")
 	}
+	return true
 }
 
-func (m *mediator) ack(session *Session) {
-	logrus.Debugf("Sending ack for websocket connection with remote address %s", session.Conn.RemoteAddr().String())
+func (m *mediator) ack(span *trace.Span, hr *hostedRoom, session *Session) {
+	trace.Log(span).Debugf("Sending ack for websocket connection with remote address %s", session.Conn.RemoteAddr().String())
 
-	ack := gameon.Ack{
-		Version: SupportedVersions,
+	// A session that no protocol version could be negotiated on with every backend is closed right away
+	versions, err := hr.supportedVersions(span)
+	if err != nil {
+		trace.Log(span).WithError(err).WithField("roomId", hr.id).Errorf("Closing websocket connection, no protocol version supported by the room service")
+		session.Close()
+		return
 	}
-	ackBytes, _ := json.Marshal(ack)
+	session.Versions = versions
 
-	msg := &gameon.Message{
-		Direction: "ack",
-		Payload:   ackBytes,
+	msg, err := gameon.NewMessage(gameon.DirectionAck, "", gameon.Ack{
+		Version: versions,
+	})
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error creating ack message")
+		return
 	}
 
-	sendMessage(msg, session)
+	sendMessage(span, msg, session)
 }
 
-func (m *mediator) handleHello(hello *gameon.Hello, session *Session) {
-	session.SetUserID(hello.UserID)
+func (m *mediator) handleHello(span *trace.Span, hr *hostedRoom, hello *gameon.Hello, session *Session) {
+	// A session is bound to the first user saying hello on it, and can't be taken over by another
+	if userID := session.UserID(); userID != "" && hello.UserID != userID {
+		securityEvent(span, "identity_spoofing", session, &hello.UserInfo, gameon.DirectionRoomHello).
+			Warnf("Dropping hello claiming a foreign identity")
+		return
+	}
+
+	// The version is negotiated on the session's first hello, and kept for the rest of its lifetime.
+	// A recovering user keeps the version of their previous session, if the session supports it.
+	version := session.Version()
+	if version == 0 {
+		detached, recoverable := hr.sessions.Detached(hello.UserID)
+		if recoverable && hello.Recovery && containsVersion(session.Versions, detached.Version) {
+			version = detached.Version
+		} else {
+			negotiated, ok := gameon.NegotiateVersion(hello.Version, session.Versions)
+			if !ok {
+				trace.Log(span).WithFields(logrus.Fields{
+					"userId":    hello.UserID,
+					"requested": hello.Version,
+					"supported": session.Versions,
+				}).Errorf("Rejecting hello with unsupported protocol version")
+
+				m.rejectHello(span, hello, session, fmt.Sprintf("Protocol version %d is not supported by this room", hello.Version))
+				return
+			}
+
+			if negotiated != hello.Version {
+				trace.Log(span).Debugf("Negotiated protocol version %d for user %s (requested %d)", negotiated, hello.UserID, hello.Version)
+			}
+			version = negotiated
+		}
+	}
+	hello.Version = version
+
+	others, ok := session.SetUser(hello.UserInfo, version, m.currentSettings().concurrentLogins)
+	if !ok {
+		trace.Log(span).WithField("userId", hello.UserID).Warnf("Rejecting hello from user already connected on another session")
+
+		m.rejectHello(span, hello, session, "You are already in this room elsewhere")
+		return
+	}
+
+	// A recovering user is reattached to the state detached from their previous session, if still available,
+	// once the hello can no longer be rejected. Any non-recovering hello discards such state,
+	// since the user is entering the room anew.
+	var since time.Time
+	detached, recovered := hr.sessions.Recover(hello.UserID)
+	if recovered && hello.Recovery {
+		trace.Log(span).Debugf("Reattaching user %s disconnected at %s", hello.UserID, detached.DisconnectedAt)
+
+		// The room service replays the messages following the last one the user got, or else for as long as
+		// the user has been disconnected
+		since = detached.DisconnectedAt
+		if hello.Bookmark == "" {
+			hello.Bookmark = detached.Bookmark
+		}
+		session.RestoreBackend(detached.Backend)
+	}
+
+	// A user joining from an additional session has already entered the room, and only needs their location
+	if others > 0 {
+		hello.Recovery = true
+	}
 
-	resp, err := m.room.Hello(hello)
+	client := hr.clientFor(span, hello.UserInfo, session)
+	resp, err := client.Hello(span, hello, version, since)
 	if err != nil {
-		logrus.WithError(err).Errorf("Error executing 'hello' with room service")
+		m.roomErrorFeedback(span, hr, session, hello.UserInfo, gameon.DirectionRoomHello, err)
 		return
 	}
 
-	m.handleResponse(resp)
+	m.mirror(span, hr, client, "/hello", hello.UserInfo, hello, resp, func(span *trace.Span, shadow *room) (*gameon.MessageCollection, error) {
+		return shadow.Hello(span, hello, version, since)
+	})
+
+	m.handleResponse(span, hr, resp, session)
 }
 
-func (m *mediator) handleGoodbye(goodbye *gameon.Goodbye, session *Session) {
+func (m *mediator) rejectHello(span *trace.Span, hello *gameon.Hello, session *Session, reason string) {
 	defer session.Close()
 
-	resp, err := m.room.Goodbye(goodbye)
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, hello.UserID, gameon.Event{
+		Type: gameon.TypeEvent,
+		Content: map[string]string{
+			hello.UserID: reason,
+		},
+	})
 	if err != nil {
-		logrus.WithError(err).Errorf("Error executing 'goodbye' with room service")
+		trace.Log(span).WithError(err).Errorf("Error creating rejection message")
 		return
 	}
 
-	m.handleResponse(resp)
+	sendMessage(span, msg, session)
 }
 
-func (m *mediator) handleRoomCommand(command *gameon.RoomCommand, session *Session) {
-	resp, err := m.room.Command(command)
+func (m *mediator) handleGoodbye(span *trace.Span, hr *hostedRoom, goodbye *gameon.Goodbye, session *Session) {
+	if !m.verifyIdentity(span, &goodbye.UserInfo, gameon.DirectionRoomGoodbye, session) {
+		return
+	}
+
+	// The room is told the user left only once their last session says goodbye
+	last := session.Leave()
+	defer session.CloseWithReason(disconnectGoodbye)
+
+	if !last {
+		trace.Log(span).Debugf("User %s left one of their sessions", goodbye.UserID)
+		return
+	}
+
+	client := hr.clientFor(span, goodbye.UserInfo, session)
+	version := session.Version()
+	resp, err := client.Goodbye(span, goodbye, version)
 	if err != nil {
-		logrus.WithError(err).Errorf("Error executing command with room service")
+		m.roomErrorFeedback(span, hr, session, goodbye.UserInfo, gameon.DirectionRoomGoodbye, err)
 		return
 	}
 
-	m.handleResponse(resp)
+	m.mirror(span, hr, client, "/goodbye", goodbye.UserInfo, goodbye, resp, func(span *trace.Span, shadow *room) (*gameon.MessageCollection, error) {
+		return shadow.Goodbye(span, goodbye, version)
+	})
+
+	m.handleResponse(span, hr, resp, session)
 }
 
-func (m *mediator) handleResponse(resp *gameon.MessageCollection) {
+func (m *mediator) handleRoomCommand(span *trace.Span, hr *hostedRoom, command *gameon.RoomCommand, session *Session) {
+	if !m.verifyIdentity(span, &command.UserInfo, gameon.DirectionRoom, session) {
+		return
+	}
+
+	client := hr.clientFor(span, command.UserInfo, session)
+	version := session.Version()
+	resp, err := client.Command(span, command, version)
+	if err != nil {
+		m.roomErrorFeedback(span, hr, session, command.UserInfo, gameon.DirectionRoom, err)
+		return
+	}
+
+	m.mirror(span, hr, client, "/room", command.UserInfo, command, resp, func(span *trace.Span, shadow *room) (*gameon.MessageCollection, error) {
+		return shadow.Command(span, command, version)
+	})
+
+	m.handleResponse(span, hr, resp, session)
+}
+
+// handleResponse dispatches the messages of a room service response to a request made on behalf of the origin session
+// (or pushed by the room service, in which case there is no origin session), to the sessions of the same room.
+// Replies addressed to the requesting user are delivered to the origin session only,
+// while messages addressed to any other user are delivered to all of that user's live sessions, on every mediator replica.
+func (m *mediator) handleResponse(span *trace.Span, hr *hostedRoom, resp *gameon.MessageCollection, origin *Session) {
 	switch len(resp.Messages) {
 	case 0:
-		logrus.Debugf("Response contains no messages")
+		trace.Log(span).Debugf("Response contains no messages")
 	case 1:
-		logrus.Debugf("Dispatching 1 response message")
+		trace.Log(span).Debugf("Dispatching 1 response message")
 	default:
-		logrus.Debugf("Dispatching %d response message", len(resp.Messages))
+		trace.Log(span).Debugf("Dispatching %d response message", len(resp.Messages))
 	}
 
-	for _, msg := range resp.Messages {
-		if msg.Recipient == "*" {
-			sendMessage(&msg, m.sessions.GetUserSessions()...)
-		} else {
-			session := m.sessions.GetUserSession(msg.Recipient)
-			if session != nil {
-				sendMessage(&msg, session)
-			}
-		}
+	var originUserID string
+	if origin != nil {
+		originUserID = origin.UserID()
 	}
-}
 
-func sendMessage(msg *gameon.Message, sessions ...*Session) {
-	logrus.WithFields(messageToFields(msg)).Debugf("Sending message")
+	// Replies are delivered directly, while any other message is published for delivery by all mediator replicas.
+	// Consecutive published messages are batched, and every batch is published before the reply following it,
+	// so that players get the messages in the order the room service returned them.
+	var published []gameon.Message
+	for _, msg := range resp.Messages {
+		if origin == nil || msg.Recipient != originUserID {
+			published = append(published, msg)
+			continue
+		}
 
-	bytes, err := formatMessage(msg)
-	if err != nil {
-		logrus.WithError(err).Errorf("Error formatting message")
-		return
+		if len(published) > 0 {
+			m.fanout.Publish(span, hr, published)
+			published = nil
+		}
+		sendMessage(span, &msg, origin)
 	}
 
-	for _, session := range sessions {
-		err := session.Conn.WriteMessage(websocket.TextMessage, bytes)
-		if err != nil {
-			logrus.WithError(err).Errorf("Error broadcasting message")
-			session.Close()
-		}
+	if len(published) > 0 {
+		m.fanout.Publish(span, hr, published)
 	}
 }
 
-func formatMessage(msg *gameon.Message) ([]byte, error) {
-	var buf bytes.Buffer
+// handleEnvelope delivers messages published to the backplane by any mediator replica to local sessions.
+func (m *mediator) handleEnvelope(env *envelope) {
+	hr, ok := m.rooms[env.RoomID]
+	if !ok {
+		return
+	}
 
-	buf.WriteString(msg.Direction)
-	buf.WriteRune(',')
+	// Delivery continues the trace of the publishing replica, if any
+	parent, _ := trace.ParseTraceparent(env.Traceparent)
+	span := m.tracer.StartSpan("backplane.deliver", parent)
+	span.SetAttribute("roomId", hr.id)
+	span.SetAttribute("origin", env.Origin)
+	defer span.Finish()
 
-	if msg.Recipient != "" {
-		buf.WriteString(msg.Recipient)
-		buf.WriteRune(',')
+	if !m.fanout.Accept(span, env) {
+		span.SetAttribute("dropped", "true")
+		return
 	}
 
-	buf.Write(msg.Payload)
-	return buf.Bytes(), nil
+	deliverMessages(span, hr, env.Messages)
 }
 
-func parseMessage(data []byte) (*gameon.Message, error) {
-	parts := strings.SplitN(string(data), ",", 3)
+func (m *mediator) currentSettings() *settings {
+	return m.settings.Load().(*settings)
+}
 
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("invalid websocket message format: %s", string(data))
+// sendMessage delivers the message to the sessions. Events are split among their audiences,
+// so that each session gets its user's own content and the public content only.
+// Sessions not bound to a user yet get the content of the message's recipient, e.g., when their hello is rejected.
+func sendMessage(span *trace.Span, msg *gameon.Message, sessions ...*Session) {
+	trace.Log(span).WithFields(messageToFields(msg)).Debugf("Sending message")
+
+	audiences, err := gameon.SplitEvent(msg)
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error splitting message among its audiences")
+		return
 	}
 
-	msg := new(gameon.Message)
-	msg.Direction = parts[0]
+	// Messages are encoded once per audience, rather than once per session
+	encoded := make(map[string][]byte, len(audiences))
+	bookmark := gameon.PayloadBookmark(msg)
+	sent := 0
+	for _, session := range sessions {
+		userID := session.UserID()
+		if userID == "" {
+			userID = msg.Recipient
+		}
+		audience := gameon.PublicAudience
+		if _, ok := audiences[userID]; ok && userID != "" {
+			audience = userID
+		}
+
+		scoped := audiences[audience]
+		if scoped == nil {
+			continue
+		}
+
+		bytes, ok := encoded[audience]
+		if !ok {
+			bytes, err = gameon.Encode(scoped)
+			if err != nil {
+				trace.Log(span).WithError(err).Errorf("Error formatting message")
+				return
+			}
+			encoded[audience] = bytes
+		}
 
-	if strings.HasPrefix(parts[1], "{") {
-		// case 1: <direction>,{...}
-		msg.Payload = data[len(parts[0])+1:]
-	} else {
-		// case 2: <direction>,<recipient>,{...}
-		msg.Recipient = parts[1]
-		msg.Payload = data[len(parts[0])+len(parts[1])+2:]
+		session.Send(span, bytes)
+		if bookmark != "" {
+			session.setBookmark(bookmark)
+		}
+		sent++
 	}
+	messagesSent.Add(float64(sent), string(msg.Direction))
+}
 
-	return msg, nil
+func containsVersion(versions []int, version int) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
 }
 
 func messageToFields(msg *gameon.Message) logrus.Fields {
 	return logrus.Fields{
-		"direction": msg.Direction,
+		"direction": string(msg.Direction),
 		"recipient": msg.Recipient,
 		"payload":   string(msg.Payload),
 	}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+func newTestSession(userID string) *Session {
+	return &Session{
+		userID:   userID,
+		done:     make(chan struct{}),
+		outbound: make(chan []byte, 8),
+		manager:  newSessions(0, writeConfig{}, keepaliveConfig{}),
+	}
+}
+
+// TestSendMessageSplitsEvents verifies that a broadcast event reaches each session with its user's own content
+// and the public content only.
+func TestSendMessageSplitsEvents(t *testing.T) {
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, "*", gameon.Event{
+		Type: gameon.TypeEvent,
+		Content: map[string]string{
+			"alice": "Welcome!",
+			"bob":   "alice is here to see you",
+			"*":     "alice has just entered the room",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, carol, anonymous := newTestSession("alice"), newTestSession("bob"), newTestSession("carol"), newTestSession("")
+	sendMessage(span, msg, alice, bob, carol, anonymous)
+
+	want := map[*Session]map[string]string{
+		alice:     {"alice": "Welcome!", "*": "alice has just entered the room"},
+		bob:       {"bob": "alice is here to see you", "*": "alice has just entered the room"},
+		carol:     {"*": "alice has just entered the room"},
+		anonymous: {"*": "alice has just entered the room"},
+	}
+	for session, wantContent := range want {
+		if len(session.outbound) != 1 {
+			t.Fatalf("session of %q got %d messages, want 1", session.UserID(), len(session.outbound))
+		}
+
+		delivered, err := gameon.Decode(<-session.outbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var event gameon.Event
+		err = json.Unmarshal(delivered.Payload, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(event.Content, wantContent) {
+			t.Errorf("session of %q got content %v, want %v", session.UserID(), event.Content, wantContent)
+		}
+	}
+}
+
+// TestSendMessageSkipsSessionsWithoutContent verifies that an event with private content only
+// isn't delivered to sessions of other users.
+func TestSendMessageSkipsSessionsWithoutContent(t *testing.T) {
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, "*", gameon.Event{
+		Type:    gameon.TypeEvent,
+		Content: map[string]string{"alice": "Pardon your french!"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := newTestSession("alice"), newTestSession("bob")
+	sendMessage(span, msg, alice, bob)
+
+	if len(alice.outbound) != 1 {
+		t.Errorf("session of alice got %d messages, want 1", len(alice.outbound))
+	}
+	if len(bob.outbound) != 0 {
+		t.Errorf("session of bob got %d messages, want none", len(bob.outbound))
+	}
+}
+
+// TestHandleMessageCountsInvalidDirections verifies that messages of unknown directions are counted under a single label,
+// rather than one per direction received.
+func TestHandleMessageCountsInvalidDirections(t *testing.T) {
+	m := &mediator{}
+	hr := &hostedRoom{id: "room"}
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+
+	before := gatherMetrics(t)
+	for i := 0; i < 3; i++ {
+		if m.handleMessage(span, hr, newTestSession(""), []byte(fmt.Sprintf("junk%d,{}", i))) {
+			t.Errorf("message of direction junk%d was accepted", i)
+		}
+	}
+	after := gatherMetrics(t)
+
+	if strings.Contains(after, "junk") {
+		t.Errorf("metrics include a series for an invalid direction")
+	}
+	if got := counterValue(after, `chatter_mediator_messages_received_total{direction="invalid"}`) -
+		counterValue(before, `chatter_mediator_messages_received_total{direction="invalid"}`); got != 3 {
+		t.Errorf("counted %v invalid messages, want 3", got)
+	}
+}
+
+func gatherMetrics(t *testing.T) string {
+	var buf bytes.Buffer
+	err := metricsRegistry.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// counterValue returns the value of the series in the metrics, or 0 if there is no such series.
+func counterValue(metrics, series string) float64 {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			value, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// TestRecoveringHelloResumesFromLastBookmark verifies that a recovering user is caught up from the last message
+// delivered to their previous session, and that the room service is told how long they were away rather than since when,
+// so that it doesn't compare its clock to the mediator's.
+func TestRecoveringHelloResumesFromLastBookmark(t *testing.T) {
+	hellos := make(chan *http.Request, 1)
+	bookmarks := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hello gameon.Hello
+		json.NewDecoder(r.Body).Decode(&hello)
+		hellos <- r
+		bookmarks <- hello.Bookmark
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"messages":[]}`))
+	}))
+	defer server.Close()
+
+	m, hr := newTestMediator("room", server.URL)
+	hr.sessions = newSessions(time.Minute, writeConfig{queueSize: 8}, keepaliveConfig{})
+	settings, err := newSettings(&mediatorConfig{ConcurrentLogins: "allow", IdentityPolicy: "reject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.settings.Store(settings)
+
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+	newSession := func() *Session {
+		session := newTestSession("")
+		session.manager = hr.sessions
+		session.Versions = []int{1, 2}
+		return session
+	}
+	bob := gameon.UserInfo{UserID: "bob", Username: "bob"}
+
+	previous := newSession()
+	previous.SetUser(bob, 1, true)
+	for _, bookmark := range []string{"kf12-7", "", "kf12-8"} {
+		msg, err := gameon.NewMessage(gameon.DirectionPlayer, "*", gameon.Chat{Type: gameon.TypeChat, Content: "hi", Bookmark: bookmark})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendMessage(span, msg, previous)
+	}
+	if previous.Bookmark() != "kf12-8" {
+		t.Fatalf("got bookmark %q, want the last one delivered", previous.Bookmark())
+	}
+	previous.CloseWithReason(disconnectConnectionError)
+
+	m.handleHello(span, hr, &gameon.Hello{UserInfo: bob, Recovery: true}, newSession())
+
+	req := <-hellos
+	if bookmark := <-bookmarks; bookmark != "kf12-8" {
+		t.Errorf("got hello bookmark %q, want the last one delivered to the previous session", bookmark)
+	}
+	disconnectedFor, err := time.ParseDuration(req.Header.Get(gameon.DisconnectedForHeader))
+	if err != nil || disconnectedFor < 0 || disconnectedFor > time.Minute {
+		t.Errorf("got %s header %q, want the time since the session closed", gameon.DisconnectedForHeader, req.Header.Get(gameon.DisconnectedForHeader))
+	}
+}
+
+// TestRejectedHelloIsToldWhy verifies that a player whose hello is rejected is sent the reason before the session is closed,
+// although the session isn't bound to the player.
+func TestRejectedHelloIsToldWhy(t *testing.T) {
+	m, hr := newTestMediator("room", "http://localhost:6379/room")
+	hr.sessions = newSessions(0, writeConfig{queueSize: 8}, keepaliveConfig{})
+	settings, err := newSettings(&mediatorConfig{ConcurrentLogins: "forbid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.settings.Store(settings)
+
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+	newSession := func(versions ...int) *Session {
+		session := newTestSession("")
+		session.manager = hr.sessions
+		session.Versions = versions
+		return session
+	}
+	bob := gameon.UserInfo{UserID: "bob", Username: "bob"}
+	newSession(1).SetUser(bob, 1, false)
+
+	tests := []struct {
+		name    string
+		hello   gameon.Hello
+		session *Session
+		want    string
+	}{
+		{
+			name:    "unsupported version",
+			hello:   gameon.Hello{UserInfo: gameon.UserInfo{UserID: "alice", Username: "alice"}, Version: 1},
+			session: newSession(2, 3),
+			want:    "Protocol version 1 is not supported by this room",
+		},
+		{
+			name:    "concurrent login",
+			hello:   gameon.Hello{UserInfo: bob, Version: 1},
+			session: newSession(1),
+			want:    "You are already in this room elsewhere",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m.handleHello(span, hr, &test.hello, test.session)
+
+			select {
+			case <-test.session.Closed():
+			default:
+				t.Fatal("rejected session wasn't closed")
+			}
+			if len(test.session.outbound) != 1 {
+				t.Fatalf("got %d messages, want the rejection", len(test.session.outbound))
+			}
+			delivered, err := gameon.Decode(<-test.session.outbound)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var event gameon.Event
+			err = json.Unmarshal(delivered.Payload, &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := event.Content[test.hello.UserID]; got != test.want {
+				t.Errorf("got %v, want %q", event.Content, test.want)
+			}
+		})
+	}
+}
+
+// TestRejectedHelloKeepsRecoveryState verifies that a hello rejected for a concurrent login doesn't consume
+// the state detached from the user's previous session, so that the session they reconnected on still recovers it.
+func TestRejectedHelloKeepsRecoveryState(t *testing.T) {
+	bookmarks := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hello gameon.Hello
+		json.NewDecoder(r.Body).Decode(&hello)
+		bookmarks <- hello.Bookmark
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"messages":[]}`))
+	}))
+	defer server.Close()
+
+	m, hr := newTestMediator("room", server.URL)
+	hr.sessions = newSessions(time.Minute, writeConfig{queueSize: 8}, keepaliveConfig{})
+	settings, err := newSettings(&mediatorConfig{ConcurrentLogins: "forbid", IdentityPolicy: "reject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.settings.Store(settings)
+
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+	newSession := func() *Session {
+		session := newTestSession("")
+		session.manager = hr.sessions
+		session.Versions = []int{1}
+		return session
+	}
+	bob := gameon.UserInfo{UserID: "bob", Username: "bob"}
+
+	previous := newSession()
+	previous.SetUser(bob, 1, false)
+	previous.setBookmark("kf12-8")
+	previous.CloseWithReason(disconnectConnectionError)
+
+	// bob reconnects, and the reconnected session is bound first, while another hello of bob is handled
+	reconnected := newSession()
+	reconnected.SetUser(bob, 1, false)
+
+	rejected := newSession()
+	m.handleHello(span, hr, &gameon.Hello{UserInfo: bob, Recovery: true}, rejected)
+	if rejected.Reason() == "" {
+		t.Fatal("concurrent hello wasn't rejected")
+	}
+
+	m.handleHello(span, hr, &gameon.Hello{UserInfo: bob, Recovery: true}, reconnected)
+	if bookmark := <-bookmarks; bookmark != "kf12-8" {
+		t.Errorf("got hello bookmark %q, want the one detached from the previous session", bookmark)
+	}
+}
+
+// TestHandleResponseKeepsOrder verifies that the origin session gets the replies and the published messages of a response
+// in the order the room service returned them.
+func TestHandleResponseKeepsOrder(t *testing.T) {
+	backplane := newMemoryBackplane()
+	m, hr := newTestMediator("room", "http://localhost:6379/room")
+	hr.sessions = newSessions(0, writeConfig{queueSize: 8}, keepaliveConfig{})
+	m.fanout = newFanout(backplane, "replica-1")
+	backplane.Subscribe(m.handleEnvelope)
+
+	bob := newTestSession("")
+	bob.manager = hr.sessions
+	bob.SetUser(gameon.UserInfo{UserID: "bob"}, 1, true)
+
+	resp := &gameon.MessageCollection{}
+	for i, recipient := range []string{"*", "bob", "*", "*", "bob"} {
+		msg, err := gameon.NewMessage(gameon.DirectionPlayer, recipient, gameon.Chat{Type: gameon.TypeChat, Content: strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Messages = append(resp.Messages, *msg)
+	}
+
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+	m.handleResponse(span, hr, resp, bob)
+
+	var got []string
+	for len(bob.outbound) > 0 {
+		delivered, err := gameon.Decode(<-bob.outbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chat gameon.Chat
+		json.Unmarshal(delivered.Payload, &chat)
+		got = append(got, chat.Content)
+	}
+	if want := []string{"0", "1", "2", "3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/elevran/chatter/pkg/metrics"
+)
+
+// invalidDirection labels received messages of any direction other than the ones players may send.
+const invalidDirection = "invalid"
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	messagesReceived = metricsRegistry.NewCounter("chatter_mediator_messages_received_total",
+		"Websocket messages received from players, by direction (or invalid).", "direction")
+
+	messagesSent = metricsRegistry.NewCounter("chatter_mediator_messages_sent_total",
+		"Websocket messages queued for delivery to player sessions, by direction.", "direction")
+
+	roomRequestDuration = metricsRegistry.NewHistogram("chatter_mediator_room_request_duration_seconds",
+		"Latency of room service requests, by room, backend, path and status code (or error).",
+		metrics.DefaultBuckets, "room", "backend", "path", "status")
+
+	routedRequests = metricsRegistry.NewCounter("chatter_mediator_routed_requests_total",
+		"Room service requests routed by routing rules, by room and backend.", "room", "backend")
+
+	mirroredRequests = metricsRegistry.NewCounter("chatter_mediator_mirrored_requests_total",
+		"Room service requests mirrored to a shadow backend, by room, shadow backend, path and outcome (match, diff or error).",
+		"room", "backend", "path", "outcome")
+
+	broadcastFanout = metricsRegistry.NewHistogram("chatter_mediator_broadcast_fanout_sessions",
+		"Number of local sessions each room broadcast was delivered to, by room.",
+		[]float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}, "room")
+
+	disconnects = metricsRegistry.NewCounter("chatter_mediator_disconnects_total",
+		"Closed websocket sessions, by room and disconnect reason.", "room", "reason")
+)
+
+// registerMetrics registers the metrics collected from the mediator's state whenever scraped.
+func (m *mediator) registerMetrics() {
+	metricsRegistry.NewGaugeFunc("chatter_mediator_active_sessions",
+		"Live websocket sessions of players who said hello, by room.", []string{"room"},
+		func(report func(float64, ...string)) {
+			for roomID, hr := range m.rooms {
+				report(float64(len(hr.sessions.GetUserSessions())), roomID)
+			}
+		})
+
+	metricsRegistry.NewGaugeFunc("chatter_mediator_room_requests_inflight",
+		"Outstanding room service requests, by room and backend.", []string{"room", "backend"},
+		func(report func(float64, ...string)) {
+			for roomID, hr := range m.rooms {
+				for backend, client := range hr.clients() {
+					report(float64(client.Inflight()), roomID, backend)
+				}
+			}
+		})
+
+	metricsRegistry.NewGaugeFunc("chatter_mediator_room_breaker_state",
+		"State of the room service circuit breaker (0 closed, 1 open, 2 half-open), by room and backend.", []string{"room", "backend"},
+		func(report func(float64, ...string)) {
+			for roomID, hr := range m.rooms {
+				for backend, client := range hr.clients() {
+					report(float64(client.breaker.State()), roomID, backend)
+				}
+			}
+		})
+
+	metricsRegistry.NewCounterFunc("chatter_mediator_room_requests_total",
+		"Room service requests, by room, backend and outcome.", []string{"room", "backend", "outcome"},
+		func(report func(float64, ...string)) {
+			for roomID, hr := range m.rooms {
+				for backend, client := range hr.clients() {
+					stats := client.Stats()
+					report(float64(stats.Successes), roomID, backend, "success")
+					report(float64(stats.Failures), roomID, backend, "failure")
+					report(float64(stats.BreakerRejections), roomID, backend, "breaker_rejected")
+					report(float64(stats.BulkheadRejections), roomID, backend, "bulkhead_rejected")
+				}
+			}
+		})
+
+	metricsRegistry.NewCounterFunc("chatter_mediator_room_request_retries_total",
+		"Room service request retries, by room and backend.", []string{"room", "backend"},
+		func(report func(float64, ...string)) {
+			for roomID, hr := range m.rooms {
+				for backend, client := range hr.clients() {
+					report(float64(client.Stats().Retries), roomID, backend)
+				}
+			}
+		})
+}
+
+// observeRoomRequest records the latency of a room service request attempt,
+// labeled by its status code, or "error" if it got no response.
+func observeRoomRequest(roomID, backend, path string, statusCode int, start time.Time) {
+	status := "error"
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+
+	roomRequestDuration.Observe(time.Since(start).Seconds(), roomID, backend, path, status)
+}
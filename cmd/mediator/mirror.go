@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// mirrorIgnoredFields lists payload fields expected to differ between room services handling the same traffic,
+// which are left out of the comparison of their responses (e.g., bookmarks, which count each service's own history).
+var mirrorIgnoredFields = map[string]bool{
+	"bookmark": true,
+}
+
+// mirrorEntry records a mirrored request whose shadow response differed from the primary one, or failed.
+type mirrorEntry struct {
+	Time            time.Time                 `json:"time"`
+	TraceID         string                    `json:"traceId"`
+	RoomID          string                    `json:"roomId"`
+	Path            string                    `json:"path"`
+	UserID          string                    `json:"userId"`
+	Primary         string                    `json:"primary"`
+	Shadow          string                    `json:"shadow"`
+	Request         interface{}               `json:"request"`
+	Differences     []string                  `json:"differences,omitempty"`
+	Error           string                    `json:"error,omitempty"`
+	PrimaryResponse *gameon.MessageCollection `json:"primaryResponse"`
+	ShadowResponse  *gameon.MessageCollection `json:"shadowResponse,omitempty"`
+}
+
+// mirrorReport records the outcome of mirrored requests which didn't match, as JSON lines.
+// Entries are logged instead if no report file is configured.
+type mirrorReport struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+func newMirrorReport(filename string) (*mirrorReport, error) {
+	if filename == "" {
+		return &mirrorReport{}, nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mirrorReport{w: f}, nil
+}
+
+func (r *mirrorReport) Record(span *trace.Span, entry *mirrorEntry) {
+	if r.w == nil {
+		trace.Log(span).WithFields(logrus.Fields{
+			"roomId":      entry.RoomID,
+			"path":        entry.Path,
+			"userId":      entry.UserID,
+			"shadow":      entry.Shadow,
+			"differences": entry.Differences,
+			"error":       entry.Error,
+		}).Infof("Shadow response differs from primary response")
+		return
+	}
+
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error encoding mirror report entry")
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, err = r.w.Write(append(bytes, '\n'))
+	if err != nil {
+		trace.Log(span).WithError(err).Errorf("Error writing mirror report entry")
+	}
+}
+
+// mirror sends a request which the primary backend responded to, to the room's shadow backend, if any.
+// The shadow request is sent in the background, so that players aren't delayed, and its response is never delivered:
+// it is only compared with the primary response, and recorded if they differ.
+func (m *mediator) mirror(span *trace.Span, hr *hostedRoom, primary *room, path string, user gameon.UserInfo, request interface{}, resp *gameon.MessageCollection, send func(span *trace.Span, shadow *room) (*gameon.MessageCollection, error)) {
+	router := hr.currentRouter()
+	if router == nil || router.shadow == "" || router.shadow == primary.backend {
+		return
+	}
+	shadow := router.backends[router.shadow]
+
+	go func() {
+		span := span.Child("room.mirror")
+		span.SetAttribute("shadow", shadow.backend)
+		defer span.Finish()
+
+		entry := &mirrorEntry{
+			Time:            time.Now(),
+			TraceID:         span.Context.TraceID,
+			RoomID:          hr.id,
+			Path:            path,
+			UserID:          user.UserID,
+			Primary:         primary.backend,
+			Shadow:          shadow.backend,
+			Request:         request,
+			PrimaryResponse: resp,
+		}
+
+		shadowResp, err := send(span, shadow)
+		switch {
+		case err != nil:
+			mirroredRequests.Inc(hr.id, shadow.backend, path, "error")
+			entry.Error = err.Error()
+		default:
+			entry.ShadowResponse = shadowResp
+			entry.Differences = diffResponses(resp, shadowResp)
+			if len(entry.Differences) == 0 {
+				mirroredRequests.Inc(hr.id, shadow.backend, path, "match")
+				return
+			}
+			mirroredRequests.Inc(hr.id, shadow.backend, path, "diff")
+		}
+
+		trace.Log(span).Debugf("Recording mirrored %s request to shadow backend %s", path, shadow.backend)
+		m.mirrorReport.Record(span, entry)
+	}()
+}
+
+// diffResponses compares the primary and shadow responses structurally, message by message and payload field by field.
+// It returns a description of each difference, located by its path, e.g.: messages[0].payload.type: "chat" != "event".
+func diffResponses(primary, shadow *gameon.MessageCollection) []string {
+	var differences []string
+	diffValues("", toTree(primary), toTree(shadow), &differences)
+	return differences
+}
+
+// toTree converts a response to generic JSON values, so that payloads are compared by their fields rather than bytes.
+func toTree(resp *gameon.MessageCollection) interface{} {
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		return nil
+	}
+
+	var tree interface{}
+	json.Unmarshal(bytes, &tree)
+	return tree
+}
+
+func diffValues(path string, primary, shadow interface{}, differences *[]string) {
+	switch p := primary.(type) {
+	case map[string]interface{}:
+		s, ok := shadow.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make(map[string]bool)
+		for key := range p {
+			keys[key] = true
+		}
+		for key := range s {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			if !mirrorIgnoredFields[key] {
+				sorted = append(sorted, key)
+			}
+		}
+		sort.Strings(sorted)
+
+		for _, key := range sorted {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+
+			pv, inPrimary := p[key]
+			sv, inShadow := s[key]
+			switch {
+			case !inShadow:
+				*differences = append(*differences, fmt.Sprintf("%s: only in primary: %s", keyPath, jsonString(pv)))
+			case !inPrimary:
+				*differences = append(*differences, fmt.Sprintf("%s: only in shadow: %s", keyPath, jsonString(sv)))
+			default:
+				diffValues(keyPath, pv, sv, differences)
+			}
+		}
+		return
+
+	case []interface{}:
+		s, ok := shadow.([]interface{})
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(p) || i < len(s); i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(s):
+				*differences = append(*differences, fmt.Sprintf("%s: only in primary: %s", itemPath, jsonString(p[i])))
+			case i >= len(p):
+				*differences = append(*differences, fmt.Sprintf("%s: only in shadow: %s", itemPath, jsonString(s[i])))
+			default:
+				diffValues(itemPath, p[i], s[i], differences)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(primary, shadow) {
+		*differences = append(*differences, fmt.Sprintf("%s: %s != %s", path, jsonString(primary), jsonString(shadow)))
+	}
+}
+
+func jsonString(value interface{}) string {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(bytes)
+}
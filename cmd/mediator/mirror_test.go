@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/elevran/chatter/pkg/gameon"
+)
+
+// newResponse creates a response holding a player message for each of the JSON payloads.
+func newResponse(payloads ...string) *gameon.MessageCollection {
+	resp := &gameon.MessageCollection{}
+	for _, payload := range payloads {
+		resp.Messages = append(resp.Messages, gameon.Message{
+			Direction: gameon.DirectionPlayer,
+			Recipient: "*",
+			Payload:   json.RawMessage(payload),
+		})
+	}
+	return resp
+}
+
+func TestDiffResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary *gameon.MessageCollection
+		shadow  *gameon.MessageCollection
+		want    []string
+	}{
+		{
+			name:    "equal",
+			primary: newResponse(`{"type":"chat","username":"bob","content":"hi"}`),
+			shadow:  newResponse(`{"type":"chat","username":"bob","content":"hi"}`),
+		},
+		{
+			name:    "reordered keys",
+			primary: newResponse(`{"type":"event","content":{"bob":"Welcome!","*":"bob is here"}}`),
+			shadow:  newResponse(`{"content":{"*":"bob is here","bob":"Welcome!"},"type":"event"}`),
+		},
+		{
+			name:    "ignored field",
+			primary: newResponse(`{"type":"chat","content":"hi","bookmark":"12"}`),
+			shadow:  newResponse(`{"type":"chat","content":"hi","bookmark":"3"}`),
+		},
+		{
+			name:    "ignored field only in primary",
+			primary: newResponse(`{"type":"chat","content":"hi","bookmark":"12"}`),
+			shadow:  newResponse(`{"type":"chat","content":"hi"}`),
+		},
+		{
+			name:    "different value",
+			primary: newResponse(`{"type":"chat","content":"hi"}`),
+			shadow:  newResponse(`{"type":"event","content":"hi"}`),
+			want:    []string{`messages[0].payload.type: "chat" != "event"`},
+		},
+		{
+			name:    "nested difference",
+			primary: newResponse(`{"type":"event","content":{"bob":"Welcome!","*":"bob is here"}}`),
+			shadow:  newResponse(`{"type":"event","content":{"bob":"Welcome back!","*":"bob is here"}}`),
+			want:    []string{`messages[0].payload.content.bob: "Welcome!" != "Welcome back!"`},
+		},
+		{
+			name:    "missing and extra fields",
+			primary: newResponse(`{"type":"location","name":"Chatter","description":"dark"}`),
+			shadow:  newResponse(`{"type":"location","name":"Chatter","fullName":"A chat room"}`),
+			want: []string{
+				`messages[0].payload.description: only in primary: "dark"`,
+				`messages[0].payload.fullName: only in shadow: "A chat room"`,
+			},
+		},
+		{
+			name:    "different types",
+			primary: newResponse(`{"type":"event","content":"hi"}`),
+			shadow:  newResponse(`{"type":"event","content":{"*":"hi"}}`),
+			want:    []string{`messages[0].payload.content: "hi" != {"*":"hi"}`},
+		},
+		{
+			name:    "extra message",
+			primary: newResponse(`{"type":"chat","content":"hi"}`),
+			shadow:  newResponse(`{"type":"chat","content":"hi"}`, `{"type":"event","content":"echo"}`),
+			want:    []string{`messages[1]: only in shadow: {"direction":"player","payload":{"content":"echo","type":"event"},"recipient":"*"}`},
+		},
+		{
+			name:    "missing message",
+			primary: newResponse(`{"type":"chat","content":"hi"}`),
+			shadow:  newResponse(),
+			want:    []string{`messages: [{"direction":"player","payload":{"content":"hi","type":"chat"},"recipient":"*"}] != null`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := diffResponses(test.primary, test.shadow)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got differences %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// maxPushSize limits the size of message batches pushed by room services.
+const maxPushSize = 1024 * 1024
+
+// pushVerifier verifies that message batches pushed to the mediator were signed by a room service,
+// using the secret shared between the mediator and its room services.
+type pushVerifier struct {
+	secret  string
+	maxSkew time.Duration
+	now     func() time.Time
+
+	// seen holds the signatures of the pushes accepted within the allowed clock skew, and the time they were signed at,
+	// so that a captured push can't be replayed while its date is still valid.
+	seen  map[string]time.Time
+	mutex sync.Mutex
+}
+
+// newPushVerifier creates a push verifier, or returns nil if no shared secret is configured.
+func newPushVerifier(secret string) *pushVerifier {
+	if secret == "" {
+		return nil
+	}
+
+	return &pushVerifier{
+		secret:  secret,
+		maxSkew: 5 * time.Minute,
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Verify verifies that the push was signed by the given room service ID, and wasn't accepted before.
+func (v *pushVerifier) Verify(req *http.Request, body []byte, pushID string) error {
+	now := v.now()
+	err := gameon.VerifyRequest(req, v.secret, body, v.maxSkew, now)
+	if err != nil {
+		return err
+	}
+
+	if id := req.Header.Get(gameon.IDHeader); id != pushID {
+		return fmt.Errorf("signed by %q rather than %q", id, pushID)
+	}
+
+	signedAt, _ := http.ParseTime(req.Header.Get(gameon.DateHeader))
+	signature := req.Header.Get(gameon.SignatureHeader)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for seen, at := range v.seen {
+		if now.Sub(at) > v.maxSkew {
+			delete(v.seen, seen)
+		}
+	}
+	if _, ok := v.seen[signature]; ok {
+		return fmt.Errorf("replayed signature")
+	}
+	v.seen[signature] = signedAt
+
+	return nil
+}
+
+// handlePush accepts a batch of messages pushed by a room service to /push/<room id>,
+// and dispatches them to the room's sessions just like a response to a player request.
+func (m *mediator) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Pushes continue the trace propagated by the room service, if any
+	parent, _ := trace.Extract(r.Header)
+	span := m.tracer.StartSpan("push", parent)
+	span.SetAttribute("path", r.URL.Path)
+	defer span.Finish()
+
+	log := trace.Log(span).WithFields(logrus.Fields{
+		"remoteAddr": r.RemoteAddr,
+		"path":       r.URL.Path,
+	})
+
+	// Pushes are rejected altogether unless the room services can authenticate
+	if m.pushVerifier == nil {
+		log.Warnf("Rejecting push, no push secret configured")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPushSize))
+	if err != nil {
+		log.WithError(err).Warnf("Error reading pushed messages")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hr, ok := m.lookupRoom(strings.TrimPrefix(r.URL.Path, "/push"))
+	if !ok {
+		log.Warnf("Rejecting push for unknown room")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Each room accepts pushes from its own room service only
+	err = m.pushVerifier.Verify(r, body, hr.pushID)
+	if err != nil {
+		log.WithError(err).Warnf("Rejecting unverified push")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var msgs gameon.MessageCollection
+	err = json.Unmarshal(body, &msgs)
+	if err != nil {
+		log.WithError(err).Warnf("Error unmarshaling pushed messages")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	log.Debugf("Dispatching %d messages pushed to room %q", len(msgs.Messages), hr.id)
+	m.handleResponse(span, hr, &msgs, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
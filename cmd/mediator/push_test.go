@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// newPushTestMediator creates a mediator hosting a lobby, pushed to by the lobby-service, and an attic,
+// along with a session of bob in the lobby.
+func newPushTestMediator(secret string, now time.Time) (*mediator, *Session) {
+	backplane := newMemoryBackplane()
+	m := &mediator{
+		rooms: newHostedRooms(&routingTable{Rooms: map[string]roomRoute{
+			"lobby": {URL: "http://localhost:6379/room", PushID: "lobby-service"},
+			"attic": {URL: "http://localhost:6379/room"},
+		}}, newTestClientConfig(), 0, writeConfig{queueSize: 8}, keepaliveConfig{}),
+		fanout:       newFanout(backplane, "replica-1"),
+		pushVerifier: newPushVerifier(secret),
+		tracer:       trace.NewTracer("test", nil),
+	}
+	if m.pushVerifier != nil {
+		m.pushVerifier.now = func() time.Time { return now }
+	}
+	backplane.Subscribe(m.handleEnvelope)
+
+	bob := newTestSession("")
+	bob.manager = m.rooms["lobby"].sessions
+	bob.SetUser(gameon.UserInfo{UserID: "bob"}, 1, true)
+
+	return m, bob
+}
+
+// newPush creates a push of a chat message to the given path, signed at the given time.
+func newPush(path, id, secret string, signedAt time.Time) *http.Request {
+	body := []byte(`{"messages":[{"direction":"player","recipient":"*","payload":{"type":"chat","content":"hi"}}]}`)
+	req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	gameon.SignRequest(req, id, secret, body, signedAt)
+	return req
+}
+
+func TestHandlePush(t *testing.T) {
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		secret string
+		req    *http.Request
+		status int
+	}{
+		{name: "signed", secret: "secret", req: newPush("/push/lobby", "lobby-service", "secret", now.Add(-time.Second)), status: http.StatusNoContent},
+		{name: "bad signature", secret: "secret", req: newPush("/push/lobby", "lobby-service", "guess", now), status: http.StatusForbidden},
+		{name: "another room's service", secret: "secret", req: newPush("/push/lobby", "attic", "secret", now), status: http.StatusForbidden},
+		{name: "stale date", secret: "secret", req: newPush("/push/lobby", "lobby-service", "secret", now.Add(-time.Hour)), status: http.StatusForbidden},
+		{name: "unknown room", secret: "secret", req: newPush("/push/cellar", "lobby-service", "secret", now), status: http.StatusNotFound},
+		{name: "no secret", req: newPush("/push/lobby", "lobby-service", "secret", now), status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, bob := newPushTestMediator(test.secret, now)
+
+			w := httptest.NewRecorder()
+			m.handlePush(w, test.req)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d", w.Code, test.status)
+			}
+
+			want := 0
+			if test.status == http.StatusNoContent {
+				want = 1
+			}
+			if len(bob.outbound) != want {
+				t.Errorf("delivered %d messages, want %d", len(bob.outbound), want)
+			}
+		})
+	}
+}
+
+func TestHandlePushRejectsReplays(t *testing.T) {
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	m, bob := newPushTestMediator("secret", now)
+
+	original := newPush("/push/lobby", "lobby-service", "secret", now)
+	replayed := newPush("/push/lobby", "lobby-service", "secret", now)
+	later := newPush("/push/lobby", "lobby-service", "secret", now.Add(time.Second))
+
+	for _, step := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{name: "original", req: original, status: http.StatusNoContent},
+		{name: "replayed", req: replayed, status: http.StatusForbidden},
+		{name: "signed later", req: later, status: http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		m.handlePush(w, step.req)
+		if w.Code != step.status {
+			t.Errorf("%s: got status %d, want %d", step.name, w.Code, step.status)
+		}
+	}
+	if len(bob.outbound) != 2 {
+		t.Errorf("delivered %d messages, want 2", len(bob.outbound))
+	}
+
+	// Signatures are forgotten once their date is stale anyway
+	m.pushVerifier.now = func() time.Time { return now.Add(10 * time.Minute) }
+	m.handlePush(httptest.NewRecorder(), newPush("/push/lobby", "lobby-service", "secret", now.Add(10*time.Minute)))
+	if len(m.pushVerifier.seen) != 1 {
+		t.Errorf("remembering %d signatures, want stale ones forgotten", len(m.pushVerifier.seen))
+	}
+}
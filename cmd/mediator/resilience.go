@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elevran/chatter/pkg/fault"
+)
+
+var (
+	// errCircuitOpen is returned for requests failed fast while the room service is considered down.
+	errCircuitOpen = errors.New("room service circuit breaker is open")
+
+	// errBulkheadFull is returned for requests failed fast while too many requests to the room service are outstanding.
+	errBulkheadFull = errors.New("too many outstanding room service requests")
+)
+
+// statusError is returned for room service responses with a non-successful status code.
+type statusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("room service %s %s failed: %d %s: %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// roomClientConfig configures the timeouts, retries, circuit breaker and concurrency limit of room service clients.
+type roomClientConfig struct {
+	timeout          time.Duration
+	retries          int
+	retryBackoff     time.Duration
+	maxRetryBackoff  time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	maxConcurrent    int
+
+	// faults injects faults into room service requests, as managed through the admin API.
+	faults *fault.Injector
+}
+
+func newRoomClientConfig(cfg *mediatorConfig) roomClientConfig {
+	return roomClientConfig{
+		timeout:          cfg.RoomTimeout,
+		retries:          cfg.RoomRetries,
+		retryBackoff:     cfg.RoomRetryBackoff,
+		maxRetryBackoff:  cfg.RoomMaxRetryBackoff,
+		breakerThreshold: cfg.RoomBreakerThreshold,
+		breakerCooldown:  cfg.RoomBreakerCooldown,
+		maxConcurrent:    cfg.RoomMaxConcurrent,
+	}
+}
+
+// backoff returns a randomized delay before the given retry attempt (starting from 1),
+// growing exponentially up to the maximum backoff ("full jitter").
+func (c roomClientConfig) backoff(attempt int) time.Duration {
+	// The shift is clamped so that the ceiling can't overflow into the sign bit, whatever the attempt
+	shift := uint(attempt - 1)
+	if max := uint(bits.LeadingZeros64(uint64(c.retryBackoff))) - 1; shift > max {
+		shift = max
+	}
+
+	ceiling := c.retryBackoff << shift
+	if ceiling > c.maxRetryBackoff {
+		ceiling = c.maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// isRetryable returns true if a failed request may be retried.
+// Requests that can't have been processed by the room service are always retryable,
+// while requests that may have been processed are retryable only if idempotent.
+func isRetryable(err error, idempotent bool) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return idempotent
+		default:
+			return false
+		}
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return idempotent
+	}
+
+	return false
+}
+
+// isServiceFailure returns true if a failed request indicates the room service is unhealthy,
+// as opposed to a rejection of the request itself (e.g., 4xx status codes).
+func isServiceFailure(err error) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed lets all requests through.
+	breakerClosed breakerState = iota
+
+	// breakerOpen fails all requests fast, until the cooldown period ends.
+	breakerOpen
+
+	// breakerHalfOpen lets a single probe request through, to decide whether to close or re-open.
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker fails requests fast after a number of consecutive failures, until the service recovers.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	mutex    sync.Mutex
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow returns errCircuitOpen if the request should be failed fast.
+// Every allowed request must be followed by a call to either Success or Failure.
+func (b *circuitBreaker) Allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return errCircuitOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (b *circuitBreaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) State() breakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+// roomClientStats counts the outcomes of requests made by a room service client.
+type roomClientStats struct {
+	Requests           int64 `json:"requests"`
+	Successes          int64 `json:"successes"`
+	Failures           int64 `json:"failures"`
+	Retries            int64 `json:"retries"`
+	BreakerRejections  int64 `json:"breakerRejections"`
+	BulkheadRejections int64 `json:"bulkheadRejections"`
+}
+
+func (s *roomClientStats) snapshot() roomClientStats {
+	return roomClientStats{
+		Requests:           atomic.LoadInt64(&s.Requests),
+		Successes:          atomic.LoadInt64(&s.Successes),
+		Failures:           atomic.LoadInt64(&s.Failures),
+		Retries:            atomic.LoadInt64(&s.Retries),
+		BreakerRejections:  atomic.LoadInt64(&s.BreakerRejections),
+		BulkheadRejections: atomic.LoadInt64(&s.BulkheadRejections),
+	}
+}
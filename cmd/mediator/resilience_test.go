@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(3, 20*time.Millisecond)
+
+	// Successes reset the count of consecutive failures
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("closed breaker rejected a request: %v", err)
+		}
+		b.Failure()
+	}
+	b.Success()
+	for i := 0; i < 2; i++ {
+		b.Allow()
+		b.Failure()
+	}
+	if b.State() != breakerClosed {
+		t.Fatalf("got %s breaker after 2 consecutive failures, want closed", b.State())
+	}
+
+	b.Allow()
+	b.Failure()
+	if b.State() != breakerOpen {
+		t.Fatalf("got %s breaker after 3 consecutive failures, want open", b.State())
+	}
+	if err := b.Allow(); err != errCircuitOpen {
+		t.Fatalf("open breaker allowed a request: %v", err)
+	}
+
+	// Once cooled down, a single probe is let through, and its failure re-opens the breaker
+	time.Sleep(25 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("cooled down breaker rejected the probe: %v", err)
+	}
+	if b.State() != breakerHalfOpen {
+		t.Fatalf("got %s breaker while probing, want half-open", b.State())
+	}
+	if err := b.Allow(); err != errCircuitOpen {
+		t.Fatalf("half-open breaker allowed a second probe: %v", err)
+	}
+	b.Failure()
+	if b.State() != breakerOpen {
+		t.Fatalf("got %s breaker after a failed probe, want open", b.State())
+	}
+	if err := b.Allow(); err != errCircuitOpen {
+		t.Fatalf("re-opened breaker allowed a request before cooling down: %v", err)
+	}
+
+	// A successful probe closes the breaker
+	time.Sleep(25 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("cooled down breaker rejected the probe: %v", err)
+	}
+	b.Success()
+	if b.State() != breakerClosed {
+		t.Fatalf("got %s breaker after a successful probe, want closed", b.State())
+	}
+	for i := 0; i < 2; i++ {
+		b.Allow()
+		b.Failure()
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("got %s breaker after 2 failures following recovery, want closed", b.State())
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Hour)
+	for i := 0; i < 100; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("disabled breaker rejected a request: %v", err)
+		}
+		b.Failure()
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("got %s disabled breaker, want closed", b.State())
+	}
+}
+
+// timeoutError is a network error reporting a timeout, e.g., of a response read.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	tests := []struct {
+		name string
+		err  error
+		// idempotent and nonIdempotent are whether the error is retryable for idempotent and non-idempotent requests
+		idempotent    bool
+		nonIdempotent bool
+	}{
+		{name: "503", err: &statusError{StatusCode: 503}, idempotent: true, nonIdempotent: true},
+		{name: "502", err: &statusError{StatusCode: 502}, idempotent: true, nonIdempotent: false},
+		{name: "504", err: &statusError{StatusCode: 504}, idempotent: true, nonIdempotent: false},
+		{name: "500", err: &statusError{StatusCode: 500}, idempotent: false, nonIdempotent: false},
+		{name: "400", err: &statusError{StatusCode: 400}, idempotent: false, nonIdempotent: false},
+		{name: "wrapped status", err: fmt.Errorf("hello: %w", &statusError{StatusCode: 503}), idempotent: true, nonIdempotent: true},
+		{name: "dial", err: dialErr, idempotent: true, nonIdempotent: true},
+		{name: "dial by http client", err: &url.Error{Op: "Post", URL: "http://room/room", Err: dialErr}, idempotent: true, nonIdempotent: true},
+		{name: "timeout", err: timeoutError{}, idempotent: true, nonIdempotent: false},
+		{name: "timeout by http client", err: &url.Error{Op: "Get", URL: "http://room/versions", Err: timeoutError{}}, idempotent: true, nonIdempotent: false},
+		{name: "connection reset", err: readErr, idempotent: false, nonIdempotent: false},
+		{name: "circuit open", err: errCircuitOpen, idempotent: false, nonIdempotent: false},
+		{name: "other", err: errors.New("invalid response"), idempotent: false, nonIdempotent: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetryable(test.err, true); got != test.idempotent {
+				t.Errorf("isRetryable(%v, idempotent) = %v, want %v", test.err, got, test.idempotent)
+			}
+			if got := isRetryable(test.err, false); got != test.nonIdempotent {
+				t.Errorf("isRetryable(%v, non-idempotent) = %v, want %v", test.err, got, test.nonIdempotent)
+			}
+		})
+	}
+}
+
+func TestIsServiceFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &statusError{StatusCode: 500}, want: true},
+		{err: &statusError{StatusCode: 503}, want: true},
+		{err: &statusError{StatusCode: 404}, want: false},
+		{err: &statusError{StatusCode: 400}, want: false},
+		{err: timeoutError{}, want: true},
+		{err: errors.New("invalid response"), want: true},
+	}
+
+	for _, test := range tests {
+		if got := isServiceFailure(test.err); got != test.want {
+			t.Errorf("isServiceFailure(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := roomClientConfig{retryBackoff: 100 * time.Millisecond, maxRetryBackoff: time.Second}
+
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{attempt: 1, ceiling: 100 * time.Millisecond},
+		{attempt: 2, ceiling: 200 * time.Millisecond},
+		{attempt: 4, ceiling: 800 * time.Millisecond},
+		{attempt: 5, ceiling: time.Second},
+		// Shifting would overflow, and is clamped before the ceiling is capped as well
+		{attempt: 64, ceiling: time.Second},
+		{attempt: 100, ceiling: time.Second},
+		{attempt: math.MaxInt32, ceiling: time.Second},
+	}
+
+	for _, test := range tests {
+		shortest, longest := test.ceiling, time.Duration(0)
+		for n := 0; n < 1000; n++ {
+			d := c.backoff(test.attempt)
+			if d < 0 || d > test.ceiling {
+				t.Fatalf("backoff(%d) = %s, want up to %s", test.attempt, d, test.ceiling)
+			}
+			if d < shortest {
+				shortest = d
+			}
+			if d > longest {
+				longest = d
+			}
+		}
+		if shortest > test.ceiling/2 || longest < test.ceiling/2 {
+			t.Errorf("backoff(%d) ranged from %s to %s, want full jitter up to %s", test.attempt, shortest, longest, test.ceiling)
+		}
+	}
+}
@@ -3,83 +3,267 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"os"
-
-	"github.com/Sirupsen/logrus"
 	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// versionsTTL is how long the protocol versions supported by a room service are cached,
+// while versionsRetryInterval is how long a failure to query them is, before querying them again.
+const (
+	versionsTTL           = time.Minute
+	versionsRetryInterval = 5 * time.Second
 )
 
 type room struct {
+	id         string
+	backend    string
 	httpClient *http.Client
 	serverURL  string
+	config     roomClientConfig
+	breaker    *circuitBreaker
+	bulkhead   chan struct{}
+	stats      roomClientStats
+	versions   versionsCache
 }
 
-func newRoom() *room {
-	serverURL := os.Getenv("ROOM_SERVICE_URL")
-	if serverURL == "" {
-		serverURL = "http://localhost:6379/room"
-	}
+// versionsCache holds the protocol versions supported by a room service, or the error querying them.
+type versionsCache struct {
+	values  []int
+	err     error
+	expires time.Time
+	mutex   sync.Mutex
+}
 
+func newRoom(id, backend, serverURL string, config roomClientConfig) *room {
 	return &room{
-		httpClient: &http.Client{Timeout: 5 * time.Second},
+		id:         id,
+		backend:    backend,
+		httpClient: &http.Client{Timeout: config.timeout, Transport: config.faults.RoundTripper(http.DefaultTransport)},
 		serverURL:  serverURL,
+		config:     config,
+		breaker:    newCircuitBreaker(config.breakerThreshold, config.breakerCooldown),
+		bulkhead:   make(chan struct{}, config.maxConcurrent),
 	}
 }
 
-func (r *room) Hello(hello *gameon.Hello) (*gameon.MessageCollection, error) {
-	return r.doRequest("/hello", hello.UserInfo, hello)
+// Stats returns a snapshot of the client's request counters.
+func (r *room) Stats() roomClientStats {
+	return r.stats.snapshot()
+}
+
+// Inflight returns the number of outstanding requests to the room service.
+func (r *room) Inflight() int {
+	return len(r.bulkhead)
 }
 
-func (r *room) Goodbye(goodbye *gameon.Goodbye) (*gameon.MessageCollection, error) {
-	return r.doRequest("/goodbye", goodbye.UserInfo, goodbye)
+// Versions returns the protocol versions supported by the room service, which are queried on every new session.
+// They are cached, and queried with a single request bypassing the bulkhead, retries and circuit breaker,
+// so that sessions aren't acknowledged late while the room service is down. The versions last known are returned
+// if querying them fails.
+func (r *room) Versions(span *trace.Span) ([]int, error) {
+	r.versions.mutex.Lock()
+	defer r.versions.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(r.versions.expires) {
+		return r.versions.values, r.versions.err
+	}
+
+	span = span.Child("room.versions")
+	span.SetAttribute("roomId", r.id)
+	span.SetAttribute("backend", r.backend)
+	defer span.Finish()
+
+	var ack gameon.Ack
+	err := r.attempt(span, "GET", "/versions", gameon.UserInfo{}, 0, nil, nil, &ack)
+	switch {
+	case err == nil:
+		r.versions.values, r.versions.err = ack.Version, nil
+		r.versions.expires = now.Add(versionsTTL)
+	case r.versions.values != nil:
+		trace.Log(span).WithError(err).Warnf("Error querying room service for supported versions, using the ones last known")
+		r.versions.expires = now.Add(versionsRetryInterval)
+	default:
+		span.SetAttribute("error", err.Error())
+		r.versions.err = err
+		r.versions.expires = now.Add(versionsRetryInterval)
+	}
+	return r.versions.values, r.versions.err
 }
 
-func (r *room) Command(command *gameon.RoomCommand) (*gameon.MessageCollection, error) {
-	return r.doRequest("/room", command.UserInfo, command)
+// Ping checks that the room service answers, with a single request bypassing the bulkhead, retries and circuit breaker,
+// so that readiness probes neither wait for backoffs nor affect the state of the breaker.
+func (r *room) Ping(span *trace.Span) error {
+	span = span.Child("room.ping")
+	span.SetAttribute("roomId", r.id)
+	span.SetAttribute("backend", r.backend)
+	defer span.Finish()
+
+	var ack gameon.Ack
+	return r.attempt(span, "GET", "/versions", gameon.UserInfo{}, 0, nil, nil, &ack)
 }
 
-func (r *room) doRequest(path string, userInfo gameon.UserInfo, body interface{}) (*gameon.MessageCollection, error) {
-	url := r.serverURL + path
+func (r *room) Hello(span *trace.Span, hello *gameon.Hello, version int, since time.Time) (*gameon.MessageCollection, error) {
+	header := make(http.Header)
+	if !since.IsZero() {
+		header.Set(gameon.DisconnectedForHeader, time.Since(since).String())
+	}
+	return r.doMessageRequest(span, "/hello", hello.UserInfo, version, header, hello)
+}
+
+func (r *room) Goodbye(span *trace.Span, goodbye *gameon.Goodbye, version int) (*gameon.MessageCollection, error) {
+	return r.doMessageRequest(span, "/goodbye", goodbye.UserInfo, version, nil, goodbye)
+}
 
-	reqBytes, err := json.Marshal(body)
+func (r *room) Command(span *trace.Span, command *gameon.RoomCommand, version int) (*gameon.MessageCollection, error) {
+	return r.doMessageRequest(span, "/room", command.UserInfo, version, nil, command)
+}
+
+func (r *room) doMessageRequest(span *trace.Span, path string, userInfo gameon.UserInfo, version int, header http.Header, body interface{}) (*gameon.MessageCollection, error) {
+	var msgs gameon.MessageCollection
+	err := r.doRequest(span, "POST", path, userInfo, version, header, body, &msgs)
 	if err != nil {
 		return nil, err
 	}
-	reqBuf := bytes.NewBuffer(reqBytes)
 
-	req, err := http.NewRequest("POST", url, reqBuf)
+	return &msgs, nil
+}
+
+// doRequest executes a request with the room service, failing fast when too many requests are outstanding,
+// or while the room service is considered down, and retrying failed requests when safe.
+// The request is traced as a child of the given span, and the trace is propagated to the room service.
+func (r *room) doRequest(span *trace.Span, method, path string, userInfo gameon.UserInfo, version int, header http.Header, body, out interface{}) error {
+	atomic.AddInt64(&r.stats.Requests, 1)
+
+	span = span.Child("room.request")
+	span.SetAttribute("roomId", r.id)
+	span.SetAttribute("backend", r.backend)
+	span.SetAttribute("request", method+" "+path)
+	defer span.Finish()
+
+	select {
+	case r.bulkhead <- struct{}{}:
+		defer func() { <-r.bulkhead }()
+	default:
+		atomic.AddInt64(&r.stats.BulkheadRejections, 1)
+		span.SetAttribute("error", errBulkheadFull.Error())
+		return errBulkheadFull
+	}
+
+	var reqBytes []byte
+	if body != nil {
+		var err error
+		reqBytes, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	idempotent := method == "GET"
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			span.SetAttribute("retries", strconv.Itoa(attempt))
+			atomic.AddInt64(&r.stats.Retries, 1)
+			time.Sleep(r.config.backoff(attempt))
+		}
+
+		if err := r.breaker.Allow(); err != nil {
+			atomic.AddInt64(&r.stats.BreakerRejections, 1)
+			span.SetAttribute("error", err.Error())
+			return err
+		}
+
+		err := r.attempt(span, method, path, userInfo, version, header, reqBytes, out)
+		if err == nil {
+			r.breaker.Success()
+			atomic.AddInt64(&r.stats.Successes, 1)
+			return nil
+		}
+
+		if isServiceFailure(err) {
+			r.breaker.Failure()
+		} else {
+			r.breaker.Success()
+		}
+
+		if attempt >= r.config.retries || !isRetryable(err, idempotent) {
+			atomic.AddInt64(&r.stats.Failures, 1)
+			span.SetAttribute("error", err.Error())
+			return err
+		}
+
+		trace.Log(span).WithError(err).Debugf("Retrying room service request: %s %s", method, path)
+	}
+}
+
+func (r *room) attempt(span *trace.Span, method, path string, userInfo gameon.UserInfo, version int, header http.Header, reqBytes []byte, out interface{}) error {
+	url := r.serverURL + path
+
+	var reqBody io.Reader
+	if reqBytes != nil {
+		reqBody = bytes.NewReader(reqBytes)
+	}
+
+	req, err := http.NewRequest(method, url, reqBody)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set(gameon.UserIDHeader, userInfo.UserID)
-	req.Header.Set(gameon.UsernameHeader, userInfo.Username)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if reqBytes != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if userInfo.UserID != "" {
+		req.Header.Set(gameon.UserIDHeader, userInfo.UserID)
+		req.Header.Set(gameon.UsernameHeader, userInfo.Username)
+	}
+	if version != 0 {
+		req.Header.Set(gameon.VersionHeader, strconv.Itoa(version))
+	}
+	span.Inject(req.Header)
 
-	logrus.Debugf("Executing HTTP request: %s %s (%d bytes)", req.Method, req.RequestURI, req.ContentLength)
+	trace.Log(span).Debugf("Executing HTTP request: %s %s (%d bytes)", req.Method, req.URL.Path, req.ContentLength)
 
+	start := time.Now()
 	resp, err := r.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		observeRoomRequest(r.id, r.backend, path, 0, start)
+		return err
 	}
 	defer resp.Body.Close()
+	defer observeRoomRequest(r.id, r.backend, path, resp.StatusCode, start)
 
-	logrus.Debugf("Received HTTP response: %d %s (%d bytes)", resp.StatusCode, resp.Status, resp.ContentLength)
+	span.SetAttribute("status", strconv.Itoa(resp.StatusCode))
+	trace.Log(span).Debugf("Received HTTP response: %d %s (%d bytes)", resp.StatusCode, resp.Status, resp.ContentLength)
 
 	respBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var msgs gameon.MessageCollection
-	err = json.Unmarshal(respBytes, &msgs)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode/100 != 2 {
+		return &statusError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Body:       string(respBytes),
+		}
 	}
 
-	return &msgs, nil
+	err = json.Unmarshal(respBytes, out)
+	if err != nil {
+		return fmt.Errorf("invalid room service response to %s %s: %v", method, path, err)
+	}
+	return nil
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// versionsService is a room service answering /versions with the given versions, or failing while down is set.
+type versionsService struct {
+	*httptest.Server
+	requests int32
+	down     int32
+}
+
+func newVersionsService(versions string) *versionsService {
+	s := &versionsService{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		if atomic.LoadInt32(&s.down) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"version":` + versions + `}`))
+	}))
+	return s
+}
+
+func TestRoomVersionsAreCached(t *testing.T) {
+	service := newVersionsService("[1,2]")
+	defer service.Close()
+
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+	config := newTestClientConfig()
+	config.retries = 3
+	r := newRoom("r1", defaultBackend, service.URL, config)
+
+	for i := 0; i < 3; i++ {
+		versions, err := r.Versions(span)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(versions, []int{1, 2}) {
+			t.Errorf("got versions %v, want [1 2]", versions)
+		}
+	}
+	if n := atomic.LoadInt32(&service.requests); n != 1 {
+		t.Errorf("queried versions %d times, want once", n)
+	}
+
+	// Once expired, a failure to query them again falls back to the versions last known, without retries
+	atomic.StoreInt32(&service.down, 1)
+	r.versions.expires = time.Now()
+
+	versions, err := r.Versions(span)
+	if err != nil || !reflect.DeepEqual(versions, []int{1, 2}) {
+		t.Errorf("got versions %v and error %v, want the versions last known", versions, err)
+	}
+	if n := atomic.LoadInt32(&service.requests); n != 2 {
+		t.Errorf("queried versions %d times, want twice", n)
+	}
+}
+
+func TestRoomVersionsFailFast(t *testing.T) {
+	service := newVersionsService("[1,2]")
+	defer service.Close()
+	atomic.StoreInt32(&service.down, 1)
+
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+	config := newTestClientConfig()
+	config.retries = 3
+	config.retryBackoff = time.Second
+	config.maxRetryBackoff = time.Second
+	r := newRoom("r1", defaultBackend, service.URL, config)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := r.Versions(span); err == nil {
+			t.Errorf("querying versions of a failing room service succeeded")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("querying versions took %s, want no backoff", elapsed)
+	}
+	if n := atomic.LoadInt32(&service.requests); n != 1 {
+		t.Errorf("queried versions %d times, want once until the retry interval passes", n)
+	}
+}
+
+func TestSupportedVersions(t *testing.T) {
+	v1 := newVersionsService("[1,2]")
+	defer v1.Close()
+	v2 := newVersionsService("[2,3]")
+	defer v2.Close()
+	shadow := newVersionsService("[4]")
+	defer shadow.Close()
+	down := newVersionsService("[1]")
+	defer down.Close()
+	atomic.StoreInt32(&down.down, 1)
+
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+
+	tests := []struct {
+		name string
+		// defaultDown is whether the room's default backend is down as well
+		defaultDown bool
+		rules       *roomRoutingRules
+		want        []int
+		err         string
+	}{
+		{name: "no routing", want: []int{1, 2}},
+		{
+			name:  "weighted backends",
+			rules: &roomRoutingRules{Backends: map[string]string{"v2": v2.URL, "v3": shadow.URL}, Weights: map[string]int{"default": 50, "v2": 50}, Shadow: "v3"},
+			want:  []int{2},
+		},
+		{
+			name:  "backend down",
+			rules: &roomRoutingRules{Backends: map[string]string{"v2": down.URL}, Weights: map[string]int{"default": 50, "v2": 50}},
+			want:  []int{1, 2},
+		},
+		{
+			name:  "no common version",
+			rules: &roomRoutingRules{Backends: map[string]string{"v3": shadow.URL}, Rules: []routingRule{{UserIDs: []string{"alice"}, Backend: "v3"}}},
+			err:   "backends default, v3 share no protocol version",
+		},
+		{
+			name:        "no backend queried",
+			defaultDown: true,
+			rules:       &roomRoutingRules{Backends: map[string]string{"v2": down.URL}, Rules: []routingRule{{UserIDs: []string{"alice"}, Backend: "v2"}}},
+			want:        DefaultVersions,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := v1.URL
+			if test.defaultDown {
+				url = down.URL
+			}
+			_, hr := newTestMediator("r1", url)
+			if test.rules != nil {
+				hr.router.Store(newRoomRouter(hr, *test.rules, nil))
+			}
+
+			got, err := hr.supportedVersions(span)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("got versions %v, error %v, want error %q", got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got versions %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestAckAdvertisesSupportedVersions verifies that new sessions are acknowledged with the versions shared by the room's backends,
+// and closed when they share none.
+func TestAckAdvertisesSupportedVersions(t *testing.T) {
+	v1 := newVersionsService("[1,2]")
+	defer v1.Close()
+	v3 := newVersionsService("[3]")
+	defer v3.Close()
+	conn, _, closeConn := newTestConn(t)
+	defer closeConn()
+
+	tests := []struct {
+		name  string
+		rules roomRoutingRules
+		// want are the versions acknowledged, if the session isn't closed
+		want []int
+	}{
+		{name: "common version", rules: roomRoutingRules{Backends: map[string]string{"v3": v3.URL}}, want: []int{1, 2}},
+		{name: "no common version", rules: roomRoutingRules{Backends: map[string]string{"v3": v3.URL}, Weights: map[string]int{"default": 90, "v3": 10}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, hr := newTestMediator("r1", v1.URL)
+			hr.router.Store(newRoomRouter(hr, test.rules, nil))
+			span := m.tracer.StartSpan("test", trace.SpanContext{})
+
+			session := newTestSession("")
+			session.Conn = conn
+			m.ack(span, hr, session)
+
+			if test.want == nil {
+				if session.Reason() == "" || len(session.outbound) != 0 {
+					t.Errorf("got %d messages and session closed for %q, want it closed without an ack", len(session.outbound), session.Reason())
+				}
+				return
+			}
+
+			if len(session.outbound) != 1 {
+				t.Fatalf("got %d messages, want the ack", len(session.outbound))
+			}
+			msg, err := gameon.Decode(<-session.outbound)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ack gameon.Ack
+			err = json.Unmarshal(msg.Payload, &ack)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ack.Version, test.want) || !reflect.DeepEqual(session.Versions, test.want) {
+				t.Errorf("got ack of versions %v and session versions %v, want %v", ack.Version, session.Versions, test.want)
+			}
+		})
+	}
+}
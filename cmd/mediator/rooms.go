@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// hostedRoom is a GameOn! room hosted by the mediator, backed by its own room service.
+// Sessions, broadcasts and goodbyes are all scoped to a single hosted room.
+type hostedRoom struct {
+	id string
+	// name is shown to players when the room service fails to answer their hello.
+	name string
+	// pushID is the ID the room service signs the messages it pushes to the room with.
+	pushID string
+	// client is the room service set in the routing table, which serves all requests unless routing rules are set.
+	client       *room
+	clientConfig roomClientConfig
+	sessions     *SessionManager
+
+	// router holds the room's current *roomRouter, replaced when the routing rules are reloaded.
+	router atomic.Value
+}
+
+// roomRoute maps a GameOn! room ID to its room service.
+// Name is shown to players when the room service fails to answer their hello, and defaults to the room ID.
+// PushID is the ID the room service signs pushed messages with, and defaults to the room ID as well.
+type roomRoute struct {
+	URL    string `json:"url"`
+	Name   string `json:"name,omitempty"`
+	PushID string `json:"pushId,omitempty"`
+}
+
+// routingTable is the format of the file listing the rooms hosted by the mediator, e.g.:
+//
+//	{"rooms": {"<room id>": {"url": "http://localhost:6379/room", "name": "<room name>", "pushId": "<room service id>"}}}
+type routingTable struct {
+	Rooms map[string]roomRoute `json:"rooms"`
+}
+
+// loadRoutingTable loads the rooms to host from the configured routes file,
+// or falls back to the single room configured by its ID and room service URL.
+func loadRoutingTable(cfg *mediatorConfig) (*routingTable, error) {
+	filename := cfg.RoutesFile
+	if filename == "" {
+		return &routingTable{
+			Rooms: map[string]roomRoute{
+				cfg.RoomID: {URL: cfg.RoomServiceURL, Name: cfg.RoomName, PushID: cfg.RoomPushID},
+			},
+		}, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var table routingTable
+	err = json.Unmarshal(data, &table)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing table %s: %v", filename, err)
+	}
+
+	if len(table.Rooms) == 0 {
+		return nil, fmt.Errorf("invalid routing table %s: no rooms", filename)
+	}
+	for roomID, route := range table.Rooms {
+		if roomID == "" || strings.Contains(roomID, "/") {
+			return nil, fmt.Errorf("invalid routing table %s: invalid room id %q", filename, roomID)
+		}
+		if _, err := url.ParseRequestURI(route.URL); err != nil {
+			return nil, fmt.Errorf("invalid routing table %s: invalid url for room %s: %v", filename, roomID, err)
+		}
+	}
+
+	return &table, nil
+}
+
+func newHostedRooms(table *routingTable, clientConfig roomClientConfig, recoveryWindow time.Duration, writeConfig writeConfig, keepalive keepaliveConfig) map[string]*hostedRoom {
+	rooms := make(map[string]*hostedRoom, len(table.Rooms))
+	for roomID, route := range table.Rooms {
+		name := route.Name
+		if name == "" {
+			name = roomID
+		}
+		pushID := route.PushID
+		if pushID == "" {
+			pushID = roomID
+		}
+
+		rooms[roomID] = &hostedRoom{
+			id:           roomID,
+			name:         name,
+			pushID:       pushID,
+			client:       newRoom(roomID, defaultBackend, route.URL, clientConfig),
+			clientConfig: clientConfig,
+			sessions:     newSessions(recoveryWindow, writeConfig, keepalive),
+		}
+	}
+
+	return rooms
+}
+
+// lookupRoom returns the hosted room addressed by the path of a websocket upgrade request (e.g., /<room id>),
+// or the only hosted room when the path addresses none.
+func (m *mediator) lookupRoom(path string) (*hostedRoom, bool) {
+	roomID := strings.Trim(path, "/")
+	if roomID == "" && len(m.rooms) == 1 {
+		for _, hr := range m.rooms {
+			return hr, true
+		}
+	}
+
+	hr, ok := m.rooms[roomID]
+	return hr, ok
+}
+
+// AcceptsRecipient returns true if messages sent to the given recipient are meant for the room.
+// A room hosted with no ID accepts messages sent to any recipient.
+func (hr *hostedRoom) AcceptsRecipient(recipient string) bool {
+	return hr.id == "" || hr.id == recipient
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRoutes writes a routes file with the given content, and returns its name along with a function removing it.
+func writeRoutes(t *testing.T, content string) (string, func()) {
+	routes, err := ioutil.TempFile("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.WriteString(content)
+	routes.Close()
+
+	return routes.Name(), func() {
+		os.Remove(routes.Name())
+	}
+}
+
+func TestLoadRoutingTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]roomRoute
+		err     string
+	}{
+		{
+			name:    "rooms",
+			content: `{"rooms": {"lobby": {"url": "http://lobby:9080/room", "name": "The Lobby", "pushId": "lobby-service"}, "attic": {"url": "http://attic:9080/room"}}}`,
+			want: map[string]roomRoute{
+				"lobby": {URL: "http://lobby:9080/room", Name: "The Lobby", PushID: "lobby-service"},
+				"attic": {URL: "http://attic:9080/room"},
+			},
+		},
+		{name: "invalid json", content: `{"rooms": [`, err: "invalid routing table"},
+		{name: "no rooms", content: `{"rooms": {}}`, err: "no rooms"},
+		{name: "no rooms key", content: `{}`, err: "no rooms"},
+		{name: "empty room id", content: `{"rooms": {"": {"url": "http://lobby:9080/room"}}}`, err: `invalid room id ""`},
+		{name: "room id with a slash", content: `{"rooms": {"lobby/east": {"url": "http://lobby:9080/room"}}}`, err: `invalid room id "lobby/east"`},
+		{name: "missing url", content: `{"rooms": {"lobby": {"name": "The Lobby"}}}`, err: "invalid url for room lobby"},
+		{name: "relative url", content: `{"rooms": {"lobby": {"url": "room"}}}`, err: "invalid url for room lobby"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename, remove := writeRoutes(t, test.content)
+			defer remove()
+
+			table, err := loadRoutingTable(&mediatorConfig{RoutesFile: filename})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) || !strings.Contains(err.Error(), filename) {
+					t.Errorf("got error %v, want %q naming the routes file", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(table.Rooms, test.want) {
+				t.Errorf("got rooms %+v, want %+v", table.Rooms, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadRoutingTableFallback(t *testing.T) {
+	cfg := &mediatorConfig{RoomID: "lobby", RoomName: "Chatter", RoomServiceURL: "http://localhost:6379/room", RoomPushID: "room"}
+	table, err := loadRoutingTable(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]roomRoute{"lobby": {URL: "http://localhost:6379/room", Name: "Chatter", PushID: "room"}}
+	if !reflect.DeepEqual(table.Rooms, want) {
+		t.Errorf("got rooms %+v, want %+v", table.Rooms, want)
+	}
+
+	// A routes file that can't be read isn't ignored for the single room
+	_, err = loadRoutingTable(&mediatorConfig{RoutesFile: "/nonexistent/routes.json", RoomServiceURL: "http://localhost:6379/room"})
+	if err == nil {
+		t.Errorf("loaded a missing routes file")
+	}
+}
+
+func TestLookupRoom(t *testing.T) {
+	filename, remove := writeRoutes(t, `{"rooms": {"lobby": {"url": "http://lobby:9080/room"}, "attic": {"url": "http://attic:9080/room"}}}`)
+	defer remove()
+
+	table, err := loadRoutingTable(&mediatorConfig{RoutesFile: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi := &mediator{rooms: newHostedRooms(table, newTestClientConfig(), 0, writeConfig{queueSize: 1}, keepaliveConfig{})}
+
+	table, err = loadRoutingTable(&mediatorConfig{RoomID: "lobby", RoomServiceURL: "http://lobby:9080/room"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	single := &mediator{rooms: newHostedRooms(table, newTestClientConfig(), 0, writeConfig{queueSize: 1}, keepaliveConfig{})}
+
+	tests := []struct {
+		name string
+		m    *mediator
+		path string
+		// want is the ID of the room found, if any
+		want string
+		ok   bool
+	}{
+		{name: "room path", m: multi, path: "/lobby", want: "lobby", ok: true},
+		{name: "other room path", m: multi, path: "/attic", want: "attic", ok: true},
+		{name: "trailing slash", m: multi, path: "/lobby/", want: "lobby", ok: true},
+		{name: "unknown room", m: multi, path: "/cellar"},
+		{name: "nested path", m: multi, path: "/lobby/east"},
+		{name: "root with several rooms", m: multi, path: "/"},
+		{name: "empty path with several rooms", m: multi, path: ""},
+		{name: "root with a single room", m: single, path: "/", want: "lobby", ok: true},
+		{name: "single room path", m: single, path: "/lobby", want: "lobby", ok: true},
+		{name: "unknown room with a single room", m: single, path: "/attic"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hr, ok := test.m.lookupRoom(test.path)
+			if ok != test.ok {
+				t.Fatalf("got found %v, want %v", ok, test.ok)
+			}
+			if ok && hr.id != test.want {
+				t.Errorf("got room %s, want %s", hr.id, test.want)
+			}
+		})
+	}
+}
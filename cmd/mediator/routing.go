@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// defaultBackend names the room service set for a hosted room in the routing table.
+const defaultBackend = "default"
+
+// routingRules is the format of the file routing the requests of hosted rooms between named room service backends,
+// e.g., versions of the room service:
+//
+//	{"rooms": {"<room id>": {
+//		"backends": {"v1": "http://room-v1", "v2": "http://room-v2"},
+//		"rules": [{"userIds": ["<user id>"], "backend": "v2"}, {"headers": {"X-Canary": "true"}, "backend": "v2"}],
+//		"weights": {"v1": 90, "v2": 10},
+//		"sticky": true,
+//		"shadow": "v3"
+//	}}}
+//
+// Rooms with no rules send all requests to their room service in the routing table, named the "default" backend.
+type routingRules struct {
+	Rooms map[string]roomRoutingRules `json:"rooms"`
+}
+
+// roomRoutingRules routes the requests of a hosted room. Rules are matched in order, and requests matching none of them
+// are split between the backends according to their weights, or sent to the default backend if no weights are set.
+type roomRoutingRules struct {
+	Backends map[string]string `json:"backends"`
+	Rules    []routingRule     `json:"rules"`
+	Weights  map[string]int    `json:"weights"`
+
+	// Sticky pins each session to the backend chosen for its first request on behalf of its user (i.e., its hello),
+	// for the rest of its lifetime. Rules still take precedence, so that users can be pinned while sessions are live.
+	Sticky bool `json:"sticky"`
+
+	// Shadow names a backend mirrored every hello, goodbye and command, whose responses are compared with the primary
+	// ones but never delivered to players.
+	Shadow string `json:"shadow,omitempty"`
+}
+
+// routingRule sends the requests matching all of its conditions to a backend.
+type routingRule struct {
+	UserIDs   []string `json:"userIds,omitempty"`
+	Usernames []string `json:"usernames,omitempty"`
+	// Headers are matched against the headers of the session's websocket upgrade request.
+	Headers map[string]string `json:"headers,omitempty"`
+	Backend string            `json:"backend"`
+}
+
+// loadRoutingRules loads the routing rules file, or returns nil if no file is configured.
+func loadRoutingRules(filename string) (*routingRules, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules routingRules
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing rules %s: %v", filename, err)
+	}
+
+	for roomID, room := range rules.Rooms {
+		err := room.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid routing rules %s: room %q: %v", filename, roomID, err)
+		}
+	}
+
+	return &rules, nil
+}
+
+func (r roomRoutingRules) validate() error {
+	for name, serverURL := range r.Backends {
+		if name == "" || name == defaultBackend {
+			return fmt.Errorf("invalid backend name %q", name)
+		}
+		if _, err := url.ParseRequestURI(serverURL); err != nil {
+			return fmt.Errorf("invalid url for backend %s: %v", name, err)
+		}
+	}
+
+	for i, rule := range r.Rules {
+		if len(rule.UserIDs) == 0 && len(rule.Usernames) == 0 && len(rule.Headers) == 0 {
+			return fmt.Errorf("rule %d has no conditions", i)
+		}
+		if !r.hasBackend(rule.Backend) {
+			return fmt.Errorf("rule %d routes to unknown backend %q", i, rule.Backend)
+		}
+	}
+
+	if r.Shadow != "" && !r.hasBackend(r.Shadow) {
+		return fmt.Errorf("unknown shadow backend %q", r.Shadow)
+	}
+
+	total := 0
+	for name, weight := range r.Weights {
+		if !r.hasBackend(name) {
+			return fmt.Errorf("weight set for unknown backend %q", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("negative weight for backend %s", name)
+		}
+		total += weight
+	}
+	if len(r.Weights) > 0 && total == 0 {
+		return fmt.Errorf("all weights are zero")
+	}
+
+	return nil
+}
+
+func (r roomRoutingRules) hasBackend(name string) bool {
+	_, ok := r.Backends[name]
+	return ok || name == defaultBackend
+}
+
+// weightedBackend is a backend receiving a share of the requests matching no rule.
+type weightedBackend struct {
+	name   string
+	weight int
+}
+
+// roomRouter routes the requests of a hosted room between its backends, according to its routing rules.
+type roomRouter struct {
+	backends map[string]*room
+	rules    []routingRule
+	weights  []weightedBackend
+	total    int
+	sticky   bool
+	shadow   string
+}
+
+// newRoomRouter creates a router for the hosted room, reusing the clients of unchanged backends of the previous router,
+// so that their circuit breaker and request counters carry over a reload.
+func newRoomRouter(hr *hostedRoom, rules roomRoutingRules, previous *roomRouter) *roomRouter {
+	rr := &roomRouter{
+		backends: map[string]*room{defaultBackend: hr.client},
+		rules:    rules.Rules,
+		sticky:   rules.Sticky,
+		shadow:   rules.Shadow,
+	}
+
+	for name, serverURL := range rules.Backends {
+		if previous != nil && previous.backends[name] != nil && previous.backends[name].serverURL == serverURL {
+			rr.backends[name] = previous.backends[name]
+		} else {
+			rr.backends[name] = newRoom(hr.id, name, serverURL, hr.clientConfig)
+		}
+	}
+
+	for name, weight := range rules.Weights {
+		if weight > 0 {
+			rr.weights = append(rr.weights, weightedBackend{name: name, weight: weight})
+			rr.total += weight
+		}
+	}
+	sort.Slice(rr.weights, func(i, j int) bool {
+		return rr.weights[i].name < rr.weights[j].name
+	})
+
+	return rr
+}
+
+// route returns the name of the backend to send a request made on behalf of the user, on the session, to.
+func (rr *roomRouter) route(user gameon.UserInfo, session *Session) string {
+	for _, rule := range rr.rules {
+		if rule.matches(user, session) {
+			return rule.Backend
+		}
+	}
+
+	if rr.sticky && session != nil {
+		if backend := session.Backend(); rr.backends[backend] != nil {
+			return backend
+		}
+	}
+
+	if rr.total > 0 {
+		n := rand.Intn(rr.total)
+		for _, wb := range rr.weights {
+			if n < wb.weight {
+				return wb.name
+			}
+			n -= wb.weight
+		}
+	}
+
+	return defaultBackend
+}
+
+// matches returns true if the request made on behalf of the user, on the session, meets all of the rule's conditions.
+func (rule routingRule) matches(user gameon.UserInfo, session *Session) bool {
+	if len(rule.UserIDs) > 0 && !containsString(rule.UserIDs, user.UserID) {
+		return false
+	}
+	if len(rule.Usernames) > 0 && !containsString(rule.Usernames, user.Username) {
+		return false
+	}
+	for name, value := range rule.Headers {
+		if session == nil || session.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// newRouters creates the routers of the hosted rooms from the routing rules file, reusing the clients of current routers.
+// Rooms with no rules get no router.
+func (m *mediator) newRouters(filename string) (map[string]*roomRouter, error) {
+	rules, err := loadRoutingRules(filename)
+	if err != nil || rules == nil {
+		return nil, err
+	}
+
+	routers := make(map[string]*roomRouter, len(rules.Rooms))
+	for roomID, roomRules := range rules.Rooms {
+		hr, ok := m.rooms[roomID]
+		if !ok {
+			return nil, fmt.Errorf("invalid routing rules %s: room %q is not hosted", filename, roomID)
+		}
+
+		routers[roomID] = newRoomRouter(hr, roomRules, hr.currentRouter())
+	}
+
+	return routers, nil
+}
+
+// setRouters replaces the routers of all hosted rooms.
+func (m *mediator) setRouters(routers map[string]*roomRouter) {
+	for roomID, hr := range m.rooms {
+		router := routers[roomID]
+		hr.router.Store(router)
+
+		if router != nil {
+			weights := make(map[string]int, len(router.weights))
+			for _, wb := range router.weights {
+				weights[wb.name] = wb.weight
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"roomId":  roomID,
+				"rules":   len(router.rules),
+				"weights": weights,
+				"sticky":  router.sticky,
+				"shadow":  router.shadow,
+			}).Infof("Routing room requests between %d backends", len(router.backends))
+		}
+	}
+}
+
+// currentRouter returns the room's router, or nil if its requests all go to the default backend.
+func (hr *hostedRoom) currentRouter() *roomRouter {
+	router, _ := hr.router.Load().(*roomRouter)
+	return router
+}
+
+// clientFor returns the client of the backend routed a request made on behalf of the user, on the session.
+// The user is unknown for requests made before the session's hello, and there is no session for requests made
+// on the mediator's own initiative. With sticky routing, the session is pinned to the backend once its user is known.
+func (hr *hostedRoom) clientFor(span *trace.Span, user gameon.UserInfo, session *Session) *room {
+	router := hr.currentRouter()
+	if router == nil {
+		return hr.client
+	}
+
+	backend := router.route(user, session)
+	span.SetAttribute("backend", backend)
+	routedRequests.Inc(hr.id, backend)
+
+	if router.sticky && session != nil && user.UserID != "" {
+		session.SetBackend(backend)
+	}
+
+	return router.backends[backend]
+}
+
+// serves returns true if the backend may be routed player requests: the default backend, and backends that rules
+// or weights route to. Other backends (e.g., a shadow backend) are only mirrored requests.
+func (rr *roomRouter) serves(backend string) bool {
+	if backend == defaultBackend {
+		return true
+	}
+	for _, rule := range rr.rules {
+		if rule.Backend == backend {
+			return true
+		}
+	}
+	for _, wb := range rr.weights {
+		if wb.name == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// clients returns the clients of all of the room's backends, keyed by backend name.
+func (hr *hostedRoom) clients() map[string]*room {
+	router := hr.currentRouter()
+	if router == nil {
+		return map[string]*room{defaultBackend: hr.client}
+	}
+
+	return router.backends
+}
+
+// servingClients returns the clients of the room's backends that may be routed player requests,
+// and of the backends that are only mirrored requests, keyed by backend name.
+func (hr *hostedRoom) servingClients() (serving, mirrored map[string]*room) {
+	router := hr.currentRouter()
+	if router == nil {
+		return map[string]*room{defaultBackend: hr.client}, nil
+	}
+
+	serving = make(map[string]*room, len(router.backends))
+	mirrored = make(map[string]*room)
+	for backend, client := range router.backends {
+		if router.serves(backend) {
+			serving[backend] = client
+		} else {
+			mirrored[backend] = client
+		}
+	}
+	return serving, mirrored
+}
+
+// supportedVersions returns the protocol versions supported by every backend that may serve players, to be advertised
+// on new sessions, since the backend serving a session is only known once its user says hello.
+// Backends that can't be queried are left out, and the default versions are returned if none can be.
+// An error is returned if the backends queried share no version, as players couldn't be served by all of them.
+func (hr *hostedRoom) supportedVersions(span *trace.Span) ([]int, error) {
+	serving, _ := hr.servingClients()
+	backends := make([]string, 0, len(serving))
+	for backend := range serving {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	var supported []int
+	var queried []string
+	for _, backend := range backends {
+		versions, err := serving[backend].Versions(span)
+		if err != nil || len(versions) == 0 {
+			trace.Log(span).WithError(err).Warnf("Error querying backend %s for supported versions", backend)
+			continue
+		}
+
+		if queried == nil {
+			supported, queried = versions, []string{backend}
+			continue
+		}
+		queried = append(queried, backend)
+
+		var common []int
+		for _, v := range supported {
+			if containsVersion(versions, v) {
+				common = append(common, v)
+			}
+		}
+		supported = common
+	}
+
+	if queried == nil {
+		trace.Log(span).Warnf("No protocol version known to be supported by the room service, using defaults")
+		return DefaultVersions, nil
+	}
+	if len(supported) == 0 {
+		return nil, fmt.Errorf("backends %s share no protocol version", strings.Join(queried, ", "))
+	}
+	return supported, nil
+}
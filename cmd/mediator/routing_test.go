@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// newRoutedSession creates a session with the given websocket upgrade headers, not bound to any connection.
+func newRoutedSession(header http.Header) *Session {
+	return &Session{
+		Header:  header,
+		manager: newSessions(0, writeConfig{}, keepaliveConfig{}),
+	}
+}
+
+func TestRoutingRulesValidate(t *testing.T) {
+	backends := map[string]string{"v2": "http://room-v2", "v3": "http://room-v3"}
+
+	tests := []struct {
+		name  string
+		rules roomRoutingRules
+		err   string
+	}{
+		{name: "valid", rules: roomRoutingRules{
+			Backends: backends,
+			Rules:    []routingRule{{UserIDs: []string{"bob"}, Backend: "v2"}, {Headers: map[string]string{"X-Canary": "true"}, Backend: defaultBackend}},
+			Weights:  map[string]int{defaultBackend: 90, "v2": 10, "v3": 0},
+			Sticky:   true,
+			Shadow:   "v3",
+		}},
+		{name: "no rules", rules: roomRoutingRules{}},
+		{name: "default backend name", rules: roomRoutingRules{Backends: map[string]string{defaultBackend: "http://room"}}, err: `invalid backend name "default"`},
+		{name: "empty backend name", rules: roomRoutingRules{Backends: map[string]string{"": "http://room"}}, err: `invalid backend name ""`},
+		{name: "invalid backend url", rules: roomRoutingRules{Backends: map[string]string{"v2": "room-v2"}}, err: "invalid url for backend v2"},
+		{name: "rule without conditions", rules: roomRoutingRules{Backends: backends, Rules: []routingRule{{Backend: "v2"}}}, err: "rule 0 has no conditions"},
+		{name: "rule to unknown backend", rules: roomRoutingRules{Backends: backends, Rules: []routingRule{{Usernames: []string{"bob"}, Backend: "v4"}}}, err: `rule 0 routes to unknown backend "v4"`},
+		{name: "unknown shadow", rules: roomRoutingRules{Backends: backends, Shadow: "v4"}, err: `unknown shadow backend "v4"`},
+		{name: "weight of unknown backend", rules: roomRoutingRules{Backends: backends, Weights: map[string]int{"v4": 1}}, err: `weight set for unknown backend "v4"`},
+		{name: "negative weight", rules: roomRoutingRules{Backends: backends, Weights: map[string]int{"v2": -1}}, err: "negative weight for backend v2"},
+		{name: "zero weights", rules: roomRoutingRules{Backends: backends, Weights: map[string]int{"v2": 0, "v3": 0}}, err: "all weights are zero"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rules.validate()
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRoute(t *testing.T) {
+	_, hr := newTestMediator("room", "http://room-v1")
+	router := newRoomRouter(hr, roomRoutingRules{
+		Backends: map[string]string{"v2": "http://room-v2", "v3": "http://room-v3"},
+		Rules: []routingRule{
+			{UserIDs: []string{"alice"}, Backend: "v2"},
+			{Usernames: []string{"Bob"}, Headers: map[string]string{"X-Canary": "true"}, Backend: "v3"},
+			{Headers: map[string]string{"X-Canary": "true"}, Backend: "v2"},
+		},
+		Sticky: true,
+	}, nil)
+
+	canary := http.Header{"X-Canary": []string{"true"}}
+	pinned := newRoutedSession(nil)
+	pinned.SetBackend("v3")
+	stale := newRoutedSession(nil)
+	stale.SetBackend("v4")
+
+	tests := []struct {
+		name    string
+		user    gameon.UserInfo
+		session *Session
+		want    string
+	}{
+		{name: "user id", user: gameon.UserInfo{UserID: "alice"}, session: newRoutedSession(nil), want: "v2"},
+		{name: "first rule wins", user: gameon.UserInfo{UserID: "alice", Username: "Bob"}, session: newRoutedSession(canary), want: "v2"},
+		{name: "all conditions", user: gameon.UserInfo{UserID: "bob", Username: "Bob"}, session: newRoutedSession(canary), want: "v3"},
+		{name: "some conditions", user: gameon.UserInfo{UserID: "bob", Username: "Bob"}, session: newRoutedSession(nil), want: defaultBackend},
+		{name: "header", user: gameon.UserInfo{UserID: "carol"}, session: newRoutedSession(canary), want: "v2"},
+		{name: "no session", user: gameon.UserInfo{UserID: "carol"}, want: defaultBackend},
+		{name: "pinned", user: gameon.UserInfo{UserID: "carol"}, session: pinned, want: "v3"},
+		{name: "rule over pin", user: gameon.UserInfo{UserID: "alice"}, session: pinned, want: "v2"},
+		{name: "pinned to a removed backend", user: gameon.UserInfo{UserID: "carol"}, session: stale, want: defaultBackend},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := router.route(test.user, test.session); got != test.want {
+				t.Errorf("got backend %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRouteWeights(t *testing.T) {
+	_, hr := newTestMediator("room", "http://room-v1")
+	router := newRoomRouter(hr, roomRoutingRules{
+		Backends: map[string]string{"v2": "http://room-v2", "v3": "http://room-v3"},
+		Weights:  map[string]int{defaultBackend: 75, "v2": 25, "v3": 0},
+	}, nil)
+
+	routed := make(map[string]int)
+	for n := 0; n < 10000; n++ {
+		routed[router.route(gameon.UserInfo{UserID: "bob"}, nil)]++
+	}
+
+	if routed["v3"] != 0 {
+		t.Errorf("routed %d requests to a backend of weight 0", routed["v3"])
+	}
+	if routed[defaultBackend] < 7000 || routed[defaultBackend] > 8000 || routed["v2"] < 2000 || routed["v2"] > 3000 {
+		t.Errorf("routed %v, want a 75/25 split", routed)
+	}
+}
+
+// TestClientForPinsSession verifies that sticky routing pins a session once its user is known,
+// while other goroutines route requests on the same session.
+func TestClientForPinsSession(t *testing.T) {
+	_, hr := newTestMediator("room", "http://room-v1")
+	hr.router.Store(newRoomRouter(hr, roomRoutingRules{
+		Backends: map[string]string{"v2": "http://room-v2"},
+		Weights:  map[string]int{"v2": 1},
+		Sticky:   true,
+	}, nil))
+
+	span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+	session := newRoutedSession(nil)
+
+	if client := hr.clientFor(span, gameon.UserInfo{}, session); client.backend != "v2" || session.Backend() != "" {
+		t.Errorf("routed to %s pinning %q, want v2 without pinning before the user is known", client.backend, session.Backend())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				hr.clientFor(span, gameon.UserInfo{UserID: "bob"}, session)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if session.Backend() != "v2" {
+		t.Errorf("got session pinned to %q, want v2", session.Backend())
+	}
+
+	// Pins survive reloads dropping the weights, as long as the backend remains
+	hr.router.Store(newRoomRouter(hr, roomRoutingRules{
+		Backends: map[string]string{"v2": "http://room-v2"},
+		Sticky:   true,
+	}, hr.currentRouter()))
+	if client := hr.clientFor(span, gameon.UserInfo{UserID: "bob"}, session); client.backend != "v2" {
+		t.Errorf("routed to %s, want the pinned backend", client.backend)
+	}
+}
@@ -1,88 +1,365 @@
 package main
 
 import (
+	"net/http"
 	"sync"
+	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
 	"github.com/gorilla/websocket"
 )
 
 type Session struct {
-	Conn   *websocket.Conn
-	UserID string
+	Conn *websocket.Conn
 
-	done    chan struct{}
-	manager *SessionManager
+	// Versions holds the protocol versions advertised to the client in the session's ack message.
+	Versions []int
+
+	ConnectedAt time.Time
+
+	// Header holds the headers of the session's websocket upgrade request, matched by routing rules.
+	Header http.Header
+
+	// userID and username are the identity of the user the session is bound to, or empty if not bound yet.
+	userID   string
+	username string
+	// version is the protocol version negotiated on the session's first hello, or 0 if not negotiated yet.
+	version int
+	// backend is the room service backend the session is pinned to by sticky routing, or empty if not pinned.
+	backend string
+	// bookmark is the bookmark of the last room message delivered to the session, or empty if none was.
+	bookmark     string
+	left         bool
+	reason       disconnectReason
+	lastActivity time.Time
+	done         chan struct{}
+	flushed      chan struct{}
+	outbound     chan []byte
+	sendMutex    sync.Mutex
+	config       writeConfig
+	keepalive    keepaliveConfig
+	manager      *SessionManager
+	span         *trace.Span
+}
+
+// DetachedSession holds the state of a user whose session was closed without a goodbye,
+// kept so that a recovering hello from the same user can be reattached to it.
+type DetachedSession struct {
+	UserID         string
+	Version        int
+	Backend        string
+	Bookmark       string
+	DisconnectedAt time.Time
 }
 
 type SessionManager struct {
-	sessions map[string]*Session
-	mutex    sync.RWMutex
+	// live holds every open session, while sessions holds the ones bound to a user, keyed by user ID.
+	live           map[*Session]struct{}
+	sessions       map[string]map[*Session]struct{}
+	detached       map[string]*DetachedSession
+	recoveryWindow time.Duration
+	writeConfig    writeConfig
+	keepalive      keepaliveConfig
+	mutex          sync.RWMutex
 }
 
-func newSessions() *SessionManager {
+func newSessions(recoveryWindow time.Duration, writeConfig writeConfig, keepalive keepaliveConfig) *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*Session),
+		live:           make(map[*Session]struct{}),
+		sessions:       make(map[string]map[*Session]struct{}),
+		detached:       make(map[string]*DetachedSession),
+		recoveryWindow: recoveryWindow,
+		writeConfig:    writeConfig,
+		keepalive:      keepalive,
 	}
 }
 
-func (sm *SessionManager) NewSession(conn *websocket.Conn) *Session {
+// NewSession creates a session for a websocket connection, and starts its writer goroutine.
+// The span lasts as long as the session, and tags the log lines not related to any single message.
+func (sm *SessionManager) NewSession(span *trace.Span, conn *websocket.Conn) *Session {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
 	session := &Session{
-		Conn:    conn,
-		done:    make(chan struct{}),
-		manager: sm,
+		Conn:        conn,
+		ConnectedAt: time.Now(),
+		done:        make(chan struct{}),
+		flushed:     make(chan struct{}),
+		outbound:    make(chan []byte, sm.writeConfig.queueSize),
+		config:      sm.writeConfig,
+		keepalive:   sm.keepalive,
+		manager:     sm,
+		span:        span,
 	}
+	sm.live[session] = struct{}{}
+	go session.writePump()
 
 	return session
 }
 
+// log returns a logger tagging log lines with the trace of the session.
+func (s *Session) log() *logrus.Entry {
+	return trace.Log(s.span)
+}
+
 func (sm *SessionManager) GetUserSessions() []*Session {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
 
 	sessions := make([]*Session, 0, len(sm.sessions))
-	for _, session := range sm.sessions {
+	for _, userSessions := range sm.sessions {
+		for session := range userSessions {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions
+}
+
+// GetAllSessions returns all open sessions, including the ones of players who haven't said hello yet.
+func (sm *SessionManager) GetAllSessions() []*Session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(sm.live))
+	for session := range sm.live {
 		sessions = append(sessions, session)
 	}
 
 	return sessions
 }
 
-func (sm *SessionManager) GetUserSession(userID string) *Session {
+// GetSessionsOfUser returns all live sessions of the given user.
+func (sm *SessionManager) GetSessionsOfUser(userID string) []*Session {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
 
-	return sm.sessions[userID]
+	userSessions := sm.sessions[userID]
+	sessions := make([]*Session, 0, len(userSessions))
+	for session := range userSessions {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// Detached returns the detached state of the given user without removing it,
+// or returns false if the user has no state detached within the recovery window.
+func (sm *SessionManager) Detached(userID string) (*DetachedSession, bool) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	detached, ok := sm.detached[userID]
+	if !ok || time.Since(detached.DisconnectedAt) > sm.recoveryWindow {
+		return nil, false
+	}
+
+	return detached, true
+}
+
+// Recover removes and returns the detached state of the given user,
+// or returns false if the user has no state detached within the recovery window.
+func (sm *SessionManager) Recover(userID string) (*DetachedSession, bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	detached, ok := sm.detached[userID]
+	if !ok {
+		return nil, false
+	}
+
+	delete(sm.detached, userID)
+	if time.Since(detached.DisconnectedAt) > sm.recoveryWindow {
+		return nil, false
+	}
+
+	return detached, true
+}
+
+// detach records the state of a session closed without a goodbye.
+// Must be called with the manager's lock held.
+func (sm *SessionManager) detach(s *Session) {
+	now := time.Now()
+	for userID, detached := range sm.detached {
+		if now.Sub(detached.DisconnectedAt) > sm.recoveryWindow {
+			delete(sm.detached, userID)
+		}
+	}
+
+	if sm.recoveryWindow > 0 {
+		sm.detached[s.userID] = &DetachedSession{
+			UserID:         s.userID,
+			Version:        s.version,
+			Backend:        s.backend,
+			Bookmark:       s.bookmark,
+			DisconnectedAt: now,
+		}
+	}
 }
 
 func (s *Session) Closed() <-chan struct{} {
 	return s.done
 }
 
+// Flushed returns a channel closed once the session's queued messages were flushed, and its connection was closed.
+func (s *Session) Flushed() <-chan struct{} {
+	return s.flushed
+}
+
 func (s *Session) Close() error {
+	return s.CloseWithReason(disconnectServerClose)
+}
+
+// CloseWithReason closes the session, recording the reason unless it was already closed.
+func (s *Session) CloseWithReason(reason disconnectReason) error {
 	s.manager.mutex.Lock()
 	defer s.manager.mutex.Unlock()
 
-	if s.UserID != "" {
-		delete(s.manager.sessions, s.UserID)
-	}
-
 	select {
-	case <- s.done:
+	case <-s.done:
 		// already closed
+		return nil
 	default:
+		s.reason = reason
 		close(s.done)
 	}
+	delete(s.manager.live, s)
+
+	userSessions := s.manager.sessions[s.userID]
+	if _, ok := userSessions[s]; ok {
+		delete(userSessions, s)
+
+		// The user's state is detached for recovery only when their last session is lost
+		if len(userSessions) == 0 {
+			delete(s.manager.sessions, s.userID)
+			if !s.left {
+				s.manager.detach(s)
+			}
+		}
+	}
 
 	return nil
 }
 
-func (s *Session) SetUserID(userID string) {
+// Reason returns the reason the session was closed for, or an empty reason if it is still open.
+func (s *Session) Reason() disconnectReason {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	return s.reason
+}
+
+// UserID returns the ID of the user the session is bound to, or empty if not bound yet.
+func (s *Session) UserID() string {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	return s.userID
+}
+
+// User returns the identity of the user the session is bound to, or empty user info if not bound yet.
+func (s *Session) User() gameon.UserInfo {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	return gameon.UserInfo{UserID: s.userID, Username: s.username}
+}
+
+// Version returns the protocol version negotiated on the session's first hello, or 0 if not negotiated yet.
+func (s *Session) Version() int {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	return s.version
+}
+
+// Backend returns the room service backend the session is pinned to by sticky routing, or empty if not pinned.
+func (s *Session) Backend() string {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	return s.backend
+}
+
+// SetBackend pins the session to a room service backend.
+func (s *Session) SetBackend(backend string) {
+	s.manager.mutex.Lock()
+	defer s.manager.mutex.Unlock()
+
+	s.backend = backend
+}
+
+// RestoreBackend pins the session to the backend its user was pinned to before being disconnected,
+// unless the session is already pinned.
+func (s *Session) RestoreBackend(backend string) {
+	s.manager.mutex.Lock()
+	defer s.manager.mutex.Unlock()
+
+	if s.backend == "" {
+		s.backend = backend
+	}
+}
+
+// Bookmark returns the bookmark of the last room message delivered to the session, or empty if none was.
+func (s *Session) Bookmark() string {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	return s.bookmark
+}
+
+// setBookmark records the bookmark of a room message delivered to the session.
+func (s *Session) setBookmark(bookmark string) {
+	s.manager.mutex.Lock()
+	defer s.manager.mutex.Unlock()
+
+	s.bookmark = bookmark
+}
+
+// Leave marks the session of a user who said goodbye as leaving, so that it can't be recovered once closed.
+// It returns true if no other sessions of the same user remain, in which case the user has left the room.
+func (s *Session) Leave() bool {
+	s.manager.mutex.Lock()
+	defer s.manager.mutex.Unlock()
+
+	s.left = true
+	for session := range s.manager.sessions[s.userID] {
+		if !session.left {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetUser binds the session to the identity of the user who said hello on it, and the protocol version negotiated.
+// It returns the number of other live sessions the user has, or false if the user has other live sessions
+// while concurrent sessions are not allowed, in which case the session is not bound.
+func (s *Session) SetUser(user gameon.UserInfo, version int, allowConcurrent bool) (int, bool) {
 	s.manager.mutex.Lock()
 	defer s.manager.mutex.Unlock()
 
-	s.UserID = userID
-	s.manager.sessions[s.UserID] = s
+	userSessions, ok := s.manager.sessions[user.UserID]
+	if !ok {
+		userSessions = make(map[*Session]struct{})
+		s.manager.sessions[user.UserID] = userSessions
+	}
+
+	others := len(userSessions)
+	if _, ok := userSessions[s]; ok {
+		others--
+	}
+
+	if others > 0 && !allowConcurrent {
+		return others, false
+	}
+
+	s.userID = user.UserID
+	s.username = user.Username
+	s.version = version
+	userSessions[s] = struct{}{}
+
+	return others, true
 }
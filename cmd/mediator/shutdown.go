@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// shutdown gracefully stops the mediator within the given timeout.
+// New sessions are refused, every player is told the room is restarting, the room service is told they left,
+// and all websocket connections are closed cleanly once their queued messages are flushed.
+func (m *mediator) shutdown(timeout time.Duration) {
+	span := m.tracer.StartSpan("shutdown", trace.SpanContext{})
+	defer span.Finish()
+
+	deadline := time.Now().Add(timeout)
+	atomic.StoreInt32(&m.draining, 1)
+
+	var sessions []*Session
+	for _, hr := range m.rooms {
+		sessions = append(sessions, hr.sessions.GetAllSessions()...)
+	}
+
+	drained := make(chan int, 1)
+	go func() {
+		drained <- m.drain(span)
+	}()
+
+	select {
+	case n := <-drained:
+		trace.Log(span).Infof("Drained %d sessions", n)
+	case <-time.After(time.Until(deadline)):
+		trace.Log(span).Warnf("Timed out draining sessions, closing the remaining ones")
+	}
+
+	// Sessions of players who never said hello, or who couldn't be drained in time, are closed as well
+	for _, session := range sessions {
+		session.CloseWithReason(disconnectDrained)
+	}
+
+	// Connections are given at least a write timeout to flush, even once the deadline has passed
+	for _, session := range sessions {
+		flushDeadline := deadline
+		if min := time.Now().Add(session.config.writeTimeout); flushDeadline.Before(min) {
+			flushDeadline = min
+		}
+
+		select {
+		case <-session.Flushed():
+		case <-time.After(time.Until(flushDeadline)):
+			trace.Log(span).WithField("remoteAddr", session.Conn.RemoteAddr().String()).Warnf("Timed out flushing session")
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+	"github.com/gorilla/websocket"
+)
+
+// shutdownClient is the client's end of a live session, along with what it got once the session was closed.
+type shutdownClient struct {
+	session  *Session
+	messages []string
+	closeErr *websocket.CloseError
+	done     chan struct{}
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// hang is whether the room service doesn't answer goodbyes, so that draining times out
+		hang bool
+	}{
+		{name: "drained", timeout: 5 * time.Second},
+		{name: "timed out", timeout: 100 * time.Millisecond, hang: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var goodbyes []string
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/goodbye" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				var goodbye gameon.Goodbye
+				json.NewDecoder(r.Body).Decode(&goodbye)
+				mutex.Lock()
+				goodbyes = append(goodbyes, goodbye.UserID)
+				mutex.Unlock()
+
+				if test.hang {
+					<-release
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"messages":[]}`))
+			}))
+			defer server.Close()
+			defer close(release)
+
+			m, hr := newTestMediator("room", server.URL)
+			hr.sessions = newSessions(0, writeConfig{queueSize: 8, writeTimeout: time.Second}, keepaliveConfig{pingInterval: time.Minute})
+			settings, err := newSettings(&mediatorConfig{ConcurrentLogins: "allow"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.settings.Store(settings)
+			span := m.tracer.StartSpan("test", trace.SpanContext{})
+
+			// bob and alice are in the room, and another player hasn't said hello yet
+			users := []gameon.UserInfo{{UserID: "alice", Username: "Alice"}, {UserID: "bob", Username: "Bob"}, {}}
+			clients := make([]*shutdownClient, len(users))
+			for i, user := range users {
+				conn, client, closeConn := newTestConn(t)
+				defer closeConn()
+
+				c := &shutdownClient{session: hr.sessions.NewSession(span, conn), done: make(chan struct{})}
+				if user.UserID != "" {
+					c.session.SetUser(user, 1, true)
+				}
+				go func() {
+					defer close(c.done)
+					c.messages, c.closeErr = readUntilClosed(t, client)
+				}()
+				clients[i] = c
+			}
+
+			started := time.Now()
+			m.shutdown(test.timeout)
+			if elapsed := time.Since(started); elapsed > test.timeout+time.Second {
+				t.Errorf("shutdown took %s, want it bounded by the timeout", elapsed)
+			}
+
+			if atomic.LoadInt32(&m.draining) == 0 {
+				t.Errorf("mediator still accepts new sessions")
+			}
+
+			noticed := 0
+			for i, c := range clients {
+				select {
+				case <-c.done:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("session of %q wasn't closed", users[i].UserID)
+				}
+				if c.session.Reason() != disconnectDrained {
+					t.Errorf("session of %q was closed for %s, want %s", users[i].UserID, c.session.Reason(), disconnectDrained)
+				}
+				if c.closeErr == nil || c.closeErr.Code != websocket.CloseGoingAway || c.closeErr.Text != string(disconnectDrained) {
+					t.Errorf("session of %q got close %v, want %d %q", users[i].UserID, c.closeErr, websocket.CloseGoingAway, disconnectDrained)
+				}
+
+				if len(c.messages) == 0 {
+					continue
+				}
+				if users[i].UserID == "" || len(c.messages) != 1 || !isRestartNotice(t, c.messages[0], users[i].UserID) {
+					t.Errorf("session of %q got messages %q, want the restart notice only", users[i].UserID, c.messages)
+					continue
+				}
+				noticed++
+			}
+
+			mutex.Lock()
+			sort.Strings(goodbyes)
+			got := append([]string(nil), goodbyes...)
+			mutex.Unlock()
+
+			if test.hang {
+				// Draining is stuck on the room service's answer to the first goodbye, and the other player is disconnected without notice
+				if len(got) != 1 || noticed != 1 {
+					t.Errorf("got goodbyes %q and %d players noticed, want those of the single player drained", got, noticed)
+				}
+				return
+			}
+			if want := []string{"alice", "bob"}; !reflect.DeepEqual(got, want) || noticed != len(want) {
+				t.Errorf("got goodbyes %q and %d players noticed, want both players drained", got, noticed)
+			}
+		})
+	}
+}
+
+// isRestartNotice returns true if the message delivered to the given user tells them the room is restarting.
+func isRestartNotice(t *testing.T, data, userID string) bool {
+	msg, err := gameon.Decode([]byte(data))
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+
+	var event gameon.Event
+	err = json.Unmarshal(msg.Payload, &event)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	return msg.Direction == gameon.DirectionPlayer && msg.Recipient == userID && event.Content[userID] == "The room is restarting, please come back in a moment"
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/trace"
+	"github.com/gorilla/websocket"
+)
+
+// slowConsumerPolicy determines what happens to a message sent to a session whose outbound queue is full.
+type slowConsumerPolicy string
+
+const (
+	// slowConsumerDrop drops the new message.
+	slowConsumerDrop slowConsumerPolicy = "drop"
+
+	// slowConsumerDisconnect closes the session.
+	slowConsumerDisconnect slowConsumerPolicy = "disconnect"
+
+	// slowConsumerCoalesce drops the oldest queued messages to make room for the new one,
+	// so that a slow client catches up on the most recent messages only.
+	slowConsumerCoalesce slowConsumerPolicy = "coalesce"
+)
+
+// writeConfig configures the outbound queue and writer goroutine owned by every session.
+type writeConfig struct {
+	queueSize    int
+	writeTimeout time.Duration
+	policy       slowConsumerPolicy
+}
+
+func newWriteConfig(cfg *mediatorConfig) writeConfig {
+	return writeConfig{
+		queueSize:    cfg.SessionQueueSize,
+		writeTimeout: cfg.WriteTimeout,
+		policy:       slowConsumerPolicy(cfg.SlowConsumerPolicy),
+	}
+}
+
+// Send queues a message to be written to the session's websocket connection by its writer goroutine.
+// When the queue is full, the message is handled according to the slow consumer policy, logged within the message's span.
+func (s *Session) Send(span *trace.Span, data []byte) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	select {
+	case s.outbound <- data:
+		return
+	default:
+	}
+
+	fields := logrus.Fields{
+		"userId":     s.UserID(),
+		"remoteAddr": s.Conn.RemoteAddr().String(),
+		"queueDepth": s.QueueDepth(),
+		"policy":     string(s.config.policy),
+	}
+
+	switch s.config.policy {
+	case slowConsumerDisconnect:
+		trace.Log(span).WithFields(fields).Warnf("Disconnecting slow consumer")
+		s.CloseWithReason(disconnectSlowConsumer)
+
+	case slowConsumerCoalesce:
+		// Senders are serialized, so that the room made for the new message isn't taken by another one
+		s.sendMutex.Lock()
+		defer s.sendMutex.Unlock()
+
+		dropped := 0
+		for {
+			select {
+			case s.outbound <- data:
+				if dropped > 0 {
+					trace.Log(span).WithFields(fields).Debugf("Coalesced slow consumer queue, dropping %d messages", dropped)
+				}
+				return
+			default:
+			}
+
+			select {
+			case <-s.outbound:
+				dropped++
+			default:
+			}
+		}
+
+	default:
+		trace.Log(span).WithFields(fields).Warnf("Dropping message to slow consumer")
+	}
+}
+
+// QueueDepth returns the number of messages queued to be written to the session's websocket connection.
+func (s *Session) QueueDepth() int {
+	return len(s.outbound)
+}
+
+// writePump is the session's single writer goroutine, and the only one writing to its websocket connection.
+// It also pings the client periodically, to verify the connection is alive.
+// Once the session is closed, messages still queued are flushed on a best-effort basis, and the connection is closed.
+func (s *Session) writePump() {
+	defer close(s.flushed)
+	defer s.Conn.Close()
+
+	pingTicker := time.NewTicker(s.keepalive.pingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case data := <-s.outbound:
+			err := s.write(data)
+			if err != nil {
+				s.log().WithError(err).Errorf("Error writing websocket message")
+				s.CloseWithReason(disconnectWriteError)
+				return
+			}
+
+		case <-pingTicker.C:
+			err := s.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.config.writeTimeout))
+			if err != nil {
+				s.log().WithError(err).Errorf("Error writing websocket ping")
+				s.CloseWithReason(disconnectWriteError)
+				return
+			}
+
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush writes the messages still queued for a closed session, followed by a close message when the connection allows it.
+func (s *Session) flush() {
+	code, ok := s.Reason().closeCode()
+	if !ok {
+		return
+	}
+
+	for {
+		select {
+		case data := <-s.outbound:
+			if s.write(data) != nil {
+				return
+			}
+		default:
+			closeMsg := websocket.FormatCloseMessage(code, string(s.Reason()))
+			s.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(s.config.writeTimeout))
+			return
+		}
+	}
+}
+
+func (s *Session) write(data []byte) error {
+	s.Conn.SetWriteDeadline(time.Now().Add(s.config.writeTimeout))
+	return s.Conn.WriteMessage(websocket.TextMessage, data)
+}
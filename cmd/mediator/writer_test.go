@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/trace"
+	"github.com/gorilla/websocket"
+)
+
+// newTestConn connects a websocket client to a test server, and returns the server's end of the connection,
+// the client's end, and a function closing both along with the server.
+func newTestConn(t *testing.T) (*websocket.Conn, *websocket.Conn, func()) {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			close(conns)
+			return
+		}
+		conns <- conn
+	}))
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	conn := <-conns
+
+	return conn, client, func() {
+		client.Close()
+		if conn != nil {
+			conn.Close()
+		}
+		server.Close()
+	}
+}
+
+// readUntilClosed reads text messages from the client's end of a connection until the server closes it,
+// and returns them along with the close error, or nil if the connection failed otherwise.
+func readUntilClosed(t *testing.T, client *websocket.Conn) ([]string, *websocket.CloseError) {
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var messages []string
+	for {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			if !ok {
+				t.Errorf("got error %v, want the connection closed by the server", err)
+			}
+			return messages, closeErr
+		}
+		messages = append(messages, string(data))
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	tests := []struct {
+		policy slowConsumerPolicy
+		// want are the messages the client gets, once the session is closed for the expected reason
+		want   []string
+		reason disconnectReason
+		code   int
+	}{
+		{policy: slowConsumerDrop, want: []string{"0", "1", "2"}, reason: disconnectServerClose, code: websocket.CloseNormalClosure},
+		{policy: slowConsumerDisconnect, want: []string{"0", "1", "2"}, reason: disconnectSlowConsumer, code: websocket.CloseGoingAway},
+		{policy: slowConsumerCoalesce, want: []string{"2", "3", "4"}, reason: disconnectServerClose, code: websocket.CloseNormalClosure},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			conn, client, closeConn := newTestConn(t)
+			defer closeConn()
+
+			// The session's writer is stalled until all messages were sent
+			sm := newSessions(0, writeConfig{queueSize: 3, writeTimeout: time.Second, policy: test.policy}, keepaliveConfig{pingInterval: time.Hour})
+			session := &Session{
+				Conn:      conn,
+				done:      make(chan struct{}),
+				flushed:   make(chan struct{}),
+				outbound:  make(chan []byte, sm.writeConfig.queueSize),
+				config:    sm.writeConfig,
+				keepalive: sm.keepalive,
+				manager:   sm,
+			}
+			sm.live[session] = struct{}{}
+
+			span := trace.NewTracer("test", nil).StartSpan("test", trace.SpanContext{})
+			for i := 0; i < 5; i++ {
+				session.Send(span, []byte(strconv.Itoa(i)))
+			}
+			if session.QueueDepth() != 3 {
+				t.Errorf("got queue depth %d, want the queue size", session.QueueDepth())
+			}
+			if test.reason != disconnectSlowConsumer && session.Reason() != "" {
+				t.Errorf("session was closed for %s, want it open", session.Reason())
+			}
+
+			go session.writePump()
+			session.Close()
+			<-session.Flushed()
+
+			messages, closeErr := readUntilClosed(t, client)
+			if !reflect.DeepEqual(messages, test.want) {
+				t.Errorf("got messages %q, want %q", messages, test.want)
+			}
+			if session.Reason() != test.reason {
+				t.Errorf("session was closed for %s, want %s", session.Reason(), test.reason)
+			}
+			if closeErr == nil || closeErr.Code != test.code || closeErr.Text != string(test.reason) {
+				t.Errorf("got close %v, want %d %q", closeErr, test.code, test.reason)
+			}
+		})
+	}
+}
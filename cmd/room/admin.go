@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/elevran/chatter/pkg/admin"
+	"github.com/elevran/chatter/pkg/fault"
+)
+
+// newAdminHandler creates the room service's administrative HTTP API, announcing events to the players in the room
+// and managing the faults injected into its handlers. Requests must carry the admin token as a bearer token.
+func newAdminHandler(token string, room *room, faults *fault.Injector) http.Handler {
+	mux := http.NewServeMux()
+
+	// Announcements are pushed to players as room events, so that only trusted callers may send them
+	mux.HandleFunc("/announce", instrument("/announce", room.traced("/announce", room.announce)))
+
+	handler := faults.AdminHandler("/faults")
+	mux.Handle("/faults", handler)
+	mux.Handle("/faults/", handler)
+
+	return admin.RequireToken(token, mux)
+}
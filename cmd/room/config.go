@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/config"
+)
+
+// roomConfig holds the room service's settings, loaded from a configuration file, environment variables and flags.
+// Settings marked reload are applied again on SIGHUP.
+type roomConfig struct {
+	Listen          string        `key:"listen" env:"LISTEN_ADDR" default:":80" usage:"Address serving the room API and metrics"`
+	LogLevel        string        `key:"log.level" env:"LOG_LEVEL" default:"info" options:"debug,info,warning,error" reload:"true" usage:"Log level"`
+	ShutdownTimeout time.Duration `key:"shutdown.timeout" env:"SHUTDOWN_TIMEOUT" default:"10s" min:"0s" usage:"Time allowed for requests in flight to complete on shutdown"`
+	ShutdownDelay   time.Duration `key:"shutdown.delay" env:"SHUTDOWN_DELAY" min:"0s" usage:"Time requests are still served on shutdown while readiness fails, letting probes route traffic elsewhere"`
+	HealthTimeout   time.Duration `key:"health.timeout" env:"HEALTH_TIMEOUT" default:"2s" min:"1ms" usage:"Timeout of each readiness check"`
+
+	Version     string `key:"version" env:"VERSION" default:"v1" options:"v1,v2" usage:"Version of the room service, selecting its profanity checker"`
+	HistorySize int    `key:"history.size" env:"HISTORY_SIZE" default:"100" min:"1" usage:"Number of chat messages kept for /history"`
+
+	MapServiceURL string `key:"map.url" env:"MAP_SERVICE_URL" usage:"URL of the GameOn! Map service the room registers with"`
+	GameOnID      string `key:"gameon.id" env:"GAMEON_ID" usage:"GameOn! ID used with the Map service"`
+	GameOnSecret  string `key:"gameon.secret" env:"GAMEON_SECRET" secret:"true" usage:"GameOn! secret used with the Map service"`
+	RoomEndpoint  string `key:"room.endpoint" env:"ROOM_ENDPOINT" usage:"Websocket endpoint registered with the Map service"`
+
+	PushURL         string        `key:"push.url" env:"MEDIATOR_PUSH_URL" usage:"URL of the mediator's push endpoint, which is disabled if not set"`
+	PushID          string        `key:"push.id" env:"PUSH_ID" default:"room" usage:"ID of the room service signing pushed messages"`
+	PushSecret      string        `key:"push.secret" env:"PUSH_SECRET" secret:"true" usage:"Secret signing pushed messages"`
+	PushTimeout     time.Duration `key:"push.timeout" env:"PUSH_TIMEOUT" default:"5s" min:"1ms" usage:"Timeout of push requests"`
+	AmbientInterval time.Duration `key:"ambient.interval" env:"AMBIENT_INTERVAL" min:"0s" usage:"Interval between pushed ambient events (0 disables them)"`
+
+	TraceExport string `key:"trace.export" env:"TRACE_EXPORT" usage:"Destination of exported spans: stdout or a file path"`
+
+	AdminAddr  string `key:"admin.addr" env:"ADMIN_ADDR" default:":81" usage:"Address serving the admin API"`
+	AdminToken string `key:"admin.token" env:"ADMIN_TOKEN" secret:"true" usage:"Bearer token of the admin API, which is disabled if not set"`
+}
+
+// loadConfig loads the room service's configuration, exiting if it is invalid.
+// The returned loader reloads it on SIGHUP.
+func loadConfig() (*roomConfig, *config.Loader) {
+	cfg := new(roomConfig)
+	loader := config.MustLoad(cfg)
+	return cfg, loader
+}
+
+// reloadConfig reloads the configuration, applying the settings that can be changed while running.
+func reloadConfig(cfg *roomConfig, loader *config.Loader) {
+	next, applied, err := loader.Reload(cfg)
+	if err != nil {
+		logrus.WithError(err).Errorf("Invalid configuration, keeping the current one")
+		return
+	}
+
+	*cfg = *next.(*roomConfig)
+	loader.Reloaded(cfg, applied)
+}
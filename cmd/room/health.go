@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/elevran/chatter/pkg/health"
+)
+
+// newHealthChecker creates the room service's readiness checks, covering its profanity checker and message history.
+// Both are in-process, so the checks exercise them, failing if they hang (e.g., on a lock) or panic.
+func (r *room) newHealthChecker(timeout time.Duration) *health.Checker {
+	checker := health.NewChecker(timeout)
+
+	checker.Add("profanity", func() error {
+		if r.profanityChecker == nil {
+			return errors.New("no profanity checker configured")
+		}
+		r.profanityChecker.Check("readiness probe")
+		return nil
+	})
+
+	checker.Add("history", func() error {
+		if r.history == nil {
+			return errors.New("no history storage configured")
+		}
+		r.history.Since(time.Now())
+		return nil
+	})
+
+	return checker
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+)
+
+type historyEntry struct {
+	bookmark uint64
+	time     time.Time
+	message  gameon.Message
+}
+
+// history keeps a bounded record of the messages broadcast in the room, oldest first.
+// Every recorded message is assigned a monotonically increasing bookmark: <epoch>-<sequence number>,
+// where the epoch is the time the history was created (in base 36), so that bookmarks keep increasing
+// when the room service restarts and its sequence numbers start over.
+type history struct {
+	entries  []historyEntry
+	capacity int
+	epoch    int64
+	bookmark uint64
+	mutex    sync.RWMutex
+}
+
+func newHistory(capacity int) *history {
+	return &history{
+		entries:  make([]historyEntry, 0, capacity),
+		capacity: capacity,
+		epoch:    time.Now().UnixNano(),
+	}
+}
+
+// Record assigns the next bookmark to the message, and returns it with the bookmark set on its chat or event payload.
+func (h *history) Record(msg gameon.Message) gameon.Message {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.bookmark++
+	msg.Payload = setBookmark(msg, formatBookmark(h.epoch, h.bookmark))
+
+	if h.capacity <= 0 {
+		return msg
+	}
+
+	if len(h.entries) == h.capacity {
+		copy(h.entries, h.entries[1:])
+		h.entries = h.entries[:len(h.entries)-1]
+	}
+	h.entries = append(h.entries, historyEntry{bookmark: h.bookmark, time: time.Now(), message: msg})
+
+	return msg
+}
+
+// Since returns the messages recorded after the given time, oldest first.
+func (h *history) Since(t time.Time) []gameon.Message {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var messages []gameon.Message
+	for _, entry := range h.entries {
+		if entry.time.After(t) {
+			messages = append(messages, entry.message)
+		}
+	}
+
+	return messages
+}
+
+// After returns the messages recorded after the given bookmark, oldest first.
+// A bookmark from an earlier epoch was assigned before the room service restarted, and precedes every recorded message,
+// while one from a later epoch was assigned by another instance of the room service, and none is known to follow it.
+func (h *history) After(bookmark string) ([]gameon.Message, error) {
+	epoch, after, err := parseBookmark(bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	switch {
+	case epoch < h.epoch:
+		after = 0
+	case epoch > h.epoch:
+		return nil, nil
+	}
+
+	var messages []gameon.Message
+	for _, entry := range h.entries {
+		if entry.bookmark > after {
+			messages = append(messages, entry.message)
+		}
+	}
+
+	return messages, nil
+}
+
+// Last returns the last n recorded messages, oldest first.
+func (h *history) Last(n int) []gameon.Message {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if n > len(h.entries) {
+		n = len(h.entries)
+	}
+
+	messages := make([]gameon.Message, 0, n)
+	for _, entry := range h.entries[len(h.entries)-n:] {
+		messages = append(messages, entry.message)
+	}
+
+	return messages
+}
+
+func setBookmark(msg gameon.Message, bookmark string) []byte {
+	payload, err := gameon.DecodePayload(&msg)
+	if err != nil {
+		return msg.Payload
+	}
+
+	switch payload := payload.(type) {
+	case *gameon.Chat:
+		payload.Bookmark = bookmark
+	case *gameon.Event:
+		payload.Bookmark = bookmark
+	default:
+		return msg.Payload
+	}
+
+	return jsonMarshal(payload)
+}
+
+func formatBookmark(epoch int64, bookmark uint64) string {
+	return strconv.FormatInt(epoch, 36) + "-" + strconv.FormatUint(bookmark, 10)
+}
+
+// parseBookmark parses a bookmark into its epoch and sequence number.
+func parseBookmark(bookmark string) (int64, uint64, error) {
+	dash := strings.IndexByte(bookmark, '-')
+	if dash < 0 {
+		return 0, 0, fmt.Errorf("invalid bookmark: %s", bookmark)
+	}
+
+	epoch, err := strconv.ParseInt(bookmark[:dash], 36, 64)
+	if err != nil || epoch <= 0 {
+		return 0, 0, fmt.Errorf("invalid bookmark: %s", bookmark)
+	}
+	value, err := strconv.ParseUint(bookmark[dash+1:], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid bookmark: %s", bookmark)
+	}
+	return epoch, value, nil
+}
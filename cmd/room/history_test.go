@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+)
+
+// chat creates a chat message broadcast to the room.
+func chat(content string) gameon.Message {
+	return gameon.Message{
+		Direction: gameon.DirectionPlayer,
+		Recipient: "*",
+		Payload:   jsonMarshal(gameon.Chat{Type: gameon.TypeChat, Username: "bob", Content: content}),
+	}
+}
+
+// contents returns the content of each chat message.
+func contents(t *testing.T, messages []gameon.Message) []string {
+	var contents []string
+	for _, msg := range messages {
+		var chat gameon.Chat
+		err := json.Unmarshal(msg.Payload, &chat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, chat.Content)
+	}
+	return contents
+}
+
+// bookmarkOf returns the bookmark set on a recorded chat message.
+func bookmarkOf(t *testing.T, msg gameon.Message) string {
+	var chat gameon.Chat
+	err := json.Unmarshal(msg.Payload, &chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chat.Bookmark
+}
+
+func TestHistoryAfter(t *testing.T) {
+	h := newHistory(3)
+	var bookmarks []string
+	for i := 1; i <= 4; i++ {
+		bookmarks = append(bookmarks, bookmarkOf(t, h.Record(chat(fmt.Sprintf("message %d", i)))))
+	}
+
+	previous := formatBookmark(h.epoch-1, 100)
+	later := formatBookmark(h.epoch+1, 1)
+
+	tests := []struct {
+		name     string
+		bookmark string
+		want     []string
+	}{
+		{name: "latest", bookmark: bookmarks[3]},
+		{name: "recent", bookmark: bookmarks[1], want: []string{"message 3", "message 4"}},
+		{name: "evicted", bookmark: bookmarks[0], want: []string{"message 2", "message 3", "message 4"}},
+		{name: "previous epoch", bookmark: previous, want: []string{"message 2", "message 3", "message 4"}},
+		{name: "later epoch", bookmark: later},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			missed, err := h.After(test.bookmark)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := contents(t, missed); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	for _, bookmark := range []string{"", "100", "abc", "-1", "zz-", "0-1", "!-1", "1-2-3"} {
+		if _, err := h.After(bookmark); err == nil {
+			t.Errorf("accepted invalid bookmark %q", bookmark)
+		}
+	}
+}
+
+// TestHistoryBookmarksIncreaseAcrossRestarts verifies that a room service restarting starts its sequence numbers over
+// within a later epoch, so that a player's bookmark from before the restart is followed by every new message.
+func TestHistoryBookmarksIncreaseAcrossRestarts(t *testing.T) {
+	before := newHistory(10)
+	for i := 0; i < 5; i++ {
+		before.Record(chat("before"))
+	}
+	bookmark := bookmarkOf(t, before.Record(chat("last before restart")))
+
+	time.Sleep(time.Millisecond)
+	after := newHistory(10)
+	after.Record(chat("first after restart"))
+	after.Record(chat("second after restart"))
+
+	missed, err := after.After(bookmark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(t, missed), []string{"first after restart", "second after restart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHistorySince(t *testing.T) {
+	h := newHistory(10)
+	h.Record(chat("before"))
+	time.Sleep(time.Millisecond)
+	since := time.Now()
+	h.Record(chat("after"))
+
+	if got, want := contents(t, h.Since(since)), []string{"after"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// newTestRoom creates a room service keeping the given number of messages in its history.
+func newTestRoom(historySize int) *room {
+	return newRoom(&roomConfig{Version: "v1", HistorySize: historySize})
+}
+
+// post sends a request to one of the room's handlers, and returns the messages it responded with.
+func post(t *testing.T, handler http.HandlerFunc, body interface{}, header http.Header) []gameon.Message {
+	req := httptest.NewRequest("POST", "/room", strings.NewReader(string(jsonMarshal(body))))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+
+	var resp gameon.MessageCollection
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Messages
+}
+
+// say sends chat messages on behalf of bob.
+func say(t *testing.T, r *room, contents ...string) {
+	for _, content := range contents {
+		post(t, r.room, gameon.RoomCommand{UserInfo: gameon.UserInfo{UserID: "bob", Username: "bob"}, Content: content}, nil)
+	}
+}
+
+// chats returns the content of the chat messages, addressed to the given user.
+func chats(t *testing.T, messages []gameon.Message, userID string) []string {
+	var chats []string
+	for _, msg := range messages {
+		var chat gameon.Chat
+		if json.Unmarshal(msg.Payload, &chat) != nil || chat.Type != gameon.TypeChat {
+			continue
+		}
+		if msg.Recipient != userID {
+			t.Errorf("replayed message addressed to %q, want %q", msg.Recipient, userID)
+		}
+		chats = append(chats, chat.Content)
+	}
+	return chats
+}
+
+func TestHistoryCommand(t *testing.T) {
+	r := newTestRoom(10)
+	alice := gameon.UserInfo{UserID: "alice", Username: "alice"}
+
+	messages := post(t, r.room, gameon.RoomCommand{UserInfo: alice, Content: "/history"}, nil)
+	var event gameon.Event
+	json.Unmarshal(messages[0].Payload, &event)
+	if event.Content["alice"] != "Nothing was said here yet" {
+		t.Errorf("got %v, want to be told nothing was said", event.Content)
+	}
+
+	say(t, r, "one", "two", "three")
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{command: "/history 2", want: []string{"two", "three"}},
+		{command: "/history 10", want: []string{"one", "two", "three"}},
+		{command: "/history", want: []string{"one", "two", "three"}},
+	}
+	for _, test := range tests {
+		messages := post(t, r.room, gameon.RoomCommand{UserInfo: alice, Content: test.command}, nil)
+		if got := chats(t, messages, "alice"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.command, got, test.want)
+		}
+	}
+
+	messages = post(t, r.room, gameon.RoomCommand{UserInfo: alice, Content: "/history lots"}, nil)
+	json.Unmarshal(messages[0].Payload, &event)
+	if event.Content["alice"] != "How much history?" {
+		t.Errorf("got %v, want an invalid count rejected", event.Content)
+	}
+}
+
+func TestHelloRecovery(t *testing.T) {
+	r := newTestRoom(10)
+	alice := gameon.UserInfo{UserID: "alice", Username: "alice"}
+
+	welcome := post(t, r.hello, gameon.Hello{UserInfo: alice}, nil)
+	bookmark := ""
+	for _, msg := range welcome {
+		if msg.Recipient == "*" {
+			bookmark = gameon.PayloadBookmark(&msg)
+		}
+	}
+	if bookmark == "" {
+		t.Fatalf("welcome of %v wasn't bookmarked", welcome)
+	}
+
+	say(t, r, "while alice was away", "still away")
+
+	tests := []struct {
+		name   string
+		hello  gameon.Hello
+		header http.Header
+		want   []string
+	}{
+		{
+			name:  "bookmark",
+			hello: gameon.Hello{UserInfo: alice, Recovery: true, Bookmark: bookmark},
+			want:  []string{"while alice was away", "still away"},
+		},
+		{
+			name:   "bookmark over disconnection time",
+			hello:  gameon.Hello{UserInfo: alice, Recovery: true, Bookmark: bookmark},
+			header: http.Header{gameon.DisconnectedForHeader: []string{"0s"}},
+			want:   []string{"while alice was away", "still away"},
+		},
+		{
+			name:   "disconnection time",
+			hello:  gameon.Hello{UserInfo: alice, Recovery: true},
+			header: http.Header{gameon.DisconnectedForHeader: []string{"1m"}},
+			want:   []string{"while alice was away", "still away"},
+		},
+		{
+			name:   "just disconnected",
+			hello:  gameon.Hello{UserInfo: alice, Recovery: true},
+			header: http.Header{gameon.DisconnectedForHeader: []string{"0s"}},
+		},
+		{
+			name:   "invalid disconnection time",
+			hello:  gameon.Hello{UserInfo: alice, Recovery: true},
+			header: http.Header{gameon.DisconnectedForHeader: []string{"2016-01-01T00:00:00Z"}},
+		},
+		{
+			name:  "invalid bookmark",
+			hello: gameon.Hello{UserInfo: alice, Recovery: true, Bookmark: "soon"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := post(t, r.hello, test.hello, test.header)
+
+			var location gameon.Location
+			json.Unmarshal(messages[0].Payload, &location)
+			if location.Type != gameon.TypeLocation {
+				t.Errorf("got first message %s, want the location", messages[0].Payload)
+			}
+			if got := chats(t, messages, "alice"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			for _, msg := range messages {
+				if msg.Recipient == "*" {
+					t.Errorf("recovering player was welcomed again: %s", msg.Payload)
+				}
+			}
+		})
+	}
+}
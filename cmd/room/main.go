@@ -1,22 +1,111 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/fault"
 )
 
 func main() {
+	deregister := flag.Bool("deregister", false, "Delete the room registration from the map service, and exit")
+	cfg, loader := loadConfig()
+
+	mapClient := newMapClient(cfg)
+
+	if *deregister {
+		if mapClient == nil {
+			logrus.Fatalf("Map service is not configured")
+		}
+
+		err := deleteRegistration(mapClient)
+		if err != nil {
+			logrus.WithError(err).Fatalf("Error deleting room registration")
+		}
+		return
+	}
+
 	logrus.Infof("Starting room service")
 
-	room := newRoom()
+	if mapClient != nil {
+		err := syncRegistration(mapClient, cfg.RoomEndpoint)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error registering room with map service")
+		}
+	}
+
+	room := newRoom(cfg)
+	faults := fault.NewInjector()
+
+	handlers := map[string]http.HandlerFunc{
+		"/versions": room.versions,
+		"/hello":    room.hello,
+		"/goodbye":  room.goodbye,
+		"/room":     room.room,
+	}
+	for path, handler := range handlers {
+		http.HandleFunc(path, instrument(path, room.traced(path, faults.Handler(handler).ServeHTTP)))
+	}
+	http.Handle("/metrics", metricsRegistry.Handler())
+
+	checker := room.newHealthChecker(cfg.HealthTimeout)
+	http.Handle("/healthz", checker.LivenessHandler())
+	http.Handle("/readyz", checker.ReadinessHandler())
+
+	if cfg.AmbientInterval > 0 && room.pusher != nil {
+		go room.pushAmbientEvents(cfg.AmbientInterval)
+	}
 
-	http.HandleFunc("/hello", room.hello)
-	http.HandleFunc("/goodbye", room.goodbye)
-	http.HandleFunc("/room", room.room)
+	servers := []*http.Server{{Addr: cfg.Listen}}
 
-	err := http.ListenAndServe(":80", nil)
-	if err != nil {
-		logrus.WithError(err).Fatalf("Error running main")
+	if cfg.AdminToken != "" {
+		servers = append(servers, &http.Server{Addr: cfg.AdminAddr, Handler: newAdminHandler(cfg.AdminToken, room, faults)})
+	} else {
+		logrus.Warnf("No admin token configured, admin API is disabled")
 	}
+
+	for _, server := range servers {
+		go func(server *http.Server) {
+			err := server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logrus.WithError(err).Fatalf("Error running main")
+			}
+		}(server)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	sig := <-signals
+	for ; sig == syscall.SIGHUP; sig = <-signals {
+		logrus.Infof("Received %s, reloading configuration", sig)
+		reloadConfig(cfg, loader)
+	}
+
+	// The listener is closed right away, while requests in flight are allowed to complete
+	logrus.Infof("Received %s, shutting down room service", sig)
+	checker.Shutdown()
+
+	// Requests keep being served for a while, until probes notice the service isn't ready and route traffic elsewhere
+	if cfg.ShutdownDelay > 0 {
+		time.Sleep(cfg.ShutdownDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error waiting for requests in flight to complete on %s", server.Addr)
+		}
+	}
+
+	logrus.Infof("Room service stopped")
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elevran/chatter/pkg/metrics"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	requestDuration = metricsRegistry.NewHistogram("chatter_room_request_duration_seconds",
+		"Latency of requests handled by the room service, by path and status code.",
+		metrics.DefaultBuckets, "path", "status")
+
+	profanityRejections = metricsRegistry.NewCounter("chatter_room_profanity_rejections_total",
+		"Chat messages rejected by the profanity checker, by checker version.", "version")
+)
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument wraps a handler, recording the latency of each request it handles.
+func instrument(path string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+
+		handler(recorder, req)
+
+		requestDuration.Observe(time.Since(start).Seconds(), path, strconv.Itoa(recorder.status))
+	}
+}
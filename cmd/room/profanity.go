@@ -2,9 +2,7 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"regexp"
-	"strings"
 )
 
 type ProfanityChecker interface {
@@ -12,11 +10,9 @@ type ProfanityChecker interface {
 	Check(content string) bool
 }
 
-func newProfanityChecker() ProfanityChecker {
-	version := strings.ToLower(os.Getenv("VERSION"))
-
+func newProfanityChecker(version string) ProfanityChecker {
 	switch version {
-	case "", "v1":
+	case "v1":
 		return newDummyProfanityChecker()
 	case "v2":
 		return newRegexProfanityChecker()
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// pusher pushes messages to players through the mediator, outside of any response to a player request.
+// Pushed messages are signed using the secret shared between the room service and the mediator.
+type pusher struct {
+	httpClient *http.Client
+	pushURL    string
+	id         string
+	secret     string
+}
+
+// newPusher creates a pusher, or returns nil if no mediator push URL is configured.
+func newPusher(cfg *roomConfig) *pusher {
+	if cfg.PushURL == "" {
+		return nil
+	}
+
+	return &pusher{
+		httpClient: &http.Client{Timeout: cfg.PushTimeout},
+		pushURL:    cfg.PushURL,
+		id:         cfg.PushID,
+		secret:     cfg.PushSecret,
+	}
+}
+
+// Push sends the messages to the mediator, tracing the request as a child of the given span.
+func (p *pusher) Push(span *trace.Span, messages ...gameon.Message) error {
+	span = span.Child("push")
+	defer span.Finish()
+
+	body := jsonMarshal(gameon.MessageCollection{
+		Messages: messages,
+	})
+
+	req, err := http.NewRequest("POST", p.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	gameon.SignRequest(req, p.id, p.secret, body, time.Now())
+	span.Inject(req.Header)
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttribute("status", strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode/100 != 2 {
+		respBytes, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("push failed: %s: %s", resp.Status, string(respBytes))
+	}
+
+	return nil
+}
+
+// push sends messages to players through the mediator,
+// bookmarking the ones broadcast to the entire room and recording them in its history.
+func (r *room) push(span *trace.Span, messages ...gameon.Message) error {
+	if r.pusher == nil {
+		return fmt.Errorf("mediator push is not configured")
+	}
+
+	for i, msg := range messages {
+		if msg.Recipient == "*" {
+			messages[i] = r.history.Record(msg)
+		}
+	}
+
+	return r.pusher.Push(span, messages...)
+}
+
+// announcement is the request body accepted by the announce endpoint.
+type announcement struct {
+	// Recipient is the user ID to send the announcement to, or empty to send it to everyone in the room.
+	Recipient string `json:"recipient,omitempty"`
+	Content   string `json:"content"`
+}
+
+// announce lets other systems send an event to the players in the room.
+func (r *room) announce(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var a announcement
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&a)
+	if err != nil || a.Content == "" {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	recipient := a.Recipient
+	if recipient == "" {
+		recipient = "*"
+	}
+
+	err = r.push(trace.FromContext(req.Context()), gameon.Message{
+		Direction: gameon.DirectionPlayer,
+		Recipient: recipient,
+		Payload: jsonMarshal(gameon.Event{
+			Type: gameon.TypeEvent,
+			Content: map[string]string{
+				recipient: a.Content,
+			},
+		}),
+	})
+	if err != nil {
+		requestLog(req).WithError(err).Errorf("Error pushing announcement")
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// ambientEvents are pushed to everyone in the room in turn, to make it feel a little more alive.
+var ambientEvents = []string{
+	"Someone bursts out laughing in a far corner of the room",
+	"The lights flicker for a moment",
+	"A faint smell of coffee drifts through the room",
+	"A group by the wall suddenly goes quiet",
+}
+
+// pushAmbientEvents pushes an ambient event to everyone in the room every interval, and never returns.
+func (r *room) pushAmbientEvents(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; ; i = (i + 1) % len(ambientEvents) {
+		<-ticker.C
+
+		span := r.tracer.StartSpan("ambient", trace.SpanContext{})
+		err := r.push(span, gameon.Message{
+			Direction: gameon.DirectionPlayer,
+			Recipient: "*",
+			Payload: jsonMarshal(gameon.Event{
+				Type: gameon.TypeEvent,
+				Content: map[string]string{
+					"*": ambientEvents[i],
+				},
+			}),
+		})
+		if err != nil {
+			trace.Log(span).WithError(err).Errorf("Error pushing ambient event")
+		}
+		span.Finish()
+	}
+}
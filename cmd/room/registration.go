@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+)
+
+// newMapClient creates a GameOn! Map service client, or returns nil if no Map service is configured.
+func newMapClient(cfg *roomConfig) *gameon.MapClient {
+	if cfg.MapServiceURL == "" {
+		return nil
+	}
+
+	return gameon.NewMapClient(cfg.MapServiceURL, cfg.GameOnID, cfg.GameOnSecret)
+}
+
+// roomInfo describes the room as registered with the GameOn! Map service.
+func roomInfo(endpoint string) *gameon.RoomInfo {
+	doors := make(map[string]string, len(exits))
+	for exitID, description := range exits {
+		doors[strings.ToLower(exitID)] = description
+	}
+
+	return &gameon.RoomInfo{
+		Name:        roomName,
+		FullName:    roomFullName,
+		Description: roomDescription,
+		Doors:       doors,
+		ConnectionDetails: &gameon.ConnectionDetails{
+			Type:   "websocket",
+			Target: endpoint,
+		},
+	}
+}
+
+// syncRegistration registers the room with the Map service, or updates its registration if it has drifted.
+func syncRegistration(client *gameon.MapClient, endpoint string) error {
+	info := roomInfo(endpoint)
+	if info.ConnectionDetails.Target == "" {
+		return fmt.Errorf("room endpoint is not configured")
+	}
+
+	site, modified, err := client.Sync(info)
+	if err != nil {
+		return err
+	}
+
+	if modified {
+		logrus.Infof("Room registration synced with map service (site %s)", site.ID)
+	} else {
+		logrus.Infof("Room registration is up to date with map service (site %s)", site.ID)
+	}
+	return nil
+}
+
+// deleteRegistration removes all registrations of the room from the Map service.
+func deleteRegistration(client *gameon.MapClient) error {
+	sites, err := client.Find(roomName)
+	if err != nil {
+		return err
+	}
+
+	for _, site := range sites {
+		err := client.Delete(site.ID)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Room registration deleted from map service (site %s)", site.ID)
+	}
+	return nil
+}
@@ -4,9 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+const (
+	roomName        = "Chatter"
+	roomFullName    = "A chat room"
+	roomDescription = "a darkly lit room, there are people here, some are walking around, some are standing in groups"
 )
 
 var exits = map[string]string{
@@ -16,14 +25,51 @@ var exits = map[string]string{
 	"E": "A door surrounded by a mysterious glow along it edges",
 }
 
+var commands = map[string]string{
+	"/history": "Replay what was recently said in the room, e.g. /history 5",
+}
+
+// supportedVersions lists the GameOn! protocol versions this room can shape its payloads for.
+// Version 2 adds the exit description to player-location messages.
+var supportedVersions = []int{1, 2}
+
+// defaultHistoryCount is the number of messages replayed by a /history command with no explicit count.
+const defaultHistoryCount = 10
+
 type room struct {
 	profanityChecker ProfanityChecker
+	version          string
+	history          *history
+	pusher           *pusher
+	tracer           *trace.Tracer
 }
 
-func newRoom() *room {
+func newRoom(cfg *roomConfig) *room {
+	tracer, err := trace.NewServiceTracer("room", cfg.TraceExport)
+	if err != nil {
+		panic(fmt.Sprintf("error creating trace exporter: %v", err))
+	}
+
 	return &room{
-		profanityChecker: newProfanityChecker(),
+		profanityChecker: newProfanityChecker(cfg.Version),
+		version:          cfg.Version,
+		history:          newHistory(cfg.HistorySize),
+		pusher:           newPusher(cfg),
+		tracer:           tracer,
+	}
+}
+
+func (r *room) versions(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsonMarshal(gameon.Ack{
+		Version: supportedVersions,
+	}))
 }
 
 func (r *room) hello(resp http.ResponseWriter, req *http.Request) {
@@ -42,24 +88,35 @@ func (r *room) hello(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	location := gameon.Message{
-		Direction: "player",
+		Direction: gameon.DirectionPlayer,
 		Recipient: hello.UserID,
 		Payload: jsonMarshal(gameon.Location{
-			Type:        "location",
-			Name:        "Chatter",
-			FullName:    "A chat room",
-			Description: "a darkly lit room, there are people here, some are walking around, some are standing in groups",
+			Type:        gameon.TypeLocation,
+			Name:        roomName,
+			FullName:    roomFullName,
+			Description: roomDescription,
 			Exits:       exits,
-			Commands:    map[string]string{},
+			Commands:    commands,
 			Inventory:   []string{},
 		}),
 	}
 
+	// The player is caught up on the messages missed, either since a provided bookmark,
+	// or (when recovering without one) for as long as the player has been disconnected
+	messages := []gameon.Message{location}
+	messages = append(messages, r.missedMessages(hello, req)...)
+
+	// A recovering player was already welcomed, and only needs to catch up
+	if hello.Recovery {
+		r.respond(resp, messages...)
+		return
+	}
+
 	welcome := gameon.Message{
-		Direction: "player",
+		Direction: gameon.DirectionPlayer,
 		Recipient: "*",
 		Payload: jsonMarshal(gameon.Event{
-			Type: "event",
+			Type: gameon.TypeEvent,
 			Content: map[string]string{
 				hello.UserID: "Welcome!",
 				"*":          fmt.Sprintf("%s has just entered the room", hello.Username),
@@ -67,7 +124,26 @@ func (r *room) hello(resp http.ResponseWriter, req *http.Request) {
 		}),
 	}
 
-	writeResponseMessages(resp, location, welcome)
+	r.respond(resp, append(messages, welcome)...)
+}
+
+func (r *room) missedMessages(hello gameon.Hello, req *http.Request) []gameon.Message {
+	var missed []gameon.Message
+	if hello.Bookmark != "" {
+		var err error
+		missed, err = r.history.After(hello.Bookmark)
+		if err != nil {
+			return nil
+		}
+	} else if hello.Recovery {
+		disconnectedFor, err := time.ParseDuration(req.Header.Get(gameon.DisconnectedForHeader))
+		if err != nil || disconnectedFor < 0 {
+			return nil
+		}
+		missed = r.history.Since(time.Now().Add(-disconnectedFor))
+	}
+
+	return retarget(missed, hello.UserID)
 }
 
 func (r *room) goodbye(resp http.ResponseWriter, req *http.Request) {
@@ -86,10 +162,10 @@ func (r *room) goodbye(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	farewell := gameon.Message{
-		Direction: "player",
+		Direction: gameon.DirectionPlayer,
 		Recipient: "*",
 		Payload: jsonMarshal(gameon.Event{
-			Type: "event",
+			Type: gameon.TypeEvent,
 			Content: map[string]string{
 				goodbye.UserID: "Farewell!",
 				"*":            fmt.Sprintf("%s has left the room", goodbye.Username),
@@ -97,7 +173,7 @@ func (r *room) goodbye(resp http.ResponseWriter, req *http.Request) {
 		}),
 	}
 
-	writeResponseMessages(resp, farewell)
+	r.respond(resp, farewell)
 }
 
 func (r *room) room(resp http.ResponseWriter, req *http.Request) {
@@ -116,14 +192,14 @@ func (r *room) room(resp http.ResponseWriter, req *http.Request) {
 
 	if strings.HasPrefix(command.Content, "/") {
 		// slash command
-		r.handleSlash(command, resp)
+		r.handleSlash(command, requestVersion(req), resp)
 	} else {
 		// chat command
 		r.handleChat(command, resp)
 	}
 }
 
-func (r *room) handleSlash(command gameon.RoomCommand, resp http.ResponseWriter) {
+func (r *room) handleSlash(command gameon.RoomCommand, version int, resp http.ResponseWriter) {
 	words := strings.Fields(command.Content)
 	commandName := strings.ToLower(words[0])
 
@@ -141,16 +217,41 @@ func (r *room) handleSlash(command gameon.RoomCommand, resp http.ResponseWriter)
 			break
 		}
 
+		playerLocation := gameon.PlayerLocation{
+			Type:    gameon.TypeExit,
+			Content: "You frantically run towards the exit",
+			ExitID:  exitID,
+		}
+		if version >= 2 {
+			playerLocation.Exit = exits[exitID]
+		}
+
 		location := gameon.Message{
-			Direction: "playerLocation",
+			Direction: gameon.DirectionPlayerLocation,
 			Recipient: command.UserID,
-			Payload: jsonMarshal(gameon.PlayerLocation{
-				Type:    "exit",
-				Content: "You frantically run towards the exit",
-				ExitID:  exitID,
-			}),
+			Payload:   jsonMarshal(playerLocation),
+		}
+		r.respond(resp, location)
+		return
+
+	case "/history":
+		count := defaultHistoryCount
+		if len(words) > 1 {
+			n, err := strconv.Atoi(words[1])
+			if err != nil || n <= 0 {
+				eventContent = "How much history?"
+				break
+			}
+			count = n
+		}
+
+		replay := r.history.Last(count)
+		if len(replay) == 0 {
+			eventContent = "Nothing was said here yet"
+			break
 		}
-		writeResponseMessages(resp, location)
+
+		r.respond(resp, retarget(replay, command.UserID)...)
 		return
 
 	case "/examine":
@@ -164,16 +265,16 @@ func (r *room) handleSlash(command gameon.RoomCommand, resp http.ResponseWriter)
 	}
 
 	event := gameon.Message{
-		Direction: "player",
+		Direction: gameon.DirectionPlayer,
 		Recipient: command.UserID,
 		Payload: jsonMarshal(gameon.Event{
-			Type: "event",
+			Type: gameon.TypeEvent,
 			Content: map[string]string{
 				command.UserID: eventContent,
 			},
 		}),
 	}
-	writeResponseMessages(resp, event)
+	r.respond(resp, event)
 }
 
 func (r *room) handleChat(command gameon.RoomCommand, resp http.ResponseWriter) {
@@ -181,11 +282,12 @@ func (r *room) handleChat(command gameon.RoomCommand, resp http.ResponseWriter)
 
 	dirty := r.profanityChecker.Check(command.Content)
 	if dirty {
+		profanityRejections.Inc(r.version)
 		msg = gameon.Message{
-			Direction: "player",
+			Direction: gameon.DirectionPlayer,
 			Recipient: command.UserID,
 			Payload: jsonMarshal(gameon.Event{
-				Type: "event",
+				Type: gameon.TypeEvent,
 				Content: map[string]string{
 					command.UserID: "Pardon your french!",
 				},
@@ -193,17 +295,38 @@ func (r *room) handleChat(command gameon.RoomCommand, resp http.ResponseWriter)
 		}
 	} else {
 		msg = gameon.Message{
-			Direction: "player",
+			Direction: gameon.DirectionPlayer,
 			Recipient: "*",
 			Payload: jsonMarshal(gameon.Chat{
-				Type:     "chat",
+				Type:     gameon.TypeChat,
 				Username: command.Username,
 				Content:  command.Content,
 			}),
 		}
 	}
 
-	writeResponseMessages(resp, msg)
+	r.respond(resp, msg)
+}
+
+// respond writes the response messages, bookmarking the ones broadcast to the entire room and recording them in its history.
+func (r *room) respond(resp http.ResponseWriter, messages ...gameon.Message) {
+	for i, msg := range messages {
+		if msg.Recipient == "*" {
+			messages[i] = r.history.Record(msg)
+		}
+	}
+
+	writeResponseMessages(resp, messages...)
+}
+
+// retarget returns copies of the given messages, addressed to the given user only.
+func retarget(messages []gameon.Message, userID string) []gameon.Message {
+	retargeted := make([]gameon.Message, 0, len(messages))
+	for _, msg := range messages {
+		msg.Recipient = userID
+		retargeted = append(retargeted, msg)
+	}
+	return retargeted
 }
 
 func writeResponseMessages(resp http.ResponseWriter, messages ...gameon.Message) {
@@ -216,6 +339,16 @@ func writeResponseMessages(resp http.ResponseWriter, messages ...gameon.Message)
 	resp.Write(bytes)
 }
 
+// requestVersion returns the protocol version negotiated by the mediator for the requesting user,
+// defaulting to version 1 when none is provided.
+func requestVersion(req *http.Request) int {
+	version, err := strconv.Atoi(req.Header.Get(gameon.VersionHeader))
+	if err != nil || version <= 0 {
+		return 1
+	}
+	return version
+}
+
 func jsonMarshal(obj interface{}) []byte {
 	bytes, _ := json.Marshal(obj)
 	return bytes
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/elevran/chatter/pkg/gameon"
+	"github.com/elevran/chatter/pkg/trace"
+)
+
+// traced wraps a handler, continuing the trace propagated by the caller (or starting a new one) in a span for each request.
+// The span is available to the handler through the request's context.
+func (r *room) traced(path string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		parent, _ := trace.Extract(req.Header)
+		span := r.tracer.StartSpan(req.Method+" "+path, parent)
+		defer span.Finish()
+
+		if userID := req.Header.Get(gameon.UserIDHeader); userID != "" {
+			span.SetAttribute("userId", userID)
+		}
+
+		trace.Log(span).Debugf("Handling %s %s request", req.Method, path)
+		handler(resp, req.WithContext(trace.NewContext(req.Context(), span)))
+	}
+}
+
+// requestLog returns a logger tagging log lines with the trace of the request.
+func requestLog(req *http.Request) *logrus.Entry {
+	return trace.Log(trace.FromContext(req.Context()))
+}
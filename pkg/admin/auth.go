@@ -0,0 +1,36 @@
+// Package admin protects the services' administrative HTTP APIs, which are served on listeners of their own.
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const bearerScheme = "Bearer "
+
+// RequireToken wraps the handler of an admin API, rejecting requests that don't carry the token as a bearer token
+// in their Authorization header. Tokens are compared in constant time, so that they can't be guessed byte by byte.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasToken(r, token) {
+			logrus.WithField("remoteAddr", r.RemoteAddr).Warnf("Rejecting unauthenticated admin request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasToken(r *http.Request, token string) bool {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < len(bearerScheme) || !strings.EqualFold(authorization[:len(bearerScheme)], bearerScheme) {
+		return false
+	}
+
+	bearer := authorization[len(bearerScheme):]
+	return token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
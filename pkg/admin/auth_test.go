@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	handler := RequireToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{name: "bearer token", authorization: "Bearer s3cret", status: http.StatusNoContent},
+		{name: "case-insensitive scheme", authorization: "bearer s3cret", status: http.StatusNoContent},
+		{name: "raw token", authorization: "s3cret", status: http.StatusUnauthorized},
+		{name: "other scheme", authorization: "Basic s3cret", status: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer secret", status: http.StatusUnauthorized},
+		{name: "token prefix", authorization: "Bearer s3c", status: http.StatusUnauthorized},
+		{name: "empty token", authorization: "Bearer ", status: http.StatusUnauthorized},
+		{name: "no authorization", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/sessions", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestRequireTokenWithoutToken(t *testing.T) {
+	handler := RequireToken("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest("GET", "/sessions", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want requests rejected when no token is configured", w.Code)
+	}
+}
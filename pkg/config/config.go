@@ -0,0 +1,407 @@
+// Package config loads service configuration into a struct, from a configuration file,
+// environment variables and command-line flags.
+//
+// Each setting is an exported struct field, described by tags:
+//
+//	key      the setting's key in the configuration file (nested sections separated by dots), and its flag name
+//	env      the environment variable setting it (optional)
+//	default  its default value (optional)
+//	usage    its description, shown in the flags usage
+//	options  a comma separated list of allowed values (optional), matched case-insensitively
+//	min      its minimal value, for numbers and durations (optional)
+//	secret   set to "true" to mask its value when dumped
+//	reload   set to "true" if it can be changed without restarting the service
+//
+// Supported field types are string, bool, int, int64, float64 and time.Duration.
+// Sources are applied in increasing order of precedence: defaults, the configuration file, environment variables, flags.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileEnv is the environment variable naming the configuration file, unless set by the -config flag.
+const FileEnv = "CONFIG_FILE"
+
+// Validator is implemented by configuration structs with constraints spanning several settings.
+// It is called once all settings are loaded.
+type Validator interface {
+	Validate() error
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting describes a single configuration struct field.
+type setting struct {
+	index    int
+	key      string
+	env      string
+	def      string
+	usage    string
+	options  []string
+	min      string
+	secret   bool
+	reload   bool
+	flag     *flagValue
+	typeName string
+}
+
+// flagValue records the value of a setting's flag, if set on the command line.
+type flagValue struct {
+	value string
+	set   bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *flagValue) Set(value string) error {
+	f.value = value
+	f.set = true
+	return nil
+}
+
+// Loader loads configuration structs of a given type.
+type Loader struct {
+	structType reflect.Type
+	settings   []*setting
+	file       flagValue
+}
+
+// NewLoader creates a loader for configuration structs of the type pointed to by cfg.
+func NewLoader(cfg interface{}) (*Loader, error) {
+	t := reflect.TypeOf(cfg)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("configuration must be a pointer to a struct, got %T", cfg)
+	}
+	t = t.Elem()
+
+	l := &Loader{structType: t}
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("key")
+		if key == "" {
+			continue
+		}
+		if keys[key] {
+			return nil, fmt.Errorf("duplicate configuration key %s", key)
+		}
+		keys[key] = true
+
+		s := &setting{
+			index:  i,
+			key:    key,
+			env:    field.Tag.Get("env"),
+			def:    field.Tag.Get("default"),
+			usage:  field.Tag.Get("usage"),
+			min:    field.Tag.Get("min"),
+			secret: field.Tag.Get("secret") == "true",
+			reload: field.Tag.Get("reload") == "true",
+			flag:   &flagValue{},
+		}
+		if options := field.Tag.Get("options"); options != "" {
+			s.options = strings.Split(options, ",")
+		}
+
+		switch {
+		case field.Type == durationType:
+			s.typeName = "duration"
+		case field.Type.Kind() == reflect.String, field.Type.Kind() == reflect.Bool,
+			field.Type.Kind() == reflect.Int, field.Type.Kind() == reflect.Int64, field.Type.Kind() == reflect.Float64:
+			s.typeName = field.Type.Kind().String()
+		default:
+			return nil, fmt.Errorf("unsupported type %s for configuration key %s", field.Type, key)
+		}
+
+		// Defaults are validated up front, so that an invalid one is caught regardless of the sources in use
+		if err := s.set(reflect.New(t).Elem().Field(i), s.def); s.def != "" && err != nil {
+			return nil, fmt.Errorf("invalid default for configuration key %s: %v", key, err)
+		}
+
+		l.settings = append(l.settings, s)
+	}
+
+	return l, nil
+}
+
+// RegisterFlags defines the -config flag naming the configuration file, and a flag for every setting.
+func (l *Loader) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(&l.file, "config", fmt.Sprintf("Configuration file (JSON or YAML), also set by %s", FileEnv))
+
+	for _, s := range l.settings {
+		usage := s.usage
+		if s.env != "" {
+			usage = fmt.Sprintf("%s (%s)", usage, s.env)
+		}
+		if len(s.options) > 0 {
+			usage = fmt.Sprintf("%s, one of: %s", usage, strings.Join(s.options, ", "))
+		}
+		if s.def != "" {
+			usage = fmt.Sprintf("%s (default %q)", usage, s.def)
+		}
+		fs.Var(s.flag, s.key, usage)
+	}
+}
+
+// Load loads the configuration into cfg, which must point to a struct of the loader's type.
+// It can be called again (e.g., on SIGHUP) to reload the configuration file and environment variables,
+// while flags keep the values set on the command line.
+func (l *Loader) Load(cfg interface{}) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Type() != l.structType {
+		return fmt.Errorf("configuration must be a *%s, got %T", l.structType, cfg)
+	}
+	v = v.Elem()
+
+	var fileValues map[string]string
+	filename := l.file.value
+	if !l.file.set {
+		filename = os.Getenv(FileEnv)
+	}
+	if filename != "" {
+		var err error
+		fileValues, err = readFile(filename)
+		if err != nil {
+			return err
+		}
+
+		for key := range fileValues {
+			if l.lookup(key) == nil {
+				return fmt.Errorf("invalid configuration file %s: unknown key %s", filename, key)
+			}
+		}
+	}
+
+	for _, s := range l.settings {
+		value, source := s.def, "default"
+		if fileValue, ok := fileValues[s.key]; ok {
+			value, source = fileValue, "file "+filename
+		}
+		if envValue := os.Getenv(s.env); s.env != "" && envValue != "" {
+			value, source = envValue, "environment variable "+s.env
+		}
+		if s.flag.set {
+			value, source = s.flag.value, "flag -"+s.key
+		}
+
+		err := s.set(v.Field(s.index), value)
+		if err != nil {
+			return fmt.Errorf("invalid %s (from %s): %v", s.key, source, err)
+		}
+	}
+
+	if validator, ok := cfg.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+func (l *Loader) lookup(key string) *setting {
+	for _, s := range l.settings {
+		if s.key == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// Dump returns the values of the settings in cfg keyed by their configuration key, with secret values masked.
+func (l *Loader) Dump(cfg interface{}) map[string]interface{} {
+	v := reflect.Indirect(reflect.ValueOf(cfg))
+
+	values := make(map[string]interface{}, len(l.settings))
+	for _, s := range l.settings {
+		field := v.Field(s.index)
+		switch {
+		case s.secret && !field.IsZero():
+			values[s.key] = "********"
+		case field.Type() == durationType:
+			values[s.key] = field.Interface().(time.Duration).String()
+		default:
+			values[s.key] = field.Interface()
+		}
+	}
+
+	return values
+}
+
+// Apply updates current with the reloadable settings that differ in next, both configurations of the loader's type.
+// It returns the keys of the settings updated, and of the ones that differ but require a restart to take effect.
+func (l *Loader) Apply(current, next interface{}) (applied, ignored []string) {
+	currentValue := reflect.Indirect(reflect.ValueOf(current))
+	nextValue := reflect.Indirect(reflect.ValueOf(next))
+
+	for _, s := range l.settings {
+		currentField, nextField := currentValue.Field(s.index), nextValue.Field(s.index)
+		if currentField.Interface() == nextField.Interface() {
+			continue
+		}
+
+		if s.reload {
+			currentField.Set(nextField)
+			applied = append(applied, s.key)
+		} else {
+			ignored = append(ignored, s.key)
+		}
+	}
+
+	return applied, ignored
+}
+
+// set parses value into the field, and validates it against the setting's constraints.
+func (s *setting) set(field reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+
+	if len(s.options) > 0 && value != "" {
+		valid := false
+		for _, option := range s.options {
+			if strings.EqualFold(value, option) {
+				value, valid = option, true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%q is not one of: %s", value, strings.Join(s.options, ", "))
+		}
+	}
+
+	switch s.typeName {
+	case "string":
+		field.SetString(value)
+		return nil
+
+	case "bool":
+		if value == "" {
+			field.SetBool(false)
+			return nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		field.SetBool(b)
+		return nil
+
+	case "duration":
+		var d time.Duration
+		if value != "" {
+			var err error
+			d, err = time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%q is not a duration", value)
+			}
+		}
+		if s.min != "" {
+			min, _ := time.ParseDuration(s.min)
+			if d < min {
+				return fmt.Errorf("%s is less than %s", d, min)
+			}
+		}
+		field.SetInt(int64(d))
+		return nil
+
+	case "int", "int64":
+		var n int64
+		if value != "" {
+			var err error
+			n, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not an integer", value)
+			}
+		}
+		if s.min != "" {
+			min, _ := strconv.ParseInt(s.min, 10, 64)
+			if n < min {
+				return fmt.Errorf("%d is less than %d", n, min)
+			}
+		}
+		field.SetInt(n)
+		return nil
+
+	case "float64":
+		var f float64
+		if value != "" {
+			var err error
+			f, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not a number", value)
+			}
+		}
+		if s.min != "" {
+			min, _ := strconv.ParseFloat(s.min, 64)
+			if f < min {
+				return fmt.Errorf("%g is less than %g", f, min)
+			}
+		}
+		field.SetFloat(f)
+		return nil
+	}
+
+	return fmt.Errorf("unsupported type %s", s.typeName)
+}
+
+// readFile reads a JSON (.json) or YAML configuration file, flattening nested sections into dotted keys.
+func readFile(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree map[string]interface{}
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(data, &tree)
+	} else {
+		tree, err = parseYAML(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", filename, err)
+	}
+
+	values := make(map[string]string)
+	err = flatten("", tree, values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", filename, err)
+	}
+	return values, nil
+}
+
+func flatten(prefix string, tree map[string]interface{}, values map[string]string) error {
+	for name, value := range tree {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := flatten(key, value, values); err != nil {
+				return err
+			}
+		case string:
+			values[key] = value
+		case bool:
+			values[key] = strconv.FormatBool(value)
+		case float64:
+			values[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		case nil:
+			values[key] = ""
+		default:
+			return fmt.Errorf("unsupported value for key %s: %v", key, value)
+		}
+	}
+	return nil
+}
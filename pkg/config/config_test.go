@@ -0,0 +1,296 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Listen   string        `key:"listen" env:"TEST_LISTEN" default:":80" usage:"Address"`
+	LogLevel string        `key:"log.level" env:"TEST_LOG_LEVEL" default:"info" options:"debug,info,warning" reload:"true" usage:"Log level"`
+	Timeout  time.Duration `key:"room.timeout" env:"TEST_ROOM_TIMEOUT" default:"5s" min:"1ms" usage:"Timeout"`
+	Retries  int           `key:"room.retries" env:"TEST_ROOM_RETRIES" default:"2" min:"0" reload:"true" usage:"Retries"`
+	Ratio    float64       `key:"ratio" usage:"Ratio"`
+	Enabled  bool          `key:"enabled" env:"TEST_ENABLED" usage:"Enabled"`
+	Secret   string        `key:"secret" env:"TEST_SECRET" secret:"true" usage:"Secret"`
+
+	// Fields with no key aren't settings
+	Derived string
+}
+
+// newTestLoader creates a loader for testConfig, with its flags parsed from args.
+func newTestLoader(t *testing.T, args ...string) *Loader {
+	loader, err := NewLoader(new(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader.RegisterFlags(fs)
+	err = fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loader
+}
+
+// writeFile writes a configuration file in a temporary directory, returning its path.
+func writeFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, name)
+	err = ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// setenv sets environment variables for the duration of a test, returning a function restoring them.
+func setenv(vars map[string]string) func() {
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	filename := writeFile(t, "config.yaml", "listen: :1000\nlog:\n  level: debug\nroom:\n  timeout: 1s\n  retries: 7\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	defer setenv(map[string]string{
+		"TEST_ROOM_TIMEOUT": "2s",
+		"TEST_ROOM_RETRIES": "8",
+		"TEST_LOG_LEVEL":    "",
+	})()
+
+	loader := newTestLoader(t, "-config", filename, "-room.retries", "9")
+
+	var cfg testConfig
+	err := loader.Load(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := testConfig{
+		Listen:   ":1000",         // file over default
+		LogLevel: "debug",         // file, since an empty environment variable is ignored
+		Timeout:  2 * time.Second, // environment variable over file
+		Retries:  9,               // flag over environment variable
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadFileFromEnvironment(t *testing.T) {
+	filename := writeFile(t, "config.json", `{"listen": ":2000", "room": {"retries": 3}, "ratio": 0.5, "enabled": true}`)
+	defer os.RemoveAll(filepath.Dir(filename))
+	defer setenv(map[string]string{FileEnv: filename})()
+
+	var cfg testConfig
+	err := newTestLoader(t).Load(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":2000" || cfg.Retries != 3 || cfg.Ratio != 0.5 || !cfg.Enabled {
+		t.Errorf("got %+v, want the values of %s", cfg, filename)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	var cfg testConfig
+	err := newTestLoader(t).Load(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := testConfig{Listen: ":80", LogLevel: "info", Timeout: 5 * time.Second, Retries: 2}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{name: "unknown key", file: "room:\n  timeot: 1s\n", err: "unknown key room.timeot"},
+		{name: "invalid option", args: []string{"-log.level", "verbose"}, err: `invalid log.level (from flag -log.level): "verbose" is not one of`},
+		{name: "below minimum", env: map[string]string{"TEST_ROOM_TIMEOUT": "0s"}, err: "invalid room.timeout (from environment variable TEST_ROOM_TIMEOUT): 0s is less than 1ms"},
+		{name: "negative integer", file: "room:\n  retries: -1\n", err: "invalid room.retries (from file"},
+		{name: "not an integer", env: map[string]string{"TEST_ROOM_RETRIES": "many"}, err: `"many" is not an integer`},
+		{name: "not a duration", args: []string{"-room.timeout", "5"}, err: `"5" is not a duration`},
+		{name: "not a boolean", env: map[string]string{"TEST_ENABLED": "maybe"}, err: `"maybe" is not a boolean`},
+		{name: "invalid yaml", file: "room:\n\ttimeout: 1s\n", err: "tabs are not allowed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setenv(test.env)()
+
+			args := test.args
+			if test.file != "" {
+				filename := writeFile(t, "config.yaml", test.file)
+				defer os.RemoveAll(filepath.Dir(filename))
+				args = append([]string{"-config", filename}, args...)
+			}
+
+			var cfg testConfig
+			err := newTestLoader(t, args...).Load(&cfg)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLoadMatchesOptionsCaseInsensitively(t *testing.T) {
+	var cfg testConfig
+	err := newTestLoader(t, "-log.level", "WARNING").Load(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != "warning" {
+		t.Errorf("got log level %q, want the option's spelling", cfg.LogLevel)
+	}
+}
+
+type validatedConfig struct {
+	Min int `key:"min" default:"1"`
+	Max int `key:"max" default:"10"`
+}
+
+func (c *validatedConfig) Validate() error {
+	if c.Max < c.Min {
+		return errors.New("max is less than min")
+	}
+	return nil
+}
+
+func TestLoadValidates(t *testing.T) {
+	loader, err := NewLoader(new(validatedConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader.RegisterFlags(fs)
+	fs.Parse([]string{"-max", "0"})
+
+	err = loader.Load(new(validatedConfig))
+	if err == nil || err.Error() != "max is less than min" {
+		t.Errorf("got error %v, want the validator's", err)
+	}
+}
+
+func TestNewLoaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  interface{}
+		err  string
+	}{
+		{name: "not a pointer", cfg: testConfig{}, err: "must be a pointer to a struct"},
+		{name: "unsupported type", cfg: &struct {
+			Hosts []string `key:"hosts"`
+		}{}, err: "unsupported type []string"},
+		{name: "duplicate key", cfg: &struct {
+			A string `key:"a"`
+			B string `key:"a"`
+		}{}, err: "duplicate configuration key a"},
+		{name: "invalid default", cfg: &struct {
+			Timeout time.Duration `key:"timeout" default:"soon"`
+		}{}, err: "invalid default for configuration key timeout"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewLoader(test.cfg)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	filename := writeFile(t, "config.yaml", "listen: :1000\nroom:\n  retries: 1\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	loader := newTestLoader(t, "-config", filename)
+	cfg := new(testConfig)
+	err := loader.Load(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filename, []byte("listen: :2000\nlog:\n  level: debug\nroom:\n  retries: 4\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, applied, err := loader.Reload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated := next.(*testConfig)
+	if updated.LogLevel != "debug" || updated.Retries != 4 {
+		t.Errorf("reloadable settings weren't applied: %+v", updated)
+	}
+	if updated.Listen != ":1000" {
+		t.Errorf("got listen %q, want it unchanged until restart", updated.Listen)
+	}
+	sort.Strings(applied)
+	if want := []string{"log.level", "room.retries"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("got applied keys %v, want %v", applied, want)
+	}
+	if cfg.Retries != 1 || cfg.LogLevel != "info" {
+		t.Errorf("reload modified the current configuration: %+v", cfg)
+	}
+
+	err = ioutil.WriteFile(filename, []byte("room:\n  retries: -1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loader.Reload(cfg); err == nil {
+		t.Errorf("reloading an invalid configuration succeeded")
+	}
+}
+
+func TestDumpMasksSecrets(t *testing.T) {
+	loader := newTestLoader(t)
+	cfg := &testConfig{Listen: ":80", Timeout: time.Second, Secret: "hunter2"}
+
+	values := loader.Dump(cfg)
+	if values["secret"] != "********" {
+		t.Errorf("got secret %v, want it masked", values["secret"])
+	}
+	if values["room.timeout"] != "1s" || values["listen"] != ":80" {
+		t.Errorf("got values %v", values)
+	}
+
+	cfg.Secret = ""
+	if values := loader.Dump(cfg); values["secret"] != "" {
+		t.Errorf("got unset secret %v, want it empty", values["secret"])
+	}
+}
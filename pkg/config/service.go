@@ -0,0 +1,76 @@
+package config
+
+import (
+	"flag"
+	"reflect"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// LogLevelKey is the key of the setting holding the service's log level, applied whenever the configuration is loaded.
+const LogLevelKey = "log.level"
+
+// MustLoad loads the configuration struct pointed to by cfg, exiting if it is invalid.
+// It registers the settings' flags on the command line, and parses it along with the flags defined beforehand.
+// The returned loader reloads the configuration, e.g., on SIGHUP.
+func MustLoad(cfg interface{}) *Loader {
+	loader, err := NewLoader(cfg)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Error creating configuration loader")
+	}
+
+	loader.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	err = loader.Load(cfg)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Invalid configuration")
+	}
+
+	loader.applyLogLevel(cfg)
+	logrus.WithFields(loader.Dump(cfg)).Debugf("Effective configuration")
+
+	return loader
+}
+
+// Reload loads the configuration again, and returns a copy of cfg updated with the reloadable settings that changed,
+// along with their keys. cfg is left unchanged, so that the caller can put the copy in use once it is fully applied.
+// Changes to other settings are logged, as they require a restart to take effect.
+func (l *Loader) Reload(cfg interface{}) (interface{}, []string, error) {
+	next := reflect.New(l.structType)
+	err := l.Load(next.Interface())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	updated := reflect.New(l.structType)
+	updated.Elem().Set(reflect.Indirect(reflect.ValueOf(cfg)))
+
+	applied, ignored := l.Apply(updated.Interface(), next.Interface())
+	if len(ignored) > 0 {
+		logrus.WithField("keys", ignored).Warnf("Configuration changes require a restart to take effect")
+	}
+
+	return updated.Interface(), applied, nil
+}
+
+// Reloaded applies the log level of a reloaded configuration once it is put in use, and logs the settings changed.
+func (l *Loader) Reloaded(cfg interface{}, applied []string) {
+	l.applyLogLevel(cfg)
+
+	logrus.WithField("changed", applied).Infof("Configuration reloaded")
+	logrus.WithFields(l.Dump(cfg)).Debugf("Effective configuration")
+}
+
+func (l *Loader) applyLogLevel(cfg interface{}) {
+	s := l.lookup(LogLevelKey)
+	if s == nil {
+		return
+	}
+
+	level, err := logrus.ParseLevel(reflect.Indirect(reflect.ValueOf(cfg)).Field(s.index).String())
+	if err != nil {
+		return
+	}
+	logrus.SetLevel(level)
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used by configuration files: nested mappings of scalar values, e.g.:
+//
+//	log:
+//	  level: info   # comments are allowed
+//	room:
+//	  timeout: 5s
+//	  url: "http://localhost:6379/room"
+//
+// Scalars are returned as strings, and sequences, anchors and multi-line values are not supported.
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+
+	// stack holds the mappings enclosing the current line, along with their indentation
+	type level struct {
+		indent  int
+		mapping map[string]interface{}
+	}
+	stack := []level{{indent: -1, mapping: root}}
+
+	// pending is set by a key with no value, which opens a nested mapping if the next line is indented further
+	var pendingKey string
+	var pendingParent map[string]interface{}
+	pendingIndent := -1
+
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNo := i + 1
+
+		line = strings.TrimRight(stripComment(line), " \t\r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+		}
+		if strings.HasPrefix(content, "- ") || content == "-" {
+			return nil, fmt.Errorf("line %d: sequences are not supported", lineNo)
+		}
+		indent := len(line) - len(content)
+
+		if pendingParent != nil {
+			if indent > pendingIndent {
+				nested := make(map[string]interface{})
+				pendingParent[pendingKey] = nested
+				stack = append(stack, level{indent: indent, mapping: nested})
+			} else {
+				pendingParent[pendingKey] = nil
+			}
+			pendingParent = nil
+		}
+
+		for len(stack) > 1 && indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		current := stack[len(stack)-1]
+		if indent != current.indent && current.indent != -1 {
+			return nil, fmt.Errorf("line %d: unexpected indentation", lineNo)
+		}
+		if current.indent == -1 {
+			stack[len(stack)-1].indent = indent
+		}
+
+		colon := strings.Index(content, ":")
+		if colon <= 0 || (colon+1 < len(content) && content[colon+1] != ' ') {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+
+		key, err := unquote(strings.TrimSpace(content[:colon]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if _, ok := current.mapping[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", lineNo, key)
+		}
+
+		value := strings.TrimSpace(content[colon+1:])
+		if value == "" {
+			pendingKey, pendingParent, pendingIndent = key, current.mapping, indent
+			continue
+		}
+
+		current.mapping[key], err = unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+
+	if pendingParent != nil {
+		pendingParent[pendingKey] = nil
+	}
+
+	return root, nil
+}
+
+// stripComment removes a trailing comment from the line, ignoring # characters within quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote returns the value of a plain, single-quoted or double-quoted scalar.
+func unquote(value string) (string, error) {
+	switch {
+	case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+		return strconv.Unquote(value)
+	case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	case strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'"):
+		return "", fmt.Errorf("unterminated quoted value: %s", value)
+	case value == "~" || value == "null":
+		return "", nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]interface{}
+	}{
+		{
+			name: "flat",
+			yaml: "listen: :3000\nversion: v2\n",
+			want: map[string]interface{}{"listen": ":3000", "version": "v2"},
+		},
+		{
+			name: "nested",
+			yaml: "log:\n  level: info\nroom:\n  timeout: 5s\n  breaker:\n    threshold: 5\nlisten: :80\n",
+			want: map[string]interface{}{
+				"log":    map[string]interface{}{"level": "info"},
+				"room":   map[string]interface{}{"timeout": "5s", "breaker": map[string]interface{}{"threshold": "5"}},
+				"listen": ":80",
+			},
+		},
+		{
+			name: "comments and blank lines",
+			yaml: "---\n# leading comment\n\nlog:   # section comment\n  level: debug # trailing comment\n\n  # indented comment\n",
+			want: map[string]interface{}{"log": map[string]interface{}{"level": "debug"}},
+		},
+		{
+			name: "quoted values",
+			yaml: "a: \"http://host/#anchor\"\nb: 'it''s # not a comment'\nc: \"tab\\there\"\n\"d e\": plain value\n",
+			want: map[string]interface{}{"a": "http://host/#anchor", "b": "it's # not a comment", "c": "tab\there", "d e": "plain value"},
+		},
+		{
+			name: "null and empty values",
+			yaml: "a: ~\nb: null\nc:\nd: ''\n",
+			want: map[string]interface{}{"a": "", "b": "", "c": nil, "d": ""},
+		},
+		{
+			name: "empty section followed by a sibling",
+			yaml: "push:\nlisten: :80\n",
+			want: map[string]interface{}{"push": nil, "listen": ":80"},
+		},
+		{
+			name: "windows line endings",
+			yaml: "log:\r\n  level: warning\r\n",
+			want: map[string]interface{}{"log": map[string]interface{}{"level": "warning"}},
+		},
+		{
+			name: "colon within value",
+			yaml: "url: http://localhost:6379/room\n",
+			want: map[string]interface{}{"url": "http://localhost:6379/room"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(test.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{name: "tab indentation", yaml: "log:\n\tlevel: info\n", err: "line 2: tabs are not allowed"},
+		{name: "sequence", yaml: "hosts:\n  - a\n", err: "line 2: sequences are not supported"},
+		{name: "unexpected indentation", yaml: "log:\n    level: info\n  file: x\n", err: "line 3: unexpected indentation"},
+		{name: "over-indented sibling", yaml: "a: 1\n  b: 2\n", err: "line 2: unexpected indentation"},
+		{name: "missing colon", yaml: "listen :80\n", err: "line 1: expected \"key: value\""},
+		{name: "missing space after colon", yaml: "listen::80\n", err: "line 1: expected \"key: value\""},
+		{name: "duplicate key", yaml: "log:\n  level: info\n  level: debug\n", err: "line 3: duplicate key level"},
+		{name: "unterminated quote", yaml: "a: \"open\n", err: "line 1: unterminated quoted value"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(test.yaml))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+// Package fault injects faults into HTTP requests, on either the server or the client side, according to rules
+// managed at runtime. Faults are delays (fixed or random), aborts with a given status, and malformed response bodies.
+package fault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elevran/chatter/pkg/gameon"
+)
+
+// Rule describes the faults injected into matching requests.
+// A request matches if it meets all of the rule's conditions, and only the first matching rule applies.
+type Rule struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled,omitempty"`
+
+	// Path matches requests whose path ends with it (e.g., /hello), regardless of the service's base path.
+	Path string `json:"path,omitempty"`
+	// UserID matches requests made on behalf of the user, identified by the X-Game-On-UserID header.
+	UserID string `json:"userId,omitempty"`
+	// Percentage of the requests meeting the other conditions that match, from 0 (none) to 100 (all requests if omitted).
+	Percentage *float64 `json:"percentage,omitempty"`
+
+	// Delay delays matching requests, by a random duration up to MaxDelay if set (e.g., "100ms").
+	Delay    string `json:"delay,omitempty"`
+	MaxDelay string `json:"maxDelay,omitempty"`
+	// Abort fails matching requests with the given HTTP status code, without handling them.
+	Abort int `json:"abort,omitempty"`
+	// Malformed truncates the response body of matching requests, so that it can't be decoded.
+	Malformed bool `json:"malformed,omitempty"`
+
+	// Injected counts the requests the rule matched. It is reported by the admin handler, and ignored when set.
+	Injected int64 `json:"injected"`
+}
+
+type rule struct {
+	Rule
+	delay    time.Duration
+	maxDelay time.Duration
+	injected int64
+}
+
+// newRule validates the rule, and parses its delays.
+func newRule(r Rule) (*rule, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("rule has no name")
+	}
+	if r.Percentage != nil && (*r.Percentage < 0 || *r.Percentage > 100) {
+		return nil, fmt.Errorf("rule %s: percentage must be between 0 and 100", r.Name)
+	}
+	if r.Abort != 0 && (r.Abort < 100 || r.Abort > 599) {
+		return nil, fmt.Errorf("rule %s: invalid abort status %d", r.Name, r.Abort)
+	}
+	if r.Abort != 0 && r.Malformed {
+		return nil, fmt.Errorf("rule %s: aborted requests have no response body to malform", r.Name)
+	}
+
+	parsed := &rule{Rule: r}
+	if r.Delay != "" {
+		var err error
+		parsed.delay, err = time.ParseDuration(r.Delay)
+		if err != nil || parsed.delay < 0 {
+			return nil, fmt.Errorf("rule %s: invalid delay %q", r.Name, r.Delay)
+		}
+	}
+	if r.MaxDelay != "" {
+		var err error
+		parsed.maxDelay, err = time.ParseDuration(r.MaxDelay)
+		if err != nil || parsed.maxDelay < parsed.delay {
+			return nil, fmt.Errorf("rule %s: invalid max delay %q", r.Name, r.MaxDelay)
+		}
+	}
+	if parsed.delay == 0 && parsed.maxDelay == 0 && r.Abort == 0 && !r.Malformed {
+		return nil, fmt.Errorf("rule %s injects no fault", r.Name)
+	}
+
+	return parsed, nil
+}
+
+func (r *rule) matches(path, userID string) bool {
+	if r.Disabled {
+		return false
+	}
+	if r.Path != "" && !strings.HasSuffix(path, r.Path) {
+		return false
+	}
+	if r.UserID != "" && r.UserID != userID {
+		return false
+	}
+	return r.Percentage == nil || rand.Float64()*100 < *r.Percentage
+}
+
+// wait sleeps for the rule's delay, or until done is closed.
+func (r *rule) wait(done <-chan struct{}) {
+	d := r.delay
+	if r.maxDelay > r.delay {
+		d += time.Duration(rand.Int63n(int64(r.maxDelay - r.delay)))
+	}
+	if d == 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-done:
+	}
+}
+
+// Injector injects faults according to a set of rules, which can be replaced at any time.
+type Injector struct {
+	rules []*rule
+	mutex sync.RWMutex
+}
+
+// NewInjector creates an injector with no rules.
+func NewInjector() *Injector {
+	return &Injector{}
+}
+
+// Rules returns the current rules, along with the number of requests each matched.
+func (i *Injector) Rules() []Rule {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	rules := make([]Rule, 0, len(i.rules))
+	for _, r := range i.rules {
+		rule := r.Rule
+		rule.Injected = atomic.LoadInt64(&r.injected)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// SetRules replaces the current rules, or returns an error, leaving them unchanged, if any of the rules is invalid.
+func (i *Injector) SetRules(rules []Rule) error {
+	parsed := make([]*rule, 0, len(rules))
+	names := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if names[r.Name] {
+			return fmt.Errorf("duplicate rule %s", r.Name)
+		}
+		names[r.Name] = true
+
+		p, err := newRule(r)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, p)
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.rules = parsed
+	return nil
+}
+
+// SetDisabled disables or re-enables the named rule, returning false if there is no such rule.
+func (i *Injector) SetDisabled(name string, disabled bool) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for _, r := range i.rules {
+		if r.Name == name {
+			r.Disabled = disabled
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the first rule matching the request, counting it as injected, or nil if none does.
+func (i *Injector) match(path, userID string) *rule {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	for _, r := range i.rules {
+		if r.matches(path, userID) {
+			atomic.AddInt64(&r.injected, 1)
+			return r
+		}
+	}
+	return nil
+}
+
+// Handler wraps a server-side handler, injecting faults into the requests it handles.
+func (i *Injector) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := i.match(req.URL.Path, req.Header.Get(gameon.UserIDHeader))
+		if r == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		r.wait(req.Context().Done())
+
+		if r.Abort != 0 {
+			http.Error(w, fmt.Sprintf("fault injected by rule %s", r.Name), r.Abort)
+			return
+		}
+
+		if !r.Malformed {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		recorder := &bufferedResponse{header: w.Header(), statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		body := malform(recorder.body.Bytes())
+		w.Header().Del("Content-Length")
+		w.WriteHeader(recorder.statusCode)
+		w.Write(body)
+	})
+}
+
+// bufferedResponse holds a response until a fault is injected into its body.
+type bufferedResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(statusCode int) {
+	b.statusCode = statusCode
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+// RoundTripper wraps a client-side transport, injecting faults into the requests it sends.
+// Aborted requests are not sent, and get a response with the rule's status code instead.
+func (i *Injector) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		r := i.match(req.URL.Path, req.Header.Get(gameon.UserIDHeader))
+		if r == nil {
+			return next.RoundTrip(req)
+		}
+
+		r.wait(req.Context().Done())
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+
+		if r.Abort != 0 {
+			body := fmt.Sprintf("fault injected by rule %s\n", r.Name)
+			return &http.Response{
+				Status:        fmt.Sprintf("%d %s", r.Abort, http.StatusText(r.Abort)),
+				StatusCode:    r.Abort,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+				Body:          ioutil.NopCloser(strings.NewReader(body)),
+				ContentLength: int64(len(body)),
+				Request:       req,
+			}, nil
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil || !r.Malformed {
+			return resp, err
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		body := malform(data)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Del("Content-Length")
+		return resp, nil
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// malform truncates a response body half way, and appends bytes invalid in any JSON document.
+func malform(body []byte) []byte {
+	return append(body[:len(body)/2:len(body)/2], "\x00<fault>"...)
+}
+
+// AdminHandler returns a handler managing the rules, to be served at the given path:
+//
+//	GET    <path>                 lists the rules, along with the number of requests each matched
+//	PUT    <path>                 replaces the rules with the JSON list in the request body
+//	DELETE <path>                 removes all rules
+//	POST   <path>/<name>/enable   enables the named rule
+//	POST   <path>/<name>/disable  disables the named rule
+func (i *Injector) AdminHandler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			i.toggle(w, req, strings.TrimPrefix(req.URL.Path, path+"/"))
+			return
+		}
+
+		switch req.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, i.Rules())
+		case "PUT":
+			var rules []Rule
+			err := json.NewDecoder(req.Body).Decode(&rules)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid rules: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			err = i.SetRules(rules)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, i.Rules())
+		case "DELETE":
+			i.SetRules(nil)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (i *Injector) toggle(w http.ResponseWriter, req *http.Request, rest string) {
+	slash := strings.LastIndex(rest, "/")
+	if slash <= 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, action := rest[:slash], rest[slash+1:]
+	var disabled bool
+	switch action {
+	case "enable":
+		disabled = false
+	case "disable":
+		disabled = true
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !i.SetDisabled(name, disabled) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, i.Rules())
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, obj interface{}) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
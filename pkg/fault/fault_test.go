@@ -0,0 +1,305 @@
+package fault
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elevran/chatter/pkg/gameon"
+)
+
+func percentage(p float64) *float64 {
+	return &p
+}
+
+func TestNewRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		err  string
+	}{
+		{name: "abort", rule: Rule{Name: "r", Abort: 503}},
+		{name: "delay", rule: Rule{Name: "r", Delay: "100ms", MaxDelay: "1s"}},
+		{name: "malformed", rule: Rule{Name: "r", Malformed: true, Percentage: percentage(0)}},
+		{name: "no name", rule: Rule{Abort: 503}, err: "rule has no name"},
+		{name: "negative percentage", rule: Rule{Name: "r", Abort: 503, Percentage: percentage(-1)}, err: "percentage must be between 0 and 100"},
+		{name: "percentage over 100", rule: Rule{Name: "r", Abort: 503, Percentage: percentage(101)}, err: "percentage must be between 0 and 100"},
+		{name: "invalid abort status", rule: Rule{Name: "r", Abort: 42}, err: "invalid abort status 42"},
+		{name: "aborted and malformed", rule: Rule{Name: "r", Abort: 503, Malformed: true}, err: "no response body to malform"},
+		{name: "invalid delay", rule: Rule{Name: "r", Delay: "soon"}, err: `invalid delay "soon"`},
+		{name: "negative delay", rule: Rule{Name: "r", Delay: "-1s"}, err: `invalid delay "-1s"`},
+		{name: "max delay below delay", rule: Rule{Name: "r", Delay: "1s", MaxDelay: "100ms"}, err: `invalid max delay "100ms"`},
+		{name: "no fault", rule: Rule{Name: "r", Path: "/room"}, err: "rule r injects no fault"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newRule(test.rule)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   Rule
+		path   string
+		userID string
+		want   bool
+	}{
+		{name: "any request", rule: Rule{}, path: "/room", want: true},
+		{name: "path suffix", rule: Rule{Path: "/hello"}, path: "/rooms/chatter/hello", want: true},
+		{name: "other path", rule: Rule{Path: "/hello"}, path: "/rooms/chatter/room", want: false},
+		{name: "user", rule: Rule{UserID: "bob"}, path: "/room", userID: "bob", want: true},
+		{name: "other user", rule: Rule{UserID: "bob"}, path: "/room", userID: "alice", want: false},
+		{name: "disabled", rule: Rule{Disabled: true}, path: "/room", want: false},
+		{name: "all requests", rule: Rule{Percentage: percentage(100)}, path: "/room", want: true},
+		{name: "no requests", rule: Rule{Percentage: percentage(0)}, path: "/room", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &rule{Rule: test.rule}
+			// Percentages are random, so that every request is tried many times
+			for n := 0; n < 100; n++ {
+				if got := r.matches(test.path, test.userID); got != test.want {
+					t.Fatalf("matches(%q, %q) = %v, want %v", test.path, test.userID, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRulePercentage(t *testing.T) {
+	r := &rule{Rule: Rule{Percentage: percentage(50)}}
+
+	matched := 0
+	for n := 0; n < 10000; n++ {
+		if r.matches("/room", "") {
+			matched++
+		}
+	}
+	if matched < 4000 || matched > 6000 {
+		t.Errorf("matched %d of 10000 requests, want about half", matched)
+	}
+}
+
+func TestInjectorMatch(t *testing.T) {
+	injector := NewInjector()
+	err := injector.SetRules([]Rule{
+		{Name: "bob", UserID: "bob", Abort: 500},
+		{Name: "hello", Path: "/hello", Abort: 503},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := injector.match("/hello", "bob"); r == nil || r.Name != "bob" {
+		t.Errorf("got rule %v, want the first matching rule", r)
+	}
+	if r := injector.match("/hello", "alice"); r == nil || r.Name != "hello" {
+		t.Errorf("got rule %v, want hello", r)
+	}
+	if r := injector.match("/room", "alice"); r != nil {
+		t.Errorf("got rule %s, want none", r.Name)
+	}
+
+	if !injector.SetDisabled("bob", true) {
+		t.Fatal("bob rule not found")
+	}
+	if r := injector.match("/hello", "bob"); r == nil || r.Name != "hello" {
+		t.Errorf("got rule %v, want hello once bob is disabled", r)
+	}
+	if injector.SetDisabled("carol", true) {
+		t.Errorf("disabled a rule that doesn't exist")
+	}
+
+	rules := injector.Rules()
+	if rules[0].Injected != 1 || rules[1].Injected != 2 {
+		t.Errorf("got injected counts %d and %d, want 1 and 2", rules[0].Injected, rules[1].Injected)
+	}
+}
+
+func TestSetRulesErrors(t *testing.T) {
+	injector := NewInjector()
+	err := injector.SetRules([]Rule{{Name: "r", Abort: 503}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = injector.SetRules([]Rule{{Name: "a", Abort: 503}, {Name: "a", Abort: 500}})
+	if err == nil || err.Error() != "duplicate rule a" {
+		t.Errorf("got error %v, want a duplicate rule", err)
+	}
+	err = injector.SetRules([]Rule{{Name: "b", Abort: 503}, {Name: "c"}})
+	if err == nil {
+		t.Errorf("set an invalid rule")
+	}
+
+	if rules := injector.Rules(); len(rules) != 1 || rules[0].Name != "r" {
+		t.Errorf("got rules %+v, want them unchanged", rules)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	injector := NewInjector()
+	handler := injector.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "15")
+		w.Write([]byte(`{"room":"open"}`))
+	}))
+
+	tests := []struct {
+		name   string
+		rules  []Rule
+		status int
+		body   string
+	}{
+		{name: "no rule", status: http.StatusOK, body: `{"room":"open"}`},
+		{name: "abort", rules: []Rule{{Name: "r", Abort: 503}}, status: 503, body: "fault injected by rule r\n"},
+		{name: "malformed", rules: []Rule{{Name: "r", Malformed: true}}, status: http.StatusOK, body: `{"room"` + "\x00<fault>"},
+		{name: "delay", rules: []Rule{{Name: "r", Delay: "1ms"}}, status: http.StatusOK, body: `{"room":"open"}`},
+		{name: "other user", rules: []Rule{{Name: "r", UserID: "alice", Abort: 503}}, status: http.StatusOK, body: `{"room":"open"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := injector.SetRules(test.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/rooms/chatter/room", nil)
+			req.Header.Set(gameon.UserIDHeader, "bob")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.status || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), test.status, test.body)
+			}
+		})
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"room":"open"}`))
+	}))
+	defer server.Close()
+
+	injector := NewInjector()
+	client := &http.Client{Transport: injector.RoundTripper(http.DefaultTransport)}
+
+	tests := []struct {
+		name   string
+		rules  []Rule
+		status int
+		body   string
+	}{
+		{name: "no rule", status: http.StatusOK, body: `{"room":"open"}`},
+		{name: "abort", rules: []Rule{{Name: "r", Path: "/room", Abort: 502}}, status: 502, body: "fault injected by rule r\n"},
+		{name: "malformed", rules: []Rule{{Name: "r", Malformed: true}}, status: http.StatusOK, body: `{"room"` + "\x00<fault>"},
+		{name: "never", rules: []Rule{{Name: "r", Abort: 502, Percentage: percentage(0)}}, status: http.StatusOK, body: `{"room":"open"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := injector.SetRules(test.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get(server.URL + "/room")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != test.status || string(body) != test.body {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, test.status, test.body)
+			}
+		})
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	injector := NewInjector()
+	handler := injector.AdminHandler("/faults")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	rules := func(w *httptest.ResponseRecorder) []Rule {
+		var rules []Rule
+		err := json.Unmarshal(w.Body.Bytes(), &rules)
+		if err != nil {
+			t.Fatalf("invalid rules %q: %v", w.Body.String(), err)
+		}
+		return rules
+	}
+
+	w := do("PUT", "/faults", `[{"name": "off", "abort": 503, "percentage": 0}, {"name": "slow", "delay": "1s"}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d setting rules: %s", w.Code, w.Body.String())
+	}
+	got := rules(w)
+	if len(got) != 2 || got[0].Percentage == nil || *got[0].Percentage != 0 || got[1].Percentage != nil {
+		t.Errorf("got rules %+v, want an explicit 0 percentage kept apart from an omitted one", got)
+	}
+
+	w = do("POST", "/faults/slow/disable", "")
+	if w.Code != http.StatusOK || !rules(w)[1].Disabled {
+		t.Errorf("got %d %s, want slow disabled", w.Code, w.Body.String())
+	}
+	w = do("POST", "/faults/slow/enable", "")
+	if w.Code != http.StatusOK || rules(w)[1].Disabled {
+		t.Errorf("got %d %s, want slow enabled", w.Code, w.Body.String())
+	}
+
+	w = do("GET", "/faults", "")
+	if w.Code != http.StatusOK || len(rules(w)) != 2 {
+		t.Errorf("got %d %s, want both rules", w.Code, w.Body.String())
+	}
+
+	failures := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{method: "PUT", path: "/faults", body: `{"name": "not a list"}`, status: http.StatusBadRequest},
+		{method: "PUT", path: "/faults", body: `[{"name": "none"}]`, status: http.StatusBadRequest},
+		{method: "POST", path: "/faults", status: http.StatusMethodNotAllowed},
+		{method: "POST", path: "/faults/missing/enable", status: http.StatusNotFound},
+		{method: "POST", path: "/faults/slow/toggle", status: http.StatusNotFound},
+		{method: "GET", path: "/faults/slow/enable", status: http.StatusMethodNotAllowed},
+		{method: "POST", path: "/faults/slow", status: http.StatusNotFound},
+	}
+	for _, e := range failures {
+		if w := do(e.method, e.path, e.body); w.Code != e.status {
+			t.Errorf("%s %s: got status %d, want %d", e.method, e.path, w.Code, e.status)
+		}
+	}
+
+	w = do("DELETE", "/faults", "")
+	if w.Code != http.StatusNoContent || len(injector.Rules()) != 0 {
+		t.Errorf("got %d with rules %+v, want them removed", w.Code, injector.Rules())
+	}
+}
@@ -0,0 +1,101 @@
+package gameon
+
+import (
+	"encoding/json"
+)
+
+// PublicAudience is the key of event content addressed to every player, and of the message delivered to players
+// with no content of their own.
+const PublicAudience = "*"
+
+// SplitEvent splits an event message among its audiences, so that private content reaches its addressee only.
+// The returned map holds the message each player with private content should receive, keyed by user ID,
+// carrying their own content along with the public content, and the message for every other player under "*",
+// carrying the public content only, or nil if there is none.
+// Messages other than player events, and events with public content only, are returned as is under "*".
+func SplitEvent(msg *Message) (map[string]*Message, error) {
+	unchanged := map[string]*Message{PublicAudience: msg}
+	if msg.Direction != DirectionPlayer {
+		return unchanged, nil
+	}
+
+	// The payload is handled as raw fields, so that fields other than the content are delivered as received
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(msg.Payload, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var payloadType string
+	if raw, ok := fields["type"]; ok {
+		err = json.Unmarshal(raw, &payloadType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if payloadType != TypeEvent {
+		return unchanged, nil
+	}
+
+	var content map[string]string
+	if raw, ok := fields["content"]; ok {
+		err = json.Unmarshal(raw, &content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	public, hasPublic := content[PublicAudience]
+	if len(content) == 0 || (hasPublic && len(content) == 1) {
+		return unchanged, nil
+	}
+
+	withContent := func(content map[string]string) (*Message, error) {
+		raw, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+
+		scoped := make(map[string]json.RawMessage, len(fields))
+		for name, value := range fields {
+			scoped[name] = value
+		}
+		scoped["content"] = raw
+
+		payload, err := json.Marshal(scoped)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Message{
+			Direction: msg.Direction,
+			Recipient: msg.Recipient,
+			Payload:   payload,
+		}, nil
+	}
+
+	audiences := map[string]*Message{PublicAudience: nil}
+	if hasPublic {
+		audiences[PublicAudience], err = withContent(map[string]string{PublicAudience: public})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for userID, text := range content {
+		if userID == PublicAudience {
+			continue
+		}
+
+		scoped := map[string]string{userID: text}
+		if hasPublic {
+			scoped[PublicAudience] = public
+		}
+		audiences[userID], err = withContent(scoped)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return audiences, nil
+}
@@ -0,0 +1,163 @@
+package gameon
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSplitEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload interface{}
+		// want holds the content expected for each audience, or nil if the audience gets no message
+		want map[string]map[string]string
+	}{
+		{
+			name: "private and public content",
+			payload: Event{Type: TypeEvent, Content: map[string]string{
+				"alice": "Welcome!",
+				"*":     "alice has just entered the room",
+			}},
+			want: map[string]map[string]string{
+				"alice": {"alice": "Welcome!", "*": "alice has just entered the room"},
+				"*":     {"*": "alice has just entered the room"},
+			},
+		},
+		{
+			name: "several private audiences",
+			payload: Event{Type: TypeEvent, Content: map[string]string{
+				"alice": "You wave at bob",
+				"bob":   "alice waves at you",
+				"*":     "alice waves at bob",
+			}},
+			want: map[string]map[string]string{
+				"alice": {"alice": "You wave at bob", "*": "alice waves at bob"},
+				"bob":   {"bob": "alice waves at you", "*": "alice waves at bob"},
+				"*":     {"*": "alice waves at bob"},
+			},
+		},
+		{
+			name:    "private content only",
+			payload: Event{Type: TypeEvent, Content: map[string]string{"alice": "Pardon your french!"}},
+			want: map[string]map[string]string{
+				"alice": {"alice": "Pardon your french!"},
+				"*":     nil,
+			},
+		},
+		{
+			name:    "public content only",
+			payload: Event{Type: TypeEvent, Content: map[string]string{"*": "A draft blows through the room"}},
+			want: map[string]map[string]string{
+				"*": {"*": "A draft blows through the room"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := NewMessage(DirectionPlayer, "*", test.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			audiences, err := SplitEvent(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(audiences) != len(test.want) {
+				t.Fatalf("got %d audiences, want %d", len(audiences), len(test.want))
+			}
+			for audience, wantContent := range test.want {
+				scoped, ok := audiences[audience]
+				if !ok {
+					t.Fatalf("no message for audience %q", audience)
+				}
+				if wantContent == nil {
+					if scoped != nil {
+						t.Errorf("audience %q got a message, want none", audience)
+					}
+					continue
+				}
+
+				if scoped.Direction != msg.Direction || scoped.Recipient != msg.Recipient {
+					t.Errorf("audience %q got direction %q and recipient %q, want %q and %q",
+						audience, scoped.Direction, scoped.Recipient, msg.Direction, msg.Recipient)
+				}
+
+				var event Event
+				err := json.Unmarshal(scoped.Payload, &event)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(event.Content, wantContent) {
+					t.Errorf("audience %q got content %v, want %v", audience, event.Content, wantContent)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitEventKeepsOtherFields(t *testing.T) {
+	msg := &Message{
+		Direction: DirectionPlayer,
+		Recipient: "*",
+		Payload:   json.RawMessage(`{"type":"event","content":{"alice":"Farewell!","*":"alice has left the room"},"bookmark":"7","extra":[1,2]}`),
+	}
+
+	audiences, err := SplitEvent(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(audiences["*"].Payload, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"type":     "event",
+		"content":  map[string]interface{}{"*": "alice has left the room"},
+		"bookmark": "7",
+		"extra":    []interface{}{1.0, 2.0},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("got payload %v, want %v", fields, want)
+	}
+}
+
+func TestSplitEventLeavesOtherMessages(t *testing.T) {
+	chat, err := NewMessage(DirectionPlayer, "*", Chat{Type: TypeChat, Username: "alice", Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := NewMessage(DirectionAck, "", Ack{Version: []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []*Message{chat, ack} {
+		audiences, err := SplitEvent(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(audiences) != 1 || audiences["*"] != msg {
+			t.Errorf("%s message was split: %v", msg.Direction, audiences)
+		}
+	}
+}
+
+func TestSplitEventRejectsInvalidContent(t *testing.T) {
+	msg := &Message{
+		Direction: DirectionPlayer,
+		Recipient: "*",
+		Payload:   json.RawMessage(`{"type":"event","content":"not a map"}`),
+	}
+
+	_, err := SplitEvent(msg)
+	if err == nil {
+		t.Error("expected an error for invalid event content")
+	}
+}
@@ -0,0 +1,196 @@
+package gameon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Direction identifies the flow of a GameOn! message, and is the first element of the websocket message framing.
+type Direction string
+
+// Message directions defined by the GameOn! websocket protocol.
+const (
+	// DirectionAck is used for the [room --> mediator] ack message, sent when a connection is established.
+	DirectionAck Direction = "ack"
+
+	// DirectionRoomHello is used for the [mediator --> room] hello message, sent when a player enters the room.
+	DirectionRoomHello Direction = "roomHello"
+
+	// DirectionRoomGoodbye is used for the [mediator --> room] goodbye message, sent when a player leaves the room.
+	DirectionRoomGoodbye Direction = "roomGoodbye"
+
+	// DirectionRoom is used for [client --> mediator --> room] chat and slash command messages.
+	DirectionRoom Direction = "room"
+
+	// DirectionPlayer is used for [room --> mediator --> client] location, chat and event messages.
+	DirectionPlayer Direction = "player"
+
+	// DirectionPlayerLocation is used for [room --> mediator --> client] player-location messages.
+	DirectionPlayerLocation Direction = "playerLocation"
+)
+
+// Payload types, carried in the "type" field of messages sent to players.
+const (
+	// TypeLocation is the type of a Location payload.
+	TypeLocation = "location"
+
+	// TypeChat is the type of a Chat payload.
+	TypeChat = "chat"
+
+	// TypeEvent is the type of an Event payload.
+	TypeEvent = "event"
+
+	// TypeExit is the type of a PlayerLocation payload.
+	TypeExit = "exit"
+)
+
+// Encode formats a message using the GameOn! websocket framing: <direction>,<recipient>,{...}
+// The recipient element is omitted when the message has no recipient.
+func Encode(msg *Message) ([]byte, error) {
+	if msg.Direction == "" {
+		return nil, fmt.Errorf("message has no direction")
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(string(msg.Direction))
+	buf.WriteRune(',')
+
+	if msg.Recipient != "" {
+		buf.WriteString(msg.Recipient)
+		buf.WriteRune(',')
+	}
+
+	buf.Write(msg.Payload)
+	return buf.Bytes(), nil
+}
+
+// Decode parses a message formatted using the GameOn! websocket framing.
+// Both the <direction>,{...} and the <direction>,<recipient>,{...} forms are accepted.
+// The payload is left undecoded, see DecodePayload.
+func Decode(data []byte) (*Message, error) {
+	parts := bytes.SplitN(data, []byte{','}, 3)
+
+	if len(parts) < 2 || len(parts[0]) == 0 {
+		return nil, fmt.Errorf("invalid websocket message format: %s", string(data))
+	}
+
+	msg := new(Message)
+	msg.Direction = Direction(parts[0])
+
+	if bytes.HasPrefix(parts[1], []byte{'{'}) {
+		// case 1: <direction>,{...}
+		msg.Payload = data[len(parts[0])+1:]
+	} else if len(parts) == 3 {
+		// case 2: <direction>,<recipient>,{...}
+		msg.Recipient = string(parts[1])
+		msg.Payload = data[len(parts[0])+len(parts[1])+2:]
+	} else {
+		return nil, fmt.Errorf("invalid websocket message format: %s", string(data))
+	}
+
+	return msg, nil
+}
+
+// NewMessage creates a message with the given direction and recipient, carrying the JSON encoding of payload.
+func NewMessage(direction Direction, recipient string, payload interface{}) (*Message, error) {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		Direction: direction,
+		Recipient: recipient,
+		Payload:   bytes,
+	}
+	return msg, nil
+}
+
+// PayloadBookmark returns the bookmark set on the chat or event payload of a player message, or an empty string if none.
+func PayloadBookmark(msg *Message) string {
+	if msg.Direction != DirectionPlayer {
+		return ""
+	}
+
+	var payload struct {
+		Bookmark string `json:"bookmark"`
+	}
+	if json.Unmarshal(msg.Payload, &payload) != nil {
+		return ""
+	}
+	return payload.Bookmark
+}
+
+// payloadKey identifies a payload struct by the message direction, and the value of the payload "type" field.
+// Directions whose payloads carry no "type" field are registered with an empty type.
+type payloadKey struct {
+	direction   Direction
+	payloadType string
+}
+
+var (
+	payloadMutex    sync.RWMutex
+	payloadRegistry = map[payloadKey]reflect.Type{}
+)
+
+func init() {
+	RegisterPayload(DirectionAck, "", Ack{})
+	RegisterPayload(DirectionRoomHello, "", Hello{})
+	RegisterPayload(DirectionRoomGoodbye, "", Goodbye{})
+	RegisterPayload(DirectionRoom, "", RoomCommand{})
+	RegisterPayload(DirectionPlayer, TypeLocation, Location{})
+	RegisterPayload(DirectionPlayer, TypeChat, Chat{})
+	RegisterPayload(DirectionPlayer, TypeEvent, Event{})
+	RegisterPayload(DirectionPlayerLocation, TypeExit, PlayerLocation{})
+}
+
+// RegisterPayload associates a payload struct with a message direction and payload type.
+// The payload type should be empty for directions whose payloads carry no "type" field.
+// A later registration for the same direction and type replaces the earlier one.
+func RegisterPayload(direction Direction, payloadType string, payload interface{}) {
+	t := reflect.TypeOf(payload)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	payloadMutex.Lock()
+	defer payloadMutex.Unlock()
+
+	payloadRegistry[payloadKey{direction: direction, payloadType: payloadType}] = t
+}
+
+// DecodePayload unmarshals the payload of a message into the struct registered for its direction and payload type.
+// The returned value is a pointer to the registered struct (e.g., *Hello, *Chat).
+func DecodePayload(msg *Message) (interface{}, error) {
+	payloadMutex.RLock()
+	t, ok := payloadRegistry[payloadKey{direction: msg.Direction}]
+	payloadMutex.RUnlock()
+
+	if !ok {
+		var typed struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(msg.Payload, &typed); err != nil {
+			return nil, err
+		}
+
+		payloadMutex.RLock()
+		t, ok = payloadRegistry[payloadKey{direction: msg.Direction, payloadType: typed.Type}]
+		payloadMutex.RUnlock()
+
+		if !ok {
+			return nil, fmt.Errorf("unrecognized payload: direction %s, type %q", msg.Direction, typed.Type)
+		}
+	}
+
+	payload := reflect.New(t).Interface()
+	if err := json.Unmarshal(msg.Payload, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
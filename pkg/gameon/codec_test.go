@@ -0,0 +1,170 @@
+package gameon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+		// err is a substring of the expected error, or empty if the message should be encoded
+		err string
+	}{
+		{name: "with recipient", msg: Message{Direction: DirectionPlayer, Recipient: "bob", Payload: []byte(`{"type":"chat"}`)}, want: `player,bob,{"type":"chat"}`},
+		{name: "without recipient", msg: Message{Direction: DirectionAck, Payload: []byte(`{"version":[1]}`)}, want: `ack,{"version":[1]}`},
+		{name: "no direction", msg: Message{Recipient: "bob", Payload: []byte(`{}`)}, err: "message has no direction"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Encode(&test.msg)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, want %q", err, test.err)
+			case test.err == "" && string(got) != test.want:
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Message
+		// err is a substring of the expected error, or empty if the message should be decoded
+		err string
+	}{
+		{name: "with recipient", data: `room,chatter,{"content":"hi"}`, want: Message{Direction: DirectionRoom, Recipient: "chatter", Payload: []byte(`{"content":"hi"}`)}},
+		{name: "without recipient", data: `ack,{"version":[1,2]}`, want: Message{Direction: DirectionAck, Payload: []byte(`{"version":[1,2]}`)}},
+		{name: "commas in payload", data: `player,*,{"type":"chat","content":"hi, all"}`, want: Message{Direction: DirectionPlayer, Recipient: "*", Payload: []byte(`{"type":"chat","content":"hi, all"}`)}},
+		{name: "commas in payload without recipient", data: `ack,{"version":[1,2]},`, want: Message{Direction: DirectionAck, Payload: []byte(`{"version":[1,2]},`)}},
+		{name: "empty", data: ``, err: "invalid websocket message format"},
+		{name: "direction only", data: `room`, err: "invalid websocket message format"},
+		{name: "no direction", data: `,chatter,{}`, err: "invalid websocket message format"},
+		{name: "recipient without payload", data: `room,chatter`, err: "invalid websocket message format"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Decode([]byte(test.data))
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, want %q", err, test.err)
+			case test.err == "" && !reflect.DeepEqual(*got, test.want):
+				t.Errorf("got %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	for _, msg := range []Message{
+		{Direction: DirectionPlayer, Recipient: "bob", Payload: []byte(`{"type":"event","content":{"bob":"hi, bob"}}`)},
+		{Direction: DirectionAck, Payload: []byte(`{"version":[1,2]}`)},
+	} {
+		data, err := Encode(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, msg) {
+			t.Errorf("got %+v after a round trip, want %+v", *got, msg)
+		}
+	}
+}
+
+// customPayload is a payload registered by a test, rather than by the package.
+type customPayload struct {
+	Type  string `json:"type"`
+	Score int    `json:"score"`
+}
+
+func TestDecodePayload(t *testing.T) {
+	RegisterPayload(DirectionPlayer, "score", &customPayload{})
+	defer func() {
+		payloadMutex.Lock()
+		delete(payloadRegistry, payloadKey{direction: DirectionPlayer, payloadType: "score"})
+		payloadMutex.Unlock()
+	}()
+
+	tests := []struct {
+		name string
+		msg  Message
+		want interface{}
+		// err is a substring of the expected error, or empty if the payload should be decoded
+		err string
+	}{
+		{name: "untyped", msg: Message{Direction: DirectionRoomHello, Payload: []byte(`{"userId":"bob","version":2}`)}, want: &Hello{UserInfo: UserInfo{UserID: "bob"}, Version: 2}},
+		{name: "ack", msg: Message{Direction: DirectionAck, Payload: []byte(`{"version":[1,2]}`)}, want: &Ack{Version: []int{1, 2}}},
+		{name: "typed", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"type":"chat","content":"hi"}`)}, want: &Chat{Type: TypeChat, Content: "hi"}},
+		{name: "exit", msg: Message{Direction: DirectionPlayerLocation, Payload: []byte(`{"type":"exit","exitId":"N"}`)}, want: &PlayerLocation{Type: TypeExit, ExitID: "N"}},
+		{name: "registered", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"type":"score","score":3}`)}, want: &customPayload{Type: "score", Score: 3}},
+		{name: "unknown type", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"type":"dance"}`)}, err: `unrecognized payload: direction player, type "dance"`},
+		{name: "unknown direction", msg: Message{Direction: "sideways", Payload: []byte(`{}`)}, err: `unrecognized payload: direction sideways, type ""`},
+		{name: "malformed typed", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"type":`)}, err: "unexpected end of JSON input"},
+		{name: "malformed untyped", msg: Message{Direction: DirectionRoom, Payload: []byte(`["hi"]`)}, err: "cannot unmarshal array"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecodePayload(&test.msg)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, want %q", err, test.err)
+			case test.err == "" && !reflect.DeepEqual(got, test.want):
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisterPayloadReplaces(t *testing.T) {
+	RegisterPayload(DirectionPlayer, TypeChat, customPayload{})
+	defer RegisterPayload(DirectionPlayer, TypeChat, Chat{})
+
+	got, err := DecodePayload(&Message{Direction: DirectionPlayer, Payload: []byte(`{"type":"chat","score":1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&customPayload{Type: TypeChat, Score: 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want the later registration %#v", got, want)
+	}
+}
+
+func TestPayloadBookmark(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{name: "chat", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"type":"chat","bookmark":"kf12-7"}`)}, want: "kf12-7"},
+		{name: "event", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"type":"event","content":{"*":"hi"},"bookmark":"kf12-8"}`)}, want: "kf12-8"},
+		{name: "no bookmark", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"type":"location"}`)}},
+		{name: "other direction", msg: Message{Direction: DirectionRoomHello, Payload: []byte(`{"bookmark":"kf12-7"}`)}},
+		{name: "malformed", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"bookmark":`)}},
+		{name: "not a string", msg: Message{Direction: DirectionPlayer, Payload: []byte(`{"bookmark":7}`)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := PayloadBookmark(&test.msg); got != test.want {
+				t.Errorf("got bookmark %q, want %q", got, test.want)
+			}
+		})
+	}
+}
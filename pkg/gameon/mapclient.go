@@ -0,0 +1,180 @@
+package gameon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// RoomInfo is the description of a room registered with the GameOn! Map service.
+type RoomInfo struct {
+	Name              string             `json:"name"`
+	FullName          string             `json:"fullName,omitempty"`
+	Description       string             `json:"description,omitempty"`
+	Doors             map[string]string  `json:"doors,omitempty"`
+	ConnectionDetails *ConnectionDetails `json:"connectionDetails,omitempty"`
+}
+
+// ConnectionDetails describes how GameOn! connects to a registered room.
+type ConnectionDetails struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	Token  string `json:"token,omitempty"`
+}
+
+// Site is a room registration, as held by the GameOn! Map service.
+type Site struct {
+	ID    string    `json:"_id,omitempty"`
+	Owner string    `json:"owner,omitempty"`
+	Info  *RoomInfo `json:"info,omitempty"`
+}
+
+// MapClient registers, updates and deletes rooms with a GameOn! Map service.
+// All requests are signed on behalf of the room owner's GameOn! ID.
+type MapClient struct {
+	httpClient *http.Client
+	serverURL  string
+	id         string
+	secret     string
+}
+
+// NewMapClient creates a client for the Map service at the given URL (e.g., https://game-on.org/map/v1),
+// signing requests using the given GameOn! ID and shared secret.
+func NewMapClient(serverURL, id, secret string) *MapClient {
+	return &MapClient{
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		serverURL:  serverURL,
+		id:         id,
+		secret:     secret,
+	}
+}
+
+// Find returns the sites owned by the client's GameOn! ID with the given room name.
+func (c *MapClient) Find(name string) ([]Site, error) {
+	query := url.Values{}
+	query.Set("owner", c.id)
+	query.Set("name", name)
+
+	var sites []Site
+	err := c.doRequest("GET", "/sites?"+query.Encode(), nil, &sites, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	return sites, nil
+}
+
+// Register creates a new site for the given room.
+func (c *MapClient) Register(info *RoomInfo) (*Site, error) {
+	var site Site
+	err := c.doRequest("POST", "/sites", info, &site, http.StatusCreated, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &site, nil
+}
+
+// Update replaces the room description of an existing site.
+func (c *MapClient) Update(siteID string, info *RoomInfo) (*Site, error) {
+	var site Site
+	err := c.doRequest("PUT", "/sites/"+url.PathEscape(siteID), info, &site, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &site, nil
+}
+
+// Delete removes an existing site.
+func (c *MapClient) Delete(siteID string) error {
+	return c.doRequest("DELETE", "/sites/"+url.PathEscape(siteID), nil, nil, http.StatusNoContent, http.StatusOK)
+}
+
+// Sync makes sure the room is registered with the given description, registering it if it has no site yet,
+// or updating its site if the registered description has drifted.
+// The returned boolean is true if the Map service was modified.
+func (c *MapClient) Sync(info *RoomInfo) (*Site, bool, error) {
+	sites, err := c.Find(info.Name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(sites) == 0 {
+		site, err := c.Register(info)
+		return site, err == nil, err
+	}
+
+	site := &sites[0]
+	if site.Info != nil && reflect.DeepEqual(normalizeRoomInfo(site.Info), normalizeRoomInfo(info)) {
+		return site, false, nil
+	}
+
+	site, err = c.Update(site.ID, info)
+	return site, err == nil, err
+}
+
+// normalizeRoomInfo returns a copy of the room description, stripped of the fields not reported back by the Map service.
+func normalizeRoomInfo(info *RoomInfo) RoomInfo {
+	normalized := *info
+	if info.ConnectionDetails != nil {
+		details := *info.ConnectionDetails
+		details.Token = ""
+		normalized.ConnectionDetails = &details
+	}
+	if len(normalized.Doors) == 0 {
+		normalized.Doors = nil
+	}
+	return normalized
+}
+
+func (c *MapClient) doRequest(method, path string, body, out interface{}, expectedStatus ...int) error {
+	var reqBytes []byte
+	if body != nil {
+		var err error
+		reqBytes, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.serverURL+path, bytes.NewReader(reqBytes))
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	SignRequest(req, c.id, c.secret, reqBytes, time.Now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	ok := false
+	for _, status := range expectedStatus {
+		ok = ok || resp.StatusCode == status
+	}
+	if !ok {
+		return fmt.Errorf("map service %s %s failed: %s: %s", method, path, resp.Status, string(respBytes))
+	}
+
+	if out == nil || len(respBytes) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBytes, out)
+}
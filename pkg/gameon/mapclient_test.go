@@ -0,0 +1,213 @@
+package gameon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMap is a local stand-in for the GameOn! Map service, holding sites in memory.
+// It rejects requests that aren't signed using its shared secret, and records the others.
+type fakeMap struct {
+	id     string
+	secret string
+
+	sites    map[string]Site
+	nextID   int
+	requests []string
+	mutex    sync.Mutex
+}
+
+func newFakeMap(id, secret string) *fakeMap {
+	return &fakeMap{
+		id:     id,
+		secret: secret,
+		sites:  make(map[string]Site),
+	}
+}
+
+func (f *fakeMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) == 0 {
+		body = nil
+	}
+
+	if r.Header.Get(IDHeader) != f.id {
+		http.Error(w, "unknown id", http.StatusForbidden)
+		return
+	}
+	err = VerifyRequest(r, f.secret, body, 5*time.Minute, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	siteID := strings.TrimPrefix(r.URL.Path, "/sites/")
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/sites":
+		sites := []Site{}
+		for _, site := range f.sites {
+			if site.Owner == r.URL.Query().Get("owner") && site.Info.Name == r.URL.Query().Get("name") {
+				sites = append(sites, site)
+			}
+		}
+		writeTestJSON(w, http.StatusOK, sites)
+	case r.Method == "POST" && r.URL.Path == "/sites":
+		var info RoomInfo
+		if json.Unmarshal(body, &info) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		site := f.store(fmt.Sprintf("site-%d", f.nextID), info)
+		writeTestJSON(w, http.StatusCreated, site)
+	case r.Method == "PUT" && f.sites[siteID].ID != "":
+		var info RoomInfo
+		if json.Unmarshal(body, &info) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeTestJSON(w, http.StatusOK, f.store(siteID, info))
+	case r.Method == "DELETE" && f.sites[siteID].ID != "":
+		delete(f.sites, siteID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// store saves the site, dropping its connection token as the Map service doesn't report it back.
+// Must be called with the lock held.
+func (f *fakeMap) store(siteID string, info RoomInfo) Site {
+	if info.ConnectionDetails != nil {
+		details := *info.ConnectionDetails
+		details.Token = ""
+		info.ConnectionDetails = &details
+	}
+
+	site := Site{ID: siteID, Owner: f.id, Info: &info}
+	f.sites[siteID] = site
+	return site
+}
+
+// takeRequests returns the requests handled since the last call.
+func (f *fakeMap) takeRequests() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+func writeTestJSON(w http.ResponseWriter, statusCode int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func TestMapClientSync(t *testing.T) {
+	secret := newSecret(t)
+	fake := newFakeMap("owner", secret)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := NewMapClient(server.URL, "owner", secret)
+	info := &RoomInfo{
+		Name:        "chatter",
+		FullName:    "Chatter",
+		Description: "A room for chatting",
+		ConnectionDetails: &ConnectionDetails{
+			Type:   "websocket",
+			Target: "ws://mediator/rooms/chatter",
+			Token:  "token",
+		},
+	}
+
+	steps := []struct {
+		name     string
+		info     RoomInfo
+		modified bool
+		requests []string
+	}{
+		{name: "create", info: *info, modified: true, requests: []string{"GET /sites", "POST /sites"}},
+		{name: "unchanged", info: *info, modified: false, requests: []string{"GET /sites"}},
+		{
+			name: "drifted",
+			info: RoomInfo{
+				Name:              "chatter",
+				FullName:          "Chatter",
+				Description:       "A room for chatting, and nothing else",
+				ConnectionDetails: info.ConnectionDetails,
+			},
+			modified: true,
+			requests: []string{"GET /sites", "PUT /sites/site-1"},
+		},
+	}
+
+	for _, step := range steps {
+		info := step.info
+		site, modified, err := client.Sync(&info)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if modified != step.modified {
+			t.Errorf("%s: got modified %v, want %v", step.name, modified, step.modified)
+		}
+		if site.ID != "site-1" || site.Info.Description != info.Description {
+			t.Errorf("%s: got site %+v", step.name, site)
+		}
+		if requests := fake.takeRequests(); !reflect.DeepEqual(requests, step.requests) {
+			t.Errorf("%s: got requests %v, want %v", step.name, requests, step.requests)
+		}
+	}
+
+	err := client.Delete("site-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sites, err := client.Find("chatter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sites) != 0 {
+		t.Errorf("got sites %+v after deletion, want none", sites)
+	}
+}
+
+func TestMapClientRejectedSignature(t *testing.T) {
+	fake := newFakeMap("owner", newSecret(t))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	for _, client := range []*MapClient{
+		NewMapClient(server.URL, "owner", newSecret(t)),
+		NewMapClient(server.URL, "someone-else", fake.secret),
+	} {
+		_, _, err := client.Sync(&RoomInfo{Name: "chatter"})
+		if err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("got error %v, want 403", err)
+		}
+	}
+
+	if requests := fake.takeRequests(); len(requests) != 0 {
+		t.Errorf("fake map service handled unsigned requests %v", requests)
+	}
+}
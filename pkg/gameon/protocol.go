@@ -7,4 +7,35 @@ const (
 
 	// UsernameHeader carries the Game On user name.
 	UsernameHeader = "X-Game-On-Username"
+
+	// VersionHeader carries the protocol version negotiated for the user's session.
+	VersionHeader = "X-Game-On-Version"
+
+	// DisconnectedForHeader carries the time (e.g., 1m30s) a recovering user has been disconnected for.
+	// It is relative rather than absolute, so that the room service doesn't compare its clock to the mediator's.
+	DisconnectedForHeader = "X-Game-On-Disconnected-For"
 )
+
+// NegotiateVersion selects the protocol version to use for a hello requesting the given version,
+// out of the versions supported by the room.
+// An unspecified (zero) requested version selects the lowest supported version.
+// An unsupported requested version is downgraded to the highest supported version below it.
+// The returned boolean is false if no supported version can satisfy the request.
+func NegotiateVersion(requested int, supported []int) (int, bool) {
+	negotiated := 0
+	for _, version := range supported {
+		if version <= 0 {
+			continue
+		}
+
+		if requested == 0 {
+			if negotiated == 0 || version < negotiated {
+				negotiated = version
+			}
+		} else if version <= requested && version > negotiated {
+			negotiated = version
+		}
+	}
+
+	return negotiated, negotiated != 0
+}
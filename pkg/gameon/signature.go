@@ -0,0 +1,98 @@
+package gameon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Headers carrying the GameOn! signature of a request, as computed using a secret shared with GameOn!.
+const (
+	// IDHeader carries the GameOn! ID of the signing party.
+	IDHeader = "gameon-id"
+
+	// DateHeader carries the time at which the request was signed, in HTTP date format.
+	DateHeader = "gameon-date"
+
+	// BodyHashHeader carries the base64-encoded SHA-256 hash of the request body, for requests that have one.
+	BodyHashHeader = "gameon-sig-body"
+
+	// SignatureHeader carries the base64-encoded HMAC-SHA256 of the ID, date and body hash headers.
+	SignatureHeader = "gameon-signature"
+)
+
+// Signature computes the GameOn! signature of the given (ordered) values, using the given shared secret.
+func Signature(secret string, values ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, value := range values {
+		mac.Write([]byte(value))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// BodyHash computes the GameOn! hash of a request body.
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SignRequest sets the GameOn! signature headers on the request, signed at the given time.
+// The body should hold the request body, or be nil for requests that have none.
+func SignRequest(req *http.Request, id, secret string, body []byte, now time.Time) {
+	date := now.UTC().Format(http.TimeFormat)
+
+	req.Header.Set(IDHeader, id)
+	req.Header.Set(DateHeader, date)
+
+	if body == nil {
+		req.Header.Set(SignatureHeader, Signature(secret, id, date))
+		return
+	}
+
+	bodyHash := BodyHash(body)
+	req.Header.Set(BodyHashHeader, bodyHash)
+	req.Header.Set(SignatureHeader, Signature(secret, id, date, bodyHash))
+}
+
+// VerifyRequest verifies the GameOn! signature headers of a request, signed using the given shared secret.
+// The body should hold the request body, or be nil for requests that have none (e.g., websocket handshakes).
+// Requests signed more than maxSkew away from the given time are rejected, to block replays of captured requests.
+func VerifyRequest(req *http.Request, secret string, body []byte, maxSkew time.Duration, now time.Time) error {
+	id := req.Header.Get(IDHeader)
+	date := req.Header.Get(DateHeader)
+	signature := req.Header.Get(SignatureHeader)
+
+	if id == "" || date == "" || signature == "" {
+		return fmt.Errorf("missing signature headers")
+	}
+
+	signedAt, err := http.ParseTime(date)
+	if err != nil {
+		return fmt.Errorf("invalid signature date: %s", date)
+	}
+
+	skew := now.Sub(signedAt)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		return fmt.Errorf("stale signature date: %s", date)
+	}
+
+	values := []string{id, date}
+	if bodyHash := req.Header.Get(BodyHashHeader); bodyHash != "" || body != nil {
+		if !hmac.Equal([]byte(bodyHash), []byte(BodyHash(body))) {
+			return fmt.Errorf("body hash mismatch")
+		}
+		values = append(values, bodyHash)
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(Signature(secret, values...))) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package gameon
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSecret generates a random shared secret for a test.
+func newSecret(t *testing.T) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+type signatureTest struct {
+	name string
+	// body is the body the request is signed with, while verified is the body it is verified with
+	body     []byte
+	verified []byte
+	// secret verifies the request, if other than the secret it is signed with
+	secret string
+	now    time.Time
+	tamper func(req *http.Request)
+	// err is a substring of the expected error, or empty if the request should be verified
+	err string
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := newSecret(t)
+	signedAt := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`{"name":"chatter"}`)
+
+	tests := []signatureTest{
+		{name: "valid", body: body, verified: body, now: signedAt},
+		{name: "valid without body", now: signedAt},
+		{name: "valid within skew", body: body, verified: body, now: signedAt.Add(4 * time.Minute)},
+		{name: "valid signed ahead within skew", body: body, verified: body, now: signedAt.Add(-4 * time.Minute)},
+		{name: "stale date", body: body, verified: body, now: signedAt.Add(6 * time.Minute), err: "stale signature date"},
+		{name: "date ahead", body: body, verified: body, now: signedAt.Add(-6 * time.Minute), err: "stale signature date"},
+		{name: "tampered body", body: body, verified: []byte(`{"name":"evil"}`), now: signedAt, err: "body hash mismatch"},
+		{name: "body added", verified: body, now: signedAt, err: "body hash mismatch"},
+		{
+			name: "tampered signature", body: body, verified: body, now: signedAt, err: "signature mismatch",
+			tamper: func(req *http.Request) {
+				req.Header.Set(SignatureHeader, Signature(secret, "forged"))
+			},
+		},
+		{
+			name: "tampered body hash", body: body, verified: body, now: signedAt, err: "body hash mismatch",
+			tamper: func(req *http.Request) {
+				req.Header.Set(BodyHashHeader, BodyHash([]byte("other")))
+			},
+		},
+		{
+			name: "tampered date", body: body, verified: body, now: signedAt, err: "signature mismatch",
+			tamper: func(req *http.Request) {
+				req.Header.Set(DateHeader, signedAt.Add(time.Minute).Format(http.TimeFormat))
+			},
+		},
+		{
+			name: "tampered id", body: body, verified: body, now: signedAt, err: "signature mismatch",
+			tamper: func(req *http.Request) {
+				req.Header.Set(IDHeader, "someone-else")
+			},
+		},
+		{name: "other secret", body: body, verified: body, secret: newSecret(t), now: signedAt, err: "signature mismatch"},
+		{
+			name: "invalid date", body: body, verified: body, now: signedAt, err: "invalid signature date",
+			tamper: func(req *http.Request) {
+				req.Header.Set(DateHeader, "yesterday")
+			},
+		},
+	}
+
+	for _, header := range []string{IDHeader, DateHeader, SignatureHeader} {
+		header := header
+		tests = append(tests, signatureTest{
+			name: "missing " + header, body: body, verified: body, now: signedAt, err: "missing signature headers",
+			tamper: func(req *http.Request) {
+				req.Header.Del(header)
+			},
+		})
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "http://map/v1/sites", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			SignRequest(req, "chatter", secret, test.body, signedAt)
+			if test.tamper != nil {
+				test.tamper(req)
+			}
+
+			verifySecret := secret
+			if test.secret != "" {
+				verifySecret = test.secret
+			}
+
+			err = VerifyRequest(req, verifySecret, test.verified, 5*time.Minute, test.now)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -10,7 +10,7 @@ type MessageCollection struct {
 // Message is a generic GameOn! message, holding a direction (player, room, ...),
 // a recipient (playerID, roomID, *, ...), and a message-type specific payload.
 type Message struct {
-	Direction string          `json:"direction,omitempty"`
+	Direction Direction       `json:"direction,omitempty"`
 	Recipient string          `json:"recipient,omitempty"`
 	Payload   json.RawMessage `json:"payload,omitempty"`
 }
@@ -31,8 +31,9 @@ type RoomCommand struct {
 // Hello is the message payload provided for a [mediator --> room] hello message.
 type Hello struct {
 	UserInfo
-	Version  int  `json:"version,omitempty"`
-	Recovery bool `json:"recovery,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Recovery bool   `json:"recovery,omitempty"`
+	Bookmark string `json:"bookmark,omitempty"`
 }
 
 // Goodbye is the message payload provided for a [mediator --> room] goodbye message.
@@ -0,0 +1,184 @@
+// Package health serves liveness and readiness probes, reporting the outcome of each readiness check as JSON.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check reports whether a dependency of the service is ready, returning an error describing why it is not.
+type Check func() error
+
+// Status values reported by probes, for the service as a whole and for each check.
+// Warn is reported for failed advisory checks, which don't fail readiness.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+	StatusWarn = "warn"
+)
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the body of a probe response.
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type namedCheck struct {
+	name     string
+	check    Check
+	advisory bool
+}
+
+// Checker runs the readiness checks of a service.
+// Checks run concurrently, and a check that doesn't complete within the timeout fails.
+type Checker struct {
+	timeout      time.Duration
+	checks       []namedCheck
+	shuttingDown int32
+	mutex        sync.Mutex
+}
+
+// NewChecker creates a checker with no checks, failing checks that take longer than the timeout.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+	}
+}
+
+// Add registers a readiness check under the given name.
+func (c *Checker) Add(name string, check Check) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// AddAdvisory registers a check of a dependency the service can serve without, under the given name.
+// Its failures are reported, but don't fail readiness.
+func (c *Checker) AddAdvisory(name string, check Check) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.checks = append(c.checks, namedCheck{name: name, check: check, advisory: true})
+}
+
+// Shutdown marks the service as shutting down, failing readiness from now on so that traffic is routed elsewhere.
+// Liveness is unaffected, so that the service isn't restarted while completing work in flight.
+func (c *Checker) Shutdown() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+}
+
+// Ready runs all checks, and reports the service as ready only if all of its non-advisory checks pass.
+func (c *Checker) Ready() Report {
+	c.mutex.Lock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mutex.Unlock()
+
+	report := Report{
+		Status: StatusOK,
+		Checks: make(map[string]CheckResult, len(checks)+1),
+	}
+
+	if atomic.LoadInt32(&c.shuttingDown) != 0 {
+		report.Status = StatusFail
+		report.Checks["shutdown"] = CheckResult{Status: StatusFail, Error: "service is shutting down", Duration: "0s"}
+	}
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = c.run(check)
+		}(i, nc.check)
+	}
+	wg.Wait()
+
+	for i, nc := range checks {
+		switch {
+		case results[i].Status == StatusOK:
+		case nc.advisory:
+			results[i].Status = StatusWarn
+		default:
+			report.Status = StatusFail
+		}
+		report.Checks[nc.name] = results[i]
+	}
+
+	return report
+}
+
+// run runs a single check, failing it if it doesn't complete within the timeout.
+// A check that times out is left running in the background, and its outcome is discarded.
+func (c *Checker) run(check Check) CheckResult {
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("check panicked: %v", r)
+			}
+		}()
+		done <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(c.timeout):
+		err = fmt.Errorf("check timed out after %s", c.timeout)
+	}
+
+	result := CheckResult{Status: StatusOK, Duration: time.Since(start).String()}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// LivenessHandler returns a handler reporting that the service is up, as long as it is able to serve requests.
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, Report{Status: StatusOK})
+	})
+}
+
+// ReadinessHandler returns a handler running all checks, responding with 503 (Service Unavailable) if any of them fails,
+// other than advisory checks.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Ready())
+	})
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	statusCode := http.StatusOK
+	if report.Status != StatusOK {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(statusCode)
+	w.Write(bytes)
+}
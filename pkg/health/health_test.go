@@ -0,0 +1,231 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pass() error {
+	return nil
+}
+
+func fail() error {
+	return errors.New("connection refused")
+}
+
+// hang blocks until released, standing for a dependency that doesn't answer.
+func hang(release chan struct{}) Check {
+	return func() error {
+		<-release
+		return nil
+	}
+}
+
+// statuses returns the status of each check in the report.
+func statuses(report Report) map[string]string {
+	statuses := make(map[string]string, len(report.Checks))
+	for name, result := range report.Checks {
+		statuses[name] = result.Status
+	}
+	return statuses
+}
+
+func TestReady(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	tests := []struct {
+		name     string
+		checks   map[string]Check
+		advisory map[string]Check
+		status   string
+		want     map[string]string
+	}{
+		{name: "no checks", status: StatusOK, want: map[string]string{}},
+		{
+			name:   "all pass",
+			checks: map[string]Check{"redis": pass, "room": pass},
+			status: StatusOK,
+			want:   map[string]string{"redis": StatusOK, "room": StatusOK},
+		},
+		{
+			name:   "one fails",
+			checks: map[string]Check{"redis": pass, "room": fail},
+			status: StatusFail,
+			want:   map[string]string{"redis": StatusOK, "room": StatusFail},
+		},
+		{
+			name:     "advisory fails",
+			checks:   map[string]Check{"room": pass},
+			advisory: map[string]Check{"shadow": fail},
+			status:   StatusOK,
+			want:     map[string]string{"room": StatusOK, "shadow": StatusWarn},
+		},
+		{
+			name:     "advisory passes",
+			advisory: map[string]Check{"shadow": pass},
+			status:   StatusOK,
+			want:     map[string]string{"shadow": StatusOK},
+		},
+		{
+			name:   "timeout",
+			checks: map[string]Check{"room": hang(release), "redis": pass},
+			status: StatusFail,
+			want:   map[string]string{"room": StatusFail, "redis": StatusOK},
+		},
+		{
+			name:     "advisory timeout",
+			checks:   map[string]Check{"room": pass},
+			advisory: map[string]Check{"shadow": hang(release)},
+			status:   StatusOK,
+			want:     map[string]string{"room": StatusOK, "shadow": StatusWarn},
+		},
+		{
+			name:   "panic",
+			checks: map[string]Check{"room": func() error { panic("nil map") }},
+			status: StatusFail,
+			want:   map[string]string{"room": StatusFail},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewChecker(50 * time.Millisecond)
+			for name, check := range test.checks {
+				c.Add(name, check)
+			}
+			for name, check := range test.advisory {
+				c.AddAdvisory(name, check)
+			}
+
+			start := time.Now()
+			report := c.Ready()
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("readiness took %s, want checks bounded by the timeout", elapsed)
+			}
+
+			if report.Status != test.status {
+				t.Errorf("got status %s, want %s", report.Status, test.status)
+			}
+			if got := statuses(report); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got check statuses %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadyReportsErrors(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	c := NewChecker(20 * time.Millisecond)
+	c.Add("room", fail)
+	c.Add("redis", hang(release))
+	c.Add("map", func() error { panic("nil map") })
+
+	report := c.Ready()
+	for name, want := range map[string]string{
+		"room":  "connection refused",
+		"redis": "check timed out after 20ms",
+		"map":   "check panicked: nil map",
+	} {
+		if got := report.Checks[name].Error; got != want {
+			t.Errorf("got %s error %q, want %q", name, got, want)
+		}
+	}
+}
+
+// TestChecksRunConcurrently verifies that slow checks don't add up, so that each can take up to the timeout.
+func TestChecksRunConcurrently(t *testing.T) {
+	c := NewChecker(time.Second)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		c.Add(name, func() error {
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		})
+	}
+
+	start := time.Now()
+	report := c.Ready()
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("readiness took %s, want checks run concurrently", elapsed)
+	}
+	if report.Status != StatusOK {
+		t.Errorf("got status %s, want %s", report.Status, StatusOK)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	c := NewChecker(time.Second)
+	c.Add("room", pass)
+
+	if report := c.Ready(); report.Status != StatusOK {
+		t.Fatalf("got status %s before shutdown, want %s", report.Status, StatusOK)
+	}
+
+	c.Shutdown()
+	report := c.Ready()
+	if report.Status != StatusFail {
+		t.Errorf("got status %s once shutting down, want %s", report.Status, StatusFail)
+	}
+	if want := map[string]string{"room": StatusOK, "shutdown": StatusFail}; !reflect.DeepEqual(statuses(report), want) {
+		t.Errorf("got check statuses %v, want %v", statuses(report), want)
+	}
+
+	// Liveness is unaffected by the shutdown
+	w := httptest.NewRecorder()
+	c.LivenessHandler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got liveness status %d once shutting down, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		check      Check
+		advisory   bool
+		statusCode int
+		status     string
+	}{
+		{name: "ready", check: pass, statusCode: http.StatusOK, status: StatusOK},
+		{name: "not ready", check: fail, statusCode: http.StatusServiceUnavailable, status: StatusFail},
+		{name: "advisory failure", check: fail, advisory: true, statusCode: http.StatusOK, status: StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewChecker(time.Second)
+			if test.advisory {
+				c.AddAdvisory("room", test.check)
+			} else {
+				c.Add("room", test.check)
+			}
+
+			w := httptest.NewRecorder()
+			c.ReadinessHandler().ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+
+			if w.Code != test.statusCode {
+				t.Errorf("got status code %d, want %d", w.Code, test.statusCode)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+				t.Errorf("got content type %q, want JSON", got)
+			}
+
+			var report Report
+			err := json.Unmarshal(w.Body.Bytes(), &report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Status != test.status || report.Checks["room"].Duration == "" {
+				t.Errorf("got report %+v, want status %s with the check's duration", report, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+// Package metrics implements a small set of Prometheus metric types, and a writer for the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets suited for request latencies, in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry holds a set of metrics, and exposes them in the Prometheus text exposition format.
+type Registry struct {
+	metrics []collector
+	names   map[string]bool
+	mutex   sync.Mutex
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]bool),
+	}
+}
+
+// collector is a metric family, able to write all of its samples.
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, c)
+}
+
+// Write writes all metrics in the registry to w, in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]collector(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range metrics {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns an HTTP handler exposing the metrics in the registry, for scraping by Prometheus.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// family holds the samples of a metric with a given set of label names, keyed by their label values.
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	values map[string]*labeledValue
+	mutex  sync.Mutex
+}
+
+type labeledValue struct {
+	labelValues []string
+	value       float64
+	histogram   *histogramValue
+}
+
+func newFamily(name, help, kind string, labelNames []string) *family {
+	return &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     make(map[string]*labeledValue),
+	}
+}
+
+// get returns the value for the given label values, creating it if needed.
+// Must be called with the family's lock held.
+func (f *family) get(labelValues []string) *labeledValue {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	v, ok := f.values[key]
+	if !ok {
+		v = &labeledValue{labelValues: append([]string(nil), labelValues...)}
+		f.values[key] = v
+	}
+	return v
+}
+
+// sorted returns the family's values, sorted by their label values.
+// Must be called with the family's lock held.
+func (f *family) sorted() []*labeledValue {
+	values := make([]*labeledValue, 0, len(f.values))
+	for _, v := range f.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labelValues, "\xff") < strings.Join(values[j].labelValues, "\xff")
+	})
+	return values
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.writeHeader(w)
+	for _, v := range f.sorted() {
+		writeSample(w, f.name, f.labelNames, v.labelValues, "", "", v.value)
+	}
+}
+
+// Counter is a metric whose value only goes up, partitioned by a set of labels.
+type Counter struct {
+	family *family
+}
+
+// NewCounter registers a counter with the given (possibly empty) label names.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, "counter", labelNames)}
+	r.register(name, c.family)
+	return c
+}
+
+// Inc increments the counter with the given label values by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter with the given label values by delta, which must not be negative.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s can't be decreased", c.family.name))
+	}
+
+	c.family.mutex.Lock()
+	defer c.family.mutex.Unlock()
+
+	c.family.get(labelValues).value += delta
+}
+
+// Gauge is a metric whose value can go up and down, partitioned by a set of labels.
+type Gauge struct {
+	family *family
+}
+
+// NewGauge registers a gauge with the given (possibly empty) label names.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{family: newFamily(name, help, "gauge", labelNames)}
+	r.register(name, g.family)
+	return g
+}
+
+// Set sets the gauge with the given label values to value.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.family.mutex.Lock()
+	defer g.family.mutex.Unlock()
+
+	g.family.get(labelValues).value = value
+}
+
+// Add adds delta (possibly negative) to the gauge with the given label values.
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.family.mutex.Lock()
+	defer g.family.mutex.Unlock()
+
+	g.family.get(labelValues).value += delta
+}
+
+// CollectFunc reports the current samples of a function-backed metric, by calling report for each set of label values.
+type CollectFunc func(report func(value float64, labelValues ...string))
+
+// funcCollector is a metric whose samples are collected from a function whenever the metric is written,
+// for values already tracked elsewhere (e.g., the number of live sessions).
+type funcCollector struct {
+	family  *family
+	collect CollectFunc
+}
+
+// NewGaugeFunc registers a gauge whose samples are collected by calling collect.
+func (r *Registry) NewGaugeFunc(name, help string, labelNames []string, collect CollectFunc) {
+	r.register(name, &funcCollector{family: newFamily(name, help, "gauge", labelNames), collect: collect})
+}
+
+// NewCounterFunc registers a counter whose samples are collected by calling collect.
+// The collected values must only go up.
+func (r *Registry) NewCounterFunc(name, help string, labelNames []string, collect CollectFunc) {
+	r.register(name, &funcCollector{family: newFamily(name, help, "counter", labelNames), collect: collect})
+}
+
+func (c *funcCollector) write(w *bufio.Writer) {
+	f := newFamily(c.family.name, c.family.help, c.family.kind, c.family.labelNames)
+	c.collect(func(value float64, labelValues ...string) {
+		f.get(labelValues).value = value
+	})
+	f.write(w)
+}
+
+// Histogram is a metric sampling observations into buckets, partitioned by a set of labels.
+type Histogram struct {
+	family  *family
+	buckets []float64
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds and (possibly empty) label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{family: newFamily(name, help, "histogram", labelNames), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+// Observe adds an observation to the histogram with the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.family.mutex.Lock()
+	defer h.family.mutex.Unlock()
+
+	v := h.family.get(labelValues)
+	if v.histogram == nil {
+		v.histogram = &histogramValue{counts: make([]uint64, len(h.buckets))}
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.histogram.counts[i]++
+		}
+	}
+	v.histogram.count++
+	v.histogram.sum += value
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	f := h.family
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.writeHeader(w)
+	for _, v := range f.sorted() {
+		for i, bound := range h.buckets {
+			writeSample(w, f.name+"_bucket", f.labelNames, v.labelValues, "le", formatFloat(bound), float64(v.histogram.counts[i]))
+		}
+		writeSample(w, f.name+"_bucket", f.labelNames, v.labelValues, "le", "+Inf", float64(v.histogram.count))
+		writeSample(w, f.name+"_sum", f.labelNames, v.labelValues, "", "", v.histogram.sum)
+		writeSample(w, f.name+"_count", f.labelNames, v.labelValues, "", "", float64(v.histogram.count))
+	}
+}
+
+// writeSample writes a single sample line, with an optional extra label (e.g., a histogram bucket's "le").
+func writeSample(w *bufio.Writer, name string, labelNames, labelValues []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+
+	if len(labelNames) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labelName, escapeLabelValue(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,207 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+// written returns the registry's metrics in the text exposition format.
+func written(t *testing.T, r *Registry) string {
+	var buf bytes.Buffer
+	err := r.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(r *Registry)
+		want     string
+	}{
+		{
+			name: "counter",
+			register: func(r *Registry) {
+				c := r.NewCounter("requests_total", "Requests handled.", "method", "status")
+				c.Inc("POST", "200")
+				c.Add(2, "GET", "200")
+				c.Inc("GET", "500")
+				c.Inc("GET", "200")
+			},
+			want: `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 3
+requests_total{method="GET",status="500"} 1
+requests_total{method="POST",status="200"} 1
+`,
+		},
+		{
+			name: "unlabeled gauge",
+			register: func(r *Registry) {
+				g := r.NewGauge("temperature", "Current temperature.")
+				g.Set(21.5)
+				g.Add(-1.25)
+			},
+			want: `# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature 20.25
+`,
+		},
+		{
+			name: "no samples",
+			register: func(r *Registry) {
+				r.NewCounter("errors_total", "Errors.", "kind")
+			},
+			want: `# HELP errors_total Errors.
+# TYPE errors_total counter
+`,
+		},
+		{
+			name: "escaping",
+			register: func(r *Registry) {
+				g := r.NewGauge("info", "Help with a \\ backslash\nand a \"quoted\" newline.", "value")
+				g.Set(1, "a \"quoted\" \\ value\non two lines")
+			},
+			want: `# HELP info Help with a \\ backslash\nand a "quoted" newline.
+# TYPE info gauge
+info{value="a \"quoted\" \\ value\non two lines"} 1
+`,
+		},
+		{
+			name: "special values",
+			register: func(r *Registry) {
+				g := r.NewGauge("bounds", "Bounds.", "bound")
+				g.Set(math.Inf(1), "upper")
+				g.Set(math.Inf(-1), "lower")
+				g.Set(math.NaN(), "unknown")
+				g.Set(1e-9, "tiny")
+			},
+			want: `# HELP bounds Bounds.
+# TYPE bounds gauge
+bounds{bound="lower"} -Inf
+bounds{bound="tiny"} 1e-09
+bounds{bound="unknown"} NaN
+bounds{bound="upper"} +Inf
+`,
+		},
+		{
+			name: "histogram",
+			register: func(r *Registry) {
+				h := r.NewHistogram("latency_seconds", "Request latency.", []float64{1, 0.1, 0.5}, "room")
+				h.Observe(0.05, "lobby")
+				h.Observe(0.1, "lobby")
+				h.Observe(0.7, "lobby")
+				h.Observe(3, "lobby")
+				h.Observe(0.2, "attic")
+			},
+			want: `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{room="attic",le="0.1"} 0
+latency_seconds_bucket{room="attic",le="0.5"} 1
+latency_seconds_bucket{room="attic",le="1"} 1
+latency_seconds_bucket{room="attic",le="+Inf"} 1
+latency_seconds_sum{room="attic"} 0.2
+latency_seconds_count{room="attic"} 1
+latency_seconds_bucket{room="lobby",le="0.1"} 2
+latency_seconds_bucket{room="lobby",le="0.5"} 2
+latency_seconds_bucket{room="lobby",le="1"} 3
+latency_seconds_bucket{room="lobby",le="+Inf"} 4
+latency_seconds_sum{room="lobby"} 3.85
+latency_seconds_count{room="lobby"} 4
+`,
+		},
+		{
+			name: "unlabeled histogram",
+			register: func(r *Registry) {
+				h := r.NewHistogram("size_bytes", "Message size.", []float64{10, 100})
+				h.Observe(50)
+			},
+			want: `# HELP size_bytes Message size.
+# TYPE size_bytes histogram
+size_bytes_bucket{le="10"} 0
+size_bytes_bucket{le="100"} 1
+size_bytes_bucket{le="+Inf"} 1
+size_bytes_sum 50
+size_bytes_count 1
+`,
+		},
+		{
+			name: "func collectors",
+			register: func(r *Registry) {
+				r.NewGaugeFunc("sessions", "Live sessions.", []string{"room"}, func(report func(float64, ...string)) {
+					report(3, "lobby")
+					report(1, "attic")
+				})
+				r.NewCounterFunc("dropped_total", "Dropped messages.", nil, func(report func(float64, ...string)) {
+					report(7)
+				})
+			},
+			want: `# HELP sessions Live sessions.
+# TYPE sessions gauge
+sessions{room="attic"} 1
+sessions{room="lobby"} 3
+# HELP dropped_total Dropped messages.
+# TYPE dropped_total counter
+dropped_total 7
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRegistry()
+			test.register(r)
+			if got := written(t, r); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests handled.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("got content type %q, want %q", got, want)
+	}
+	if got, want := w.Body.String(), written(t, r); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	tests := []struct {
+		name string
+		use  func(r *Registry)
+	}{
+		{name: "duplicate name", use: func(r *Registry) {
+			r.NewCounter("requests_total", "Requests.")
+			r.NewGauge("requests_total", "Requests.")
+		}},
+		{name: "missing label values", use: func(r *Registry) {
+			r.NewCounter("requests_total", "Requests.", "method").Inc()
+		}},
+		{name: "decreased counter", use: func(r *Registry) {
+			r.NewCounter("requests_total", "Requests.").Add(-1)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("didn't panic")
+				}
+			}()
+			test.use(NewRegistry())
+		})
+	}
+}
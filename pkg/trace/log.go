@@ -0,0 +1,27 @@
+package trace
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+// NewServiceTracer creates a tracer for the given service, exporting spans to the destination (stdout or a file path), if any.
+func NewServiceTracer(service, destination string) (*Tracer, error) {
+	exporter, err := NewExporter(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTracer(service, exporter), nil
+}
+
+// Log returns a logger tagging log lines with the trace and span IDs of the span, or an untagged logger if span is nil.
+func Log(span *Span) *logrus.Entry {
+	if span == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+
+	return logrus.WithFields(logrus.Fields{
+		"traceId": span.Context.TraceID,
+		"spanId":  span.Context.SpanID,
+	})
+}
@@ -0,0 +1,304 @@
+// Package trace implements lightweight distributed tracing: spans identified by trace and span IDs,
+// propagated between services using the W3C Trace Context and B3 HTTP headers, and exported as JSON lines.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers used to propagate the span context between services.
+const (
+	// TraceparentHeader carries the span context in the W3C Trace Context format: 00-<trace id>-<span id>-<flags>
+	TraceparentHeader = "traceparent"
+
+	// B3TraceIDHeader carries the trace ID in the B3 (Zipkin) format.
+	B3TraceIDHeader = "X-B3-TraceId"
+
+	// B3SpanIDHeader carries the span ID in the B3 (Zipkin) format.
+	B3SpanIDHeader = "X-B3-SpanId"
+
+	// B3ParentSpanIDHeader carries the ID of the parent span in the B3 (Zipkin) format.
+	B3ParentSpanIDHeader = "X-B3-ParentSpanId"
+
+	// B3SampledHeader carries the sampling decision in the B3 (Zipkin) format.
+	B3SampledHeader = "X-B3-Sampled"
+)
+
+// SpanContext identifies a span, and is the part of a span propagated between services.
+type SpanContext struct {
+	// TraceID is the 32 hex digit ID shared by all spans of a trace.
+	TraceID string
+	// SpanID is the 16 hex digit ID of the span.
+	SpanID string
+	// Sampled is set if the trace should be recorded.
+	Sampled bool
+}
+
+// IsValid returns true if the span context has a well formed trace and span ID.
+func (sc SpanContext) IsValid() bool {
+	return isHexID(sc.TraceID, 32) && isHexID(sc.SpanID, 16)
+}
+
+// Traceparent formats the span context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(value string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("invalid traceparent: %s", value)
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent flags: %s", value)
+	}
+
+	sc := SpanContext{
+		TraceID: parts[1],
+		SpanID:  parts[2],
+		Sampled: flags[0]&1 == 1,
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent IDs: %s", value)
+	}
+	return sc, nil
+}
+
+// Inject sets the span context on the headers of an outgoing request, in both the W3C and the B3 formats.
+func Inject(header http.Header, sc SpanContext, parentID string) {
+	header.Set(TraceparentHeader, sc.Traceparent())
+
+	header.Set(B3TraceIDHeader, sc.TraceID)
+	header.Set(B3SpanIDHeader, sc.SpanID)
+	if parentID != "" {
+		header.Set(B3ParentSpanIDHeader, parentID)
+	}
+	if sc.Sampled {
+		header.Set(B3SampledHeader, "1")
+	} else {
+		header.Set(B3SampledHeader, "0")
+	}
+}
+
+// Extract returns the span context propagated on the headers of an incoming request.
+// The W3C format is preferred over the B3 format when both are present.
+// The returned boolean is false if no valid span context was found.
+func Extract(header http.Header) (SpanContext, bool) {
+	if value := header.Get(TraceparentHeader); value != "" {
+		sc, err := ParseTraceparent(value)
+		if err == nil {
+			return sc, true
+		}
+	}
+
+	sc := SpanContext{
+		TraceID: strings.ToLower(header.Get(B3TraceIDHeader)),
+		SpanID:  strings.ToLower(header.Get(B3SpanIDHeader)),
+		Sampled: header.Get(B3SampledHeader) != "0",
+	}
+
+	// B3 allows 64 bit trace IDs, which are left-padded to the W3C length
+	if len(sc.TraceID) == 16 {
+		sc.TraceID = strings.Repeat("0", 16) + sc.TraceID
+	}
+
+	return sc, sc.IsValid()
+}
+
+// Tracer starts the spans of a service, and exports them once finished.
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// NewTracer creates a tracer for the given service. Spans are not exported if exporter is nil.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{
+		service:  service,
+		exporter: exporter,
+	}
+}
+
+// StartSpan starts a span as a child of the given parent span context,
+// or as the root span of a new trace if the parent is not valid.
+func (t *Tracer) StartSpan(name string, parent SpanContext) *Span {
+	span := &Span{
+		Name:   name,
+		Start:  time.Now(),
+		tracer: t,
+	}
+
+	if parent.IsValid() {
+		span.Context = SpanContext{TraceID: parent.TraceID, SpanID: newID(8), Sampled: parent.Sampled}
+		span.ParentID = parent.SpanID
+	} else {
+		span.Context = SpanContext{TraceID: newID(16), SpanID: newID(8), Sampled: true}
+	}
+
+	return span
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	Name     string
+	Context  SpanContext
+	ParentID string
+	Start    time.Time
+
+	tracer     *Tracer
+	attributes map[string]string
+	finished   bool
+	mutex      sync.Mutex
+}
+
+// Child starts a span as a child of this span.
+func (s *Span) Child(name string) *Span {
+	return s.tracer.StartSpan(name, s.Context)
+}
+
+// SetAttribute annotates the span with a key-value pair, replacing any previous value of the key.
+func (s *Span) SetAttribute(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = value
+}
+
+// Inject sets the span's context on the headers of an outgoing request.
+func (s *Span) Inject(header http.Header) {
+	Inject(header, s.Context, s.ParentID)
+}
+
+// Finish ends the span, and exports it if sampled. Only the first call has any effect.
+func (s *Span) Finish() {
+	s.mutex.Lock()
+	if s.finished {
+		s.mutex.Unlock()
+		return
+	}
+	s.finished = true
+
+	data := SpanData{
+		TraceID:    s.Context.TraceID,
+		SpanID:     s.Context.SpanID,
+		ParentID:   s.ParentID,
+		Service:    s.tracer.service,
+		Name:       s.Name,
+		Start:      s.Start,
+		Duration:   time.Since(s.Start).String(),
+		Attributes: s.attributes,
+	}
+	s.mutex.Unlock()
+
+	if s.tracer.exporter != nil && s.Context.Sampled {
+		s.tracer.exporter.Export(&data)
+	}
+}
+
+type spanKey struct{}
+
+// NewContext returns a copy of ctx carrying the span.
+func NewContext(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// FromContext returns the span carried by ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanData is the exported representation of a finished span.
+type SpanData struct {
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentId,omitempty"`
+	Service    string            `json:"service"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	Duration   string            `json:"duration"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Exporter exports finished spans.
+type Exporter interface {
+	Export(span *SpanData) error
+}
+
+// NewExporter creates an exporter writing spans as JSON lines to the given destination:
+// "stdout", or the path of a file to append to. It returns nil if the destination is empty.
+func NewExporter(destination string) (Exporter, error) {
+	switch destination {
+	case "":
+		return nil, nil
+	case "stdout":
+		return NewWriterExporter(os.Stdout), nil
+	default:
+		f, err := os.OpenFile(destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return NewWriterExporter(f), nil
+	}
+}
+
+// WriterExporter writes spans to a writer, one JSON object per line.
+type WriterExporter struct {
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+// NewWriterExporter creates an exporter writing spans to w.
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// Export writes the span as a single JSON line.
+func (e *WriterExporter) Export(span *SpanData) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.encoder.Encode(span)
+}
+
+// newID returns a random ID of n bytes, hex encoded.
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isHexID returns true if id is a lowercase hex string of the given length, not made of zeros only.
+func isHexID(id string, length int) bool {
+	if len(id) != length || strings.Trim(id, "0") == "" {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
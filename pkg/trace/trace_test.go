@@ -0,0 +1,122 @@
+package trace
+
+import (
+	"net/http"
+	"testing"
+)
+
+const (
+	traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanID  = "00f067aa0ba902b7"
+)
+
+func TestInjectExtractRoundTrip(t *testing.T) {
+	for _, sc := range []SpanContext{
+		{TraceID: traceID, SpanID: spanID, Sampled: true},
+		{TraceID: traceID, SpanID: spanID, Sampled: false},
+	} {
+		header := http.Header{}
+		Inject(header, sc, "b7ad6b7169203331")
+
+		got, ok := Extract(header)
+		if !ok || got != sc {
+			t.Errorf("got %+v, %v after a round trip, want %+v", got, ok, sc)
+		}
+
+		// Services reading B3 headers only get the same span context
+		header.Del(TraceparentHeader)
+		got, ok = Extract(header)
+		if !ok || got != sc {
+			t.Errorf("got %+v, %v after a B3 round trip, want %+v", got, ok, sc)
+		}
+		if parentID := header.Get(B3ParentSpanIDHeader); parentID != "b7ad6b7169203331" {
+			t.Errorf("got B3 parent span ID %q, want the one injected", parentID)
+		}
+	}
+}
+
+func TestSpanInjectContinuesTrace(t *testing.T) {
+	tracer := NewTracer("test", nil)
+	parent := tracer.StartSpan("parent", SpanContext{})
+	child := parent.Child("child")
+
+	header := http.Header{}
+	child.Inject(header)
+
+	got, ok := Extract(header)
+	if !ok || got != child.Context {
+		t.Fatalf("got %+v, %v, want the child's context %+v", got, ok, child.Context)
+	}
+	if got.TraceID != parent.Context.TraceID || header.Get(B3ParentSpanIDHeader) != parent.Context.SpanID {
+		t.Errorf("child %+v doesn't continue the trace of its parent %+v", got, parent.Context)
+	}
+
+	continued := tracer.StartSpan("continued", got)
+	if continued.Context.TraceID != child.Context.TraceID || continued.ParentID != child.Context.SpanID || continued.Context.SpanID == child.Context.SpanID {
+		t.Errorf("got span %+v with parent %s, want a new span of the child's trace", continued.Context, continued.ParentID)
+	}
+}
+
+// newHeader creates request headers from pairs of names and values, canonicalizing the names as received requests do.
+func newHeader(pairs ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i < len(pairs); i += 2 {
+		h.Set(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+func TestExtract(t *testing.T) {
+	valid := SpanContext{TraceID: traceID, SpanID: spanID, Sampled: true}
+	unsampled := SpanContext{TraceID: traceID, SpanID: spanID}
+	b3 := SpanContext{TraceID: "a3ce929d0e0e47364bf92f3577b34da6", SpanID: "b7ad6b7169203331", Sampled: true}
+	b3Header := newHeader(B3TraceIDHeader, b3.TraceID, B3SpanIDHeader, b3.SpanID)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   SpanContext
+		ok     bool
+	}{
+		{name: "traceparent", header: newHeader(TraceparentHeader, "00-"+traceID+"-"+spanID+"-01"), want: valid, ok: true},
+		{name: "traceparent not sampled", header: newHeader(TraceparentHeader, "00-"+traceID+"-"+spanID+"-00"), want: unsampled, ok: true},
+		{name: "traceparent of a later version", header: newHeader(TraceparentHeader, "01-"+traceID+"-"+spanID+"-01-extra"), want: valid, ok: true},
+		{name: "traceparent with spaces", header: newHeader(TraceparentHeader, " 00-"+traceID+"-"+spanID+"-01 "), want: valid, ok: true},
+		{name: "traceparent of an invalid version", header: newHeader(TraceparentHeader, "ff-"+traceID+"-"+spanID+"-01")},
+		{name: "traceparent with extra fields", header: newHeader(TraceparentHeader, "00-"+traceID+"-"+spanID+"-01-extra")},
+		{name: "traceparent missing fields", header: newHeader(TraceparentHeader, "00-"+traceID+"-"+spanID)},
+		{name: "traceparent with invalid flags", header: newHeader(TraceparentHeader, "00-"+traceID+"-"+spanID+"-x1")},
+		{name: "traceparent with a short trace ID", header: newHeader(TraceparentHeader, "00-"+traceID[:16]+"-"+spanID+"-01")},
+		{name: "traceparent with a zero trace ID", header: newHeader(TraceparentHeader, "00-00000000000000000000000000000000-"+spanID+"-01")},
+		{name: "traceparent with a zero span ID", header: newHeader(TraceparentHeader, "00-"+traceID+"-0000000000000000-01")},
+		{name: "traceparent in uppercase", header: newHeader(TraceparentHeader, "00-4BF92F3577B34DA6A3CE929D0E0E4736-"+spanID+"-01")},
+		{name: "b3", header: b3Header, want: b3, ok: true},
+		{name: "b3 not sampled", header: newHeader(B3TraceIDHeader, b3.TraceID, B3SpanIDHeader, b3.SpanID, B3SampledHeader, "0"),
+			want: SpanContext{TraceID: b3.TraceID, SpanID: b3.SpanID}, ok: true},
+		{name: "b3 in uppercase", header: newHeader(B3TraceIDHeader, "A3CE929D0E0E47364BF92F3577B34DA6", B3SpanIDHeader, "B7AD6B7169203331"), want: b3, ok: true},
+		{name: "b3 with a 64 bit trace ID", header: newHeader(B3TraceIDHeader, "a3ce929d0e0e4736", B3SpanIDHeader, b3.SpanID),
+			want: SpanContext{TraceID: "0000000000000000a3ce929d0e0e4736", SpanID: b3.SpanID, Sampled: true}, ok: true},
+		{name: "b3 missing span ID", header: newHeader(B3TraceIDHeader, b3.TraceID)},
+		{name: "b3 with an invalid trace ID", header: newHeader(B3TraceIDHeader, "not-a-trace-id", B3SpanIDHeader, b3.SpanID)},
+		{
+			name:   "traceparent over b3",
+			header: newHeader(TraceparentHeader, "00-"+traceID+"-"+spanID+"-01", B3TraceIDHeader, b3.TraceID, B3SpanIDHeader, b3.SpanID),
+			want:   valid, ok: true,
+		},
+		{
+			name:   "b3 over a malformed traceparent",
+			header: newHeader(TraceparentHeader, "00-garbage", B3TraceIDHeader, b3.TraceID, B3SpanIDHeader, b3.SpanID),
+			want:   b3, ok: true,
+		},
+		{name: "none", header: newHeader()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := Extract(test.header)
+			if ok != test.ok || (ok && got != test.want) {
+				t.Errorf("got %+v, %v, want %+v, %v", got, ok, test.want, test.ok)
+			}
+		})
+	}
+}